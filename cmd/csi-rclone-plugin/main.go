@@ -6,12 +6,27 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/wunderio/csi-rclone/pkg/kube"
 	"github.com/wunderio/csi-rclone/pkg/rclone"
+	"k8s.io/klog"
+	"k8s.io/utils/exec"
 	"os"
+	"time"
 )
 
 var (
-	endpoint string
-	nodeID   string
+	endpoint          string
+	nodeID            string
+	metricsAddr       string
+	metricsMaxVolumes int
+	mounter           string
+	mode              string
+	reconcileInterval time.Duration
+	volumeExpansion   bool
+	topologyKeys      []string
+	shutdownTimeout   time.Duration
+	pluginDir         string
+	configDir         string
+	cacheDir          string
+	evictConsumers    bool
 )
 
 func init() {
@@ -32,12 +47,30 @@ func main() {
 
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 
-	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "node id")
-	cmd.MarkPersistentFlagRequired("nodeid")
+	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "node id, required in node and all modes")
 
 	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
 	cmd.MarkPersistentFlagRequired("endpoint")
 
+	cmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", ":9090", "address to serve Prometheus metrics on, empty to disable")
+	cmd.PersistentFlags().IntVar(&metricsMaxVolumes, "metrics-max-volumes", 100, "maximum number of volumes exported with their own metric labels")
+
+	cmd.PersistentFlags().StringVar(&mounter, "mounter", "deployment", "how volumes are mounted: deployment (a mounter pod per volume) or process (rclone child processes of the plugin)")
+
+	cmd.PersistentFlags().StringVar(&mode, "mode", "all", "services to serve: controller, node or all")
+	cmd.PersistentFlags().DurationVar(&reconcileInterval, "reconcile-interval", 5*time.Minute, "how often mounters are checked for orphans, 0 to disable")
+
+	cmd.PersistentFlags().BoolVar(&volumeExpansion, "enable-volume-expansion", false, "accept PVC resizes, needs the csi-resizer sidecar on the controller")
+
+	cmd.PersistentFlags().StringSliceVar(&topologyKeys, "topology-keys", nil, "node labels reported as topology segments, e.g. topology.kubernetes.io/zone; the first is matched by topologyEndpoints")
+
+	cmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "how long in-flight RPCs may run after SIGTERM")
+	cmd.PersistentFlags().StringVar(&pluginDir, "plugin-dir", "", "host directory for node-local state, empty keeps it in memory")
+	cmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "host directory for the VFS caches of volumes with cacheStorage host, mounted at the same path in the plugin")
+	cmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "tmpfs directory for the rclone configs of controller calls, /dev/shm by default")
+
+	cmd.PersistentFlags().BoolVar(&evictConsumers, "evict-stale-consumers", false, "evict pods that keep the stale mount of a repaired volume, if a controller owns them")
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Prints information about this version of csi rclone plugin",
@@ -61,10 +94,56 @@ Version:    %s
 }
 
 func handle() {
+	driverMode, err := rclone.ParseMode(mode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := rclone.CheckEnvironment(driverMode, nodeID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	kubeClient, err := kube.GetK8sClient()
 	if err != nil {
 		panic(err)
 	}
-	d := rclone.NewDriver(nodeID, endpoint, kubeClient)
+	opts := []rclone.DriverOption{
+		rclone.WithMode(driverMode),
+		rclone.WithReconcileInterval(reconcileInterval),
+		rclone.WithShutdownTimeout(shutdownTimeout),
+		rclone.WithPluginDir(pluginDir),
+		rclone.WithConfigDir(configDir),
+		rclone.WithCacheDir(cacheDir),
+	}
+	if len(topologyKeys) > 0 {
+		opts = append(opts, rclone.WithTopologyKeys(topologyKeys...))
+	}
+	if volumeExpansion {
+		opts = append(opts, rclone.WithVolumeExpansion())
+	}
+	if evictConsumers {
+		opts = append(opts, rclone.WithConsumerEviction())
+	}
+	switch mounter {
+	case "deployment":
+	case "process":
+		ops, err := rclone.NewProcessRclone(kubeClient, exec.New(), nodeID)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, rclone.WithOperations(ops))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mounter %q\n", mounter)
+		os.Exit(1)
+	}
+	d := rclone.NewDriver(nodeID, endpoint, kubeClient, exec.New(), opts...)
+	if metricsAddr != "" {
+		go func() {
+			if err := d.ServeMetrics(metricsAddr, metricsMaxVolumes); err != nil {
+				klog.Errorf("metrics server stopped: %v", err)
+			}
+		}()
+	}
 	d.Run()
 }
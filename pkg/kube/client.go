@@ -6,9 +6,9 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-var clientset *kubernetes.Clientset
+var clientset kubernetes.Interface
 
-func GetK8sClient() (*kubernetes.Clientset, error) {
+func GetK8sClient() (kubernetes.Interface, error) {
 	if clientset != nil {
 		return clientset, nil
 	}
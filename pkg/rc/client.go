@@ -0,0 +1,316 @@
+// Package rc is a client of the rclone remote control API, which every
+// mounter serves on DefaultPort.
+package rc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultPort is the port mounters serve the rc API on.
+const DefaultPort = 5572
+
+// DefaultTimeout bounds each call unless WithTimeout changes it.
+const DefaultTimeout = 5 * time.Second
+
+// Client calls the rc API of one rclone process.
+type Client struct {
+	baseURL  string
+	user     string
+	password string
+	http     *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAuth sets the user and password of rclone --rc-user and --rc-pass.
+func WithAuth(user, password string) Option {
+	return func(c *Client) {
+		c.user, c.password = user, password
+	}
+}
+
+// WithTimeout bounds each call to timeout, zero means no bound.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.Timeout = timeout
+	}
+}
+
+// New returns a client of the rc API at addr, which is host:port, an
+// http(s) URL, or the path of a unix socket as given to --rc-addr, with or
+// without a unix:// prefix.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{http: &http.Client{Timeout: DefaultTimeout}}
+	switch {
+	case strings.HasPrefix(addr, "unix://") || strings.HasPrefix(addr, "/"):
+		socket := strings.TrimPrefix(addr, "unix://")
+		c.baseURL = "http://unix"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	case strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://"):
+		c.baseURL = strings.TrimSuffix(addr, "/")
+	default:
+		c.baseURL = "http://" + addr
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// PodAddress returns the rc address of a mounter pod with podIP.
+func PodAddress(podIP string) string {
+	return net.JoinHostPort(podIP, strconv.Itoa(DefaultPort))
+}
+
+// Error is a failed rc call.
+type Error struct {
+	Method string
+	Status int
+	// Message is the error rclone replied with, or the reply body when it
+	// is not an rc error.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rc %s returned %d %s: %s", e.Method, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Call posts in as JSON to the rc method and decodes the reply into out,
+// unless out is nil.
+func (c *Client) Call(ctx context.Context, method string, in, out interface{}) error {
+	if in == nil {
+		in = struct{}{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != "" || c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		rcErr := &Error{Method: method, Status: resp.StatusCode, Message: string(bytes.TrimSpace(data))}
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &reply) == nil && reply.Error != "" {
+			rcErr.Message = reply.Error
+		}
+		return rcErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// CoreStats is the reply of core/stats.
+type CoreStats struct {
+	Bytes          float64 `json:"bytes"`
+	Checks         float64 `json:"checks"`
+	DeletedDirs    float64 `json:"deletedDirs"`
+	Deletes        float64 `json:"deletes"`
+	ElapsedTime    float64 `json:"elapsedTime"`
+	Errors         float64 `json:"errors"`
+	FatalError     bool    `json:"fatalError"`
+	LastError      string  `json:"lastError"`
+	RetryError     bool    `json:"retryError"`
+	Speed          float64 `json:"speed"`
+	TotalBytes     float64 `json:"totalBytes"`
+	TotalChecks    float64 `json:"totalChecks"`
+	TotalTransfers float64 `json:"totalTransfers"`
+	TransferTime   float64 `json:"transferTime"`
+	Transfers      float64 `json:"transfers"`
+}
+
+// CoreStats returns the transfer statistics of the process.
+func (c *Client) CoreStats(ctx context.Context) (*CoreStats, error) {
+	stats := &CoreStats{}
+	return stats, c.Call(ctx, "core/stats", nil, stats)
+}
+
+// DiskCacheStats are the VFS cache statistics, present with a cache mode
+// other than off.
+type DiskCacheStats struct {
+	BytesUsed         float64 `json:"bytesUsed"`
+	Files             float64 `json:"files"`
+	ErroredFiles      float64 `json:"erroredFiles"`
+	UploadsInProgress float64 `json:"uploadsInProgress"`
+	UploadsQueued     float64 `json:"uploadsQueued"`
+	OutOfSpace        bool    `json:"outOfSpace"`
+	Path              string  `json:"path"`
+}
+
+// VfsStats is the reply of vfs/stats.
+type VfsStats struct {
+	Fs            string          `json:"fs"`
+	InUse         int             `json:"inUse"`
+	DiskCache     *DiskCacheStats `json:"diskCache"`
+	MetadataCache struct {
+		Dirs  int `json:"dirs"`
+		Files int `json:"files"`
+	} `json:"metadataCache"`
+}
+
+// VfsStats returns the statistics of the VFS of fs, which may be empty when
+// the process has a single VFS, as mounters do.
+func (c *Client) VfsStats(ctx context.Context, fs string) (*VfsStats, error) {
+	stats := &VfsStats{}
+	return stats, c.Call(ctx, "vfs/stats", fsParams(fs), stats)
+}
+
+// VfsForget drops files and dirs from the directory cache of the VFS of fs,
+// everything when both are empty, and returns what was forgotten.
+func (c *Client) VfsForget(ctx context.Context, fs string, files, dirs []string) ([]string, error) {
+	params := fsParams(fs)
+	numbered(params, "file", files)
+	numbered(params, "dir", dirs)
+	var reply struct {
+		Forgotten []string `json:"forgotten"`
+	}
+	err := c.Call(ctx, "vfs/forget", params, &reply)
+	return reply.Forgotten, err
+}
+
+// VfsRefresh reads dirs of the VFS of fs into its directory cache, the root
+// when dirs is empty, and returns the result per directory, "OK" or an error.
+func (c *Client) VfsRefresh(ctx context.Context, fs string, dirs []string, recursive bool) (map[string]string, error) {
+	params := fsParams(fs)
+	numbered(params, "dir", dirs)
+	if recursive {
+		params["recursive"] = "true"
+	}
+	var reply struct {
+		Result map[string]string `json:"result"`
+	}
+	err := c.Call(ctx, "vfs/refresh", params, &reply)
+	return reply.Result, err
+}
+
+// BwLimit is the reply of core/bwlimit.
+type BwLimit struct {
+	BytesPerSecond   int64  `json:"bytesPerSecond"`
+	BytesPerSecondTx int64  `json:"bytesPerSecondTx"`
+	BytesPerSecondRx int64  `json:"bytesPerSecondRx"`
+	Rate             string `json:"rate"`
+}
+
+// BwLimit sets the bandwidth limit to rate, in the --bwlimit format such as
+// "10M" or "off", and returns the limit in effect. An empty rate only reads
+// it.
+func (c *Client) BwLimit(ctx context.Context, rate string) (*BwLimit, error) {
+	params := map[string]string{}
+	if rate != "" {
+		params["rate"] = rate
+	}
+	limit := &BwLimit{}
+	return limit, c.Call(ctx, "core/bwlimit", params, limit)
+}
+
+// OptionsSet changes global options of the process, by block and option
+// name as listed by options/get, such as {"main": {"Transfers": 8}}.
+func (c *Client) OptionsSet(ctx context.Context, options map[string]map[string]interface{}) error {
+	return c.Call(ctx, "options/set", options, nil)
+}
+
+// ConfigUpdate sets parameters of the remote name in the config of the
+// process, non-interactively. Values are passed as they are, obscured ones
+// must already be obscured.
+func (c *Client) ConfigUpdate(ctx context.Context, name string, parameters map[string]string) error {
+	params := map[string]interface{}{
+		"name":       name,
+		"parameters": parameters,
+		"opt": map[string]bool{
+			"nonInteractive": true,
+			"noObscure":      true,
+		},
+	}
+	return c.Call(ctx, "config/update", params, nil)
+}
+
+// FsCacheClear drops the backends the process built and cached, so the next
+// use of a remote builds it again from the current config.
+func (c *Client) FsCacheClear(ctx context.Context) error {
+	return c.Call(ctx, "fscache/clear", nil, nil)
+}
+
+// ConfigGet returns the options of the remote name as the process currently
+// has them, including tokens it refreshed.
+func (c *Client) ConfigGet(ctx context.Context, name string) (map[string]string, error) {
+	options := map[string]string{}
+	return options, c.Call(ctx, "config/get", map[string]string{"name": name}, &options)
+}
+
+// Mount is a mount listed by mount/listmounts.
+type Mount struct {
+	Fs         string    `json:"Fs"`
+	MountPoint string    `json:"MountPoint"`
+	MountedOn  time.Time `json:"MountedOn"`
+}
+
+// ListMounts returns the mounts made through the rc API of the process.
+// Mounters started as rclone mount do not list their own mount.
+func (c *Client) ListMounts(ctx context.Context) ([]Mount, error) {
+	var reply struct {
+		MountPoints []Mount `json:"mountPoints"`
+	}
+	err := c.Call(ctx, "mount/listmounts", nil, &reply)
+	return reply.MountPoints, err
+}
+
+// Quit asks the process to exit with exitCode.
+func (c *Client) Quit(ctx context.Context, exitCode int) error {
+	return c.Call(ctx, "core/quit", map[string]int{"exitCode": exitCode}, nil)
+}
+
+func fsParams(fs string) map[string]string {
+	params := map[string]string{}
+	if fs != "" {
+		params["fs"] = fs
+	}
+	return params
+}
+
+// numbered adds values as key, key2, key3... the way rc methods taking
+// several paths expect them.
+func numbered(params map[string]string, key string, values []string) {
+	for i, value := range values {
+		if i == 0 {
+			params[key] = value
+		} else {
+			params[key+strconv.Itoa(i+1)] = value
+		}
+	}
+}
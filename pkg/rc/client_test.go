@@ -0,0 +1,279 @@
+package rc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRc serves reply for every method and records the last request.
+type fakeRc struct {
+	method string
+	params map[string]interface{}
+	user   string
+	pass   string
+	status int
+	reply  string
+}
+
+func (f *fakeRc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.method = strings.TrimPrefix(r.URL.Path, "/")
+	f.user, f.pass, _ = r.BasicAuth()
+	body, _ := ioutil.ReadAll(r.Body)
+	f.params = nil
+	json.Unmarshal(body, &f.params)
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+	}
+	w.Write([]byte(f.reply))
+}
+
+func newFakeRc(t *testing.T, reply string) (*fakeRc, *Client) {
+	f := &fakeRc{reply: reply}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, New(strings.TrimPrefix(server.URL, "http://"))
+}
+
+func TestClientMethods(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      string
+		call       func(*Client) (interface{}, error)
+		wantMethod string
+		wantParams map[string]interface{}
+		want       interface{}
+	}{
+		{
+			name:  "core/stats",
+			reply: `{"bytes": 1024, "errors": 1, "transfers": 2, "lastError": "boom"}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.CoreStats(context.Background())
+			},
+			wantMethod: "core/stats",
+			wantParams: map[string]interface{}{},
+			want:       &CoreStats{Bytes: 1024, Errors: 1, Transfers: 2, LastError: "boom"},
+		},
+		{
+			name:  "vfs/stats",
+			reply: `{"fs": "minio:base", "inUse": 1, "diskCache": {"uploadsQueued": 3}}`,
+			call: func(c *Client) (interface{}, error) {
+				stats, err := c.VfsStats(context.Background(), "")
+				return stats.DiskCache, err
+			},
+			wantMethod: "vfs/stats",
+			wantParams: map[string]interface{}{},
+			want:       &DiskCacheStats{UploadsQueued: 3},
+		},
+		{
+			name:  "vfs/forget",
+			reply: `{"forgotten": ["a", "b/c"]}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.VfsForget(context.Background(), "minio:base", []string{"a", "b/c"}, nil)
+			},
+			wantMethod: "vfs/forget",
+			wantParams: map[string]interface{}{"fs": "minio:base", "file": "a", "file2": "b/c"},
+			want:       []string{"a", "b/c"},
+		},
+		{
+			name:  "vfs/refresh",
+			reply: `{"result": {"": "OK", "data": "OK"}}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.VfsRefresh(context.Background(), "", []string{"", "data"}, true)
+			},
+			wantMethod: "vfs/refresh",
+			wantParams: map[string]interface{}{"dir": "", "dir2": "data", "recursive": "true"},
+			want:       map[string]string{"": "OK", "data": "OK"},
+		},
+		{
+			name:  "core/bwlimit",
+			reply: `{"bytesPerSecond": 1048576, "rate": "1Mi"}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.BwLimit(context.Background(), "1M")
+			},
+			wantMethod: "core/bwlimit",
+			wantParams: map[string]interface{}{"rate": "1M"},
+			want:       &BwLimit{BytesPerSecond: 1048576, Rate: "1Mi"},
+		},
+		{
+			name:  "options/set",
+			reply: `{}`,
+			call: func(c *Client) (interface{}, error) {
+				return nil, c.OptionsSet(context.Background(), map[string]map[string]interface{}{"main": {"TPSLimit": 2.5, "Transfers": 8}})
+			},
+			wantMethod: "options/set",
+			wantParams: map[string]interface{}{"main": map[string]interface{}{"TPSLimit": 2.5, "Transfers": float64(8)}},
+		},
+		{
+			name:  "config/update",
+			reply: `{}`,
+			call: func(c *Client) (interface{}, error) {
+				return nil, c.ConfigUpdate(context.Background(), "minio", map[string]string{"secret_access_key": "new"})
+			},
+			wantMethod: "config/update",
+			wantParams: map[string]interface{}{
+				"name":       "minio",
+				"parameters": map[string]interface{}{"secret_access_key": "new"},
+				"opt":        map[string]interface{}{"nonInteractive": true, "noObscure": true},
+			},
+		},
+		{
+			name:  "fscache/clear",
+			reply: `{}`,
+			call: func(c *Client) (interface{}, error) {
+				return nil, c.FsCacheClear(context.Background())
+			},
+			wantMethod: "fscache/clear",
+			wantParams: map[string]interface{}{},
+		},
+		{
+			name:  "config/get",
+			reply: `{"type": "drive", "token": "{\"access_token\":\"new\"}"}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.ConfigGet(context.Background(), "drive")
+			},
+			wantMethod: "config/get",
+			wantParams: map[string]interface{}{"name": "drive"},
+			want:       map[string]string{"type": "drive", "token": `{"access_token":"new"}`},
+		},
+		{
+			name:  "mount/listmounts",
+			reply: `{"mountPoints": [{"Fs": "minio:base", "MountPoint": "/mnt"}]}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.ListMounts(context.Background())
+			},
+			wantMethod: "mount/listmounts",
+			wantParams: map[string]interface{}{},
+			want:       []Mount{{Fs: "minio:base", MountPoint: "/mnt"}},
+		},
+		{
+			name:  "core/quit",
+			reply: `{}`,
+			call: func(c *Client) (interface{}, error) {
+				return nil, c.Quit(context.Background(), 3)
+			},
+			wantMethod: "core/quit",
+			wantParams: map[string]interface{}{"exitCode": float64(3)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, c := newFakeRc(t, tc.reply)
+			got, err := tc.call(c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if f.method != tc.wantMethod {
+				t.Errorf("expected method %s, got %s", tc.wantMethod, f.method)
+			}
+			if !reflect.DeepEqual(f.params, tc.wantParams) {
+				t.Errorf("expected params %v, got %v", tc.wantParams, f.params)
+			}
+			if tc.want != nil && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		reply       string
+		wantMessage string
+	}{
+		{
+			name:        "rc error",
+			status:      http.StatusInternalServerError,
+			reply:       `{"error": "no VFS found with name \"nope\"", "status": 500}`,
+			wantMessage: `no VFS found with name "nope"`,
+		},
+		{
+			name:        "plain text",
+			status:      http.StatusUnauthorized,
+			reply:       "Unauthorized\n",
+			wantMessage: "Unauthorized",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, c := newFakeRc(t, tc.reply)
+			f.status = tc.status
+			_, err := c.CoreStats(context.Background())
+			var rcErr *Error
+			if !errors.As(err, &rcErr) {
+				t.Fatalf("expected an rc error, got %v", err)
+			}
+			if rcErr.Status != tc.status || rcErr.Message != tc.wantMessage {
+				t.Errorf("expected %d %q, got %d %q", tc.status, tc.wantMessage, rcErr.Status, rcErr.Message)
+			}
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	f := &fakeRc{reply: `{}`}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	if err := New(server.URL, WithAuth("rc", "secret")).Quit(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.user != "rc" || f.pass != "secret" {
+		t.Errorf("expected basic auth rc:secret, got %s:%s", f.user, f.pass)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	if _, err := New(server.URL, WithTimeout(20*time.Millisecond)).CoreStats(context.Background()); err == nil {
+		t.Fatal("expected a timeout")
+	}
+}
+
+func TestClientSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "rc.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	f := &fakeRc{reply: `{"rate": "off"}`}
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: f}}
+	server.Start()
+	defer server.Close()
+
+	for _, addr := range []string{socket, "unix://" + socket} {
+		limit, err := New(addr).BwLimit(context.Background(), "")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if limit.Rate != "off" || f.method != "core/bwlimit" {
+			t.Errorf("%s: expected core/bwlimit off, got %s %s", addr, f.method, limit.Rate)
+		}
+	}
+}
+
+func TestPodAddress(t *testing.T) {
+	if got := PodAddress("10.0.0.7"); got != "10.0.0.7:5572" {
+		t.Errorf("expected 10.0.0.7:5572, got %s", got)
+	}
+	if got := PodAddress("fd00::7"); got != "[fd00::7]:5572" {
+		t.Errorf("expected [fd00::7]:5572, got %s", got)
+	}
+}
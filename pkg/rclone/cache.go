@@ -0,0 +1,184 @@
+package rclone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+)
+
+// Volume attributes placing the VFS cache of a mounter. Without
+// cacheStorageKey the cache stays in the writable layer of the mounter
+// container.
+const (
+	cacheStorageKey = "cacheStorage"
+	cacheSizeKey    = "cacheSize"
+	cacheMaxAgeKey  = "cacheMaxAge"
+
+	// cacheStorageHost keeps the cache in a directory of the node under
+	// --cache-dir, which outlives the mounter pod.
+	cacheStorageHost = "host"
+	// cacheStorageEmptyDir keeps the cache in an emptyDir limited to the
+	// cache size, which outlives mounter container restarts.
+	cacheStorageEmptyDir = "emptyDir"
+	// cacheStorageContainer is the writable layer of the mounter container.
+	cacheStorageContainer = "container"
+)
+
+// mounterCacheDir is where mounters find dedicated cache storage.
+const mounterCacheDir = "/cache"
+
+// cacheHeadroom is added to the emptyDir size limit, rclone only evicts
+// files that are not open and may exceed its maximum size for a while, which
+// would get the mounter evicted.
+const cacheHeadroom = 0.25
+
+// cacheCollectAge spares caches younger than this from collection, their
+// mounter may have been created after the mounters were listed.
+const cacheCollectAge = 10 * time.Minute
+
+// vfsCache is where and how much a mounter caches.
+type vfsCache struct {
+	Storage string
+	// Size is the --vfs-cache-max-size, nil keeps the default.
+	Size *resource.Quantity
+	// MaxAge is the --vfs-cache-max-age, empty keeps the default.
+	MaxAge string
+}
+
+// parseCacheOptions reads the cache attributes, nil when none is set.
+func parseCacheOptions(attributes map[string]string) (*vfsCache, error) {
+	storage, hasStorage := attributes[cacheStorageKey]
+	size, hasSize := attributes[cacheSizeKey]
+	maxAge, hasMaxAge := attributes[cacheMaxAgeKey]
+	if !hasStorage && !hasSize && !hasMaxAge {
+		return nil, nil
+	}
+
+	cache := &vfsCache{Storage: cacheStorageContainer, MaxAge: maxAge}
+	switch storage {
+	case "", cacheStorageContainer:
+	case cacheStorageHost, cacheStorageEmptyDir:
+		cache.Storage = storage
+	default:
+		return nil, fmt.Errorf("unknown %s %q, expected %s, %s or %s", cacheStorageKey, storage, cacheStorageHost, cacheStorageEmptyDir, cacheStorageContainer)
+	}
+	if hasSize {
+		quantity, err := resource.ParseQuantity(size)
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a size such as 10Gi", cacheSizeKey, size)
+		}
+		cache.Size = &quantity
+	}
+	if cache.Storage == cacheStorageEmptyDir && cache.Size == nil {
+		return nil, fmt.Errorf("%s %s needs %s", cacheStorageKey, cacheStorageEmptyDir, cacheSizeKey)
+	}
+	if hasMaxAge {
+		if _, err := time.ParseDuration(maxAge); err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected a duration such as 24h", cacheMaxAgeKey, maxAge)
+		}
+	}
+	return cache, nil
+}
+
+// mountFlags are the rclone flags applying the cache settings, with the
+// cache kept under dir unless the storage is the container's.
+func (c *vfsCache) mountFlags(dir string) map[string]string {
+	flags := map[string]string{}
+	if c.Storage != cacheStorageContainer {
+		flags["cache-dir"] = dir
+	}
+	if c.Size != nil {
+		// rclone reads bare numbers as KiB.
+		flags["vfs-cache-max-size"] = fmt.Sprintf("%dB", c.Size.Value())
+	}
+	if c.MaxAge != "" {
+		flags["vfs-cache-max-age"] = c.MaxAge
+	}
+	return flags
+}
+
+// volume is the mounter pod volume holding the cache of a volume, nil with
+// container storage. hostDir is the node directory of host caches.
+func (c *vfsCache) volume(hostDir string) *corev1.Volume {
+	switch c.Storage {
+	case cacheStorageHost:
+		hostPathCreate := corev1.HostPathDirectoryOrCreate
+		return &corev1.Volume{
+			Name: "cache",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: hostDir, Type: &hostPathCreate},
+			},
+		}
+	case cacheStorageEmptyDir:
+		limit := resource.NewQuantity(c.Size.Value()+int64(float64(c.Size.Value())*cacheHeadroom), resource.BinarySI)
+		return &corev1.Volume{
+			Name: "cache",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: limit},
+			},
+		}
+	}
+	return nil
+}
+
+// volumeCacheDir returns the node directory caching volumeId under cacheDir.
+func volumeCacheDir(cacheDir, volumeId string) string {
+	return filepath.Join(cacheDir, (&RcloneVolume{ID: volumeId}).normalizedVolumeId())
+}
+
+// hostCacheDir returns the node directory of the host cache of
+// rcloneVolume, or fails when the node has no --cache-dir.
+func (r *Rclone) hostCacheDir(rcloneVolume *RcloneVolume) (string, error) {
+	if r.cacheDir == "" {
+		return "", status.Errorf(codes.FailedPrecondition, "%s %s needs the node plugin to run with --cache-dir", cacheStorageKey, cacheStorageHost)
+	}
+	return volumeCacheDir(r.cacheDir, rcloneVolume.ID), nil
+}
+
+// removeCache deletes the host cache of volumeId, if there is one.
+func (r *Rclone) removeCache(volumeId string) error {
+	if r.cacheDir == "" {
+		return nil
+	}
+	dir := volumeCacheDir(r.cacheDir, volumeId)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	klog.Infof("removing the VFS cache of volume %s in %s", volumeId, dir)
+	return os.RemoveAll(dir)
+}
+
+// collectCaches deletes host caches of volumes without a mounter on this
+// node, left behind when a removal raced the exiting mounter or the plugin
+// was down.
+func (r *Rclone) collectCaches(mounted map[string]bool) error {
+	if r.cacheDir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(r.cacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || mounted[entry.Name()] || time.Since(entry.ModTime()) < cacheCollectAge {
+			continue
+		}
+		dir := filepath.Join(r.cacheDir, entry.Name())
+		klog.Infof("removing the VFS cache in %s, its volume has no mounter on node %s", dir, r.nodeID)
+		if err := os.RemoveAll(dir); err != nil {
+			klog.Errorf("removing %s: %v", dir, err)
+		}
+	}
+	return nil
+}
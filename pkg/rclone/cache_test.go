@@ -0,0 +1,199 @@
+package rclone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCacheOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		wantFlags  map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "unset",
+			attributes: map[string]string{"remote": "minio"},
+		},
+		{
+			name:       "host",
+			attributes: map[string]string{cacheStorageKey: "host", cacheSizeKey: "10Gi", cacheMaxAgeKey: "24h"},
+			wantFlags:  map[string]string{"cache-dir": mounterCacheDir, "vfs-cache-max-size": "10737418240B", "vfs-cache-max-age": "24h"},
+		},
+		{
+			name:       "size only",
+			attributes: map[string]string{cacheSizeKey: "500M"},
+			wantFlags:  map[string]string{"vfs-cache-max-size": "500000000B"},
+		},
+		{
+			name:       "emptyDir without size",
+			attributes: map[string]string{cacheStorageKey: "emptyDir"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown storage",
+			attributes: map[string]string{cacheStorageKey: "nfs"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid size",
+			attributes: map[string]string{cacheSizeKey: "lots"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid age",
+			attributes: map[string]string{cacheMaxAgeKey: "a week"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := parseCacheOptions(tc.attributes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if tc.wantFlags == nil {
+				if cache != nil {
+					t.Errorf("expected no cache options, got %+v", cache)
+				}
+				return
+			}
+			if flags := cache.mountFlags(mounterCacheDir); !reflect.DeepEqual(flags, tc.wantFlags) {
+				t.Errorf("expected flags %v, got %v", tc.wantFlags, flags)
+			}
+		})
+	}
+}
+
+func TestMountCacheStorage(t *testing.T) {
+	tests := []struct {
+		name       string
+		storage    string
+		cacheDir   string
+		wantVolume func(cacheDir string) corev1.VolumeSource
+		wantCode   codes.Code
+	}{
+		{
+			name:     "host",
+			storage:  cacheStorageHost,
+			cacheDir: "/var/lib/csi-rclone-cache",
+			wantVolume: func(cacheDir string) corev1.VolumeSource {
+				hostPathCreate := corev1.HostPathDirectoryOrCreate
+				return corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: filepath.Join(cacheDir, "vol-1"), Type: &hostPathCreate}}
+			},
+		},
+		{
+			name:     "host without cache dir",
+			storage:  cacheStorageHost,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "emptyDir",
+			storage: cacheStorageEmptyDir,
+			wantVolume: func(string) corev1.VolumeSource {
+				// 8Gi and the headroom.
+				limit := resource.MustParse("10Gi")
+				return corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &limit}}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone())
+			ops := td.ns.RcloneOps.(*Rclone)
+			ops.cacheDir = tc.cacheDir
+			cache, err := parseCacheOptions(map[string]string{cacheStorageKey: tc.storage, cacheSizeKey: "8Gi"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			vol := &RcloneVolume{ID: "vol-1", Remote: "minio", RemotePath: "base/pvc-1", Cache: cache}
+			err = ops.Mount(context.Background(), vol, filepath.Join(t.TempDir(), "mount"), testRcloneConf, map[string]string{})
+			if status.Code(err) != tc.wantCode {
+				t.Fatalf("expected %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+
+			deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get(vol.deploymentName(), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec := deployment.Spec.Template.Spec
+			var source *corev1.VolumeSource
+			for i := range spec.Volumes {
+				if spec.Volumes[i].Name == "cache" {
+					source = &spec.Volumes[i].VolumeSource
+				}
+			}
+			if want := tc.wantVolume(tc.cacheDir); source == nil || !equality.Semantic.DeepEqual(*source, want) {
+				t.Errorf("expected cache volume %+v, got %+v", want, source)
+			}
+			if !contains(spec.Containers[0].Args, "--cache-dir="+mounterCacheDir) || !contains(spec.Containers[0].Args, "--vfs-cache-max-size=8589934592B") {
+				t.Errorf("expected the cache flags in %v", spec.Containers[0].Args)
+			}
+		})
+	}
+}
+
+func TestHostCacheRemoved(t *testing.T) {
+	running := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-running"},
+		Spec:       corev1.PodSpec{NodeName: testNodeID},
+	}
+	td := newTestDriver(newFakeRclone(), running)
+	ops := td.ns.RcloneOps.(*Rclone)
+	ops.cacheDir = t.TempDir()
+	cache := &vfsCache{Storage: cacheStorageHost}
+	kubelet := t.TempDir()
+	for _, id := range []string{"vol-1", "vol-2"} {
+		vol := &RcloneVolume{ID: id, Remote: "minio", RemotePath: "base/" + id, Cache: cache}
+		targetPath := filepath.Join(kubelet, "pods", "uid-running", "volumes", "kubernetes.io~csi", id, "mount")
+		if err := ops.Mount(context.Background(), vol, targetPath, testRcloneConf, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		// Kubelet creates the directory when the mounter starts.
+		if err := os.MkdirAll(filepath.Join(ops.cacheDir, id, "vfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := filepath.Join(ops.cacheDir, "vol-gone")
+	old := time.Now().Add(-2 * cacheCollectAge)
+	for _, dir := range []string{stale, filepath.Join(ops.cacheDir, "vol-new")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(stale, old, old)
+
+	if err := ops.Unmount(context.Background(), &RcloneVolume{ID: "vol-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.reconcileNodeMounters(context.Background(), td.mounter); err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, want := range map[string]bool{"vol-1": true, "vol-2": false, "vol-gone": false, "vol-new": true} {
+		_, err := os.Stat(filepath.Join(ops.cacheDir, dir))
+		if exists := err == nil; exists != want {
+			t.Errorf("expected cache %s kept %v, got %v", dir, want, exists)
+		}
+	}
+}
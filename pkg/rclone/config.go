@@ -0,0 +1,78 @@
+package rclone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// configDirName is the private directory of controller rclone configs,
+// created under the config base directory.
+const configDirName = "csi-rclone-conf"
+
+// configProvider hands the rclone.conf of provisioner secrets to rclone runs
+// as 0600 files in a private directory, each removed once its call is done.
+type configProvider struct {
+	dir string
+}
+
+// newConfigProvider keeps configs under base, /dev/shm when empty so they
+// never reach a disk, or the temp directory without it. Configs left behind
+// by a plugin that did not exit cleanly are removed.
+func newConfigProvider(base string) *configProvider {
+	if base == "" {
+		base = os.TempDir()
+		if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+			base = "/dev/shm"
+		}
+	}
+	p := &configProvider{dir: filepath.Join(base, configDirName)}
+	stale, _ := filepath.Glob(filepath.Join(p.dir, "*.conf"))
+	for _, path := range stale {
+		klog.Infof("removing stale rclone config %s", path)
+		if err := os.Remove(path); err != nil {
+			klog.Warningf("removing %s: %v", path, err)
+		}
+	}
+	return p
+}
+
+// provide writes the rclone.conf of secrets and returns its path and the
+// function removing it, to be deferred by the caller.
+func (p *configProvider) provide(secrets map[string]string) (string, func(), error) {
+	rcloneConfData, ok := secrets["rclone.conf"]
+	if !ok {
+		return "", nil, status.Error(codes.InvalidArgument, "rclone.conf key in secret not found")
+	}
+
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return "", nil, err
+	}
+	if err := os.Chmod(p.dir, 0700); err != nil {
+		return "", nil, err
+	}
+	// TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(p.dir, "rclone-*.conf")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("removing rclone config %s: %v", f.Name(), err)
+		}
+	}
+	if _, err := f.Write([]byte(rcloneConfData)); err != nil {
+		f.Close()
+		remove()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return f.Name(), remove, nil
+}
@@ -0,0 +1,144 @@
+package rclone
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestConfigProvider(t *testing.T) {
+	base := t.TempDir()
+	stale := filepath.Join(base, configDirName, "rclone-1.conf")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stale, []byte(testRcloneConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newConfigProvider(base)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale config to be removed, got %v", err)
+	}
+
+	path, remove, err := p.provide(testSecrets)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != testRcloneConf {
+		t.Errorf("expected the secret in %s, got %q (%v)", path, data, err)
+	}
+	for name, want := range map[string]os.FileMode{path: 0600, p.dir: 0700} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != want {
+			t.Errorf("expected %s to have mode %v, got %v", name, want, mode)
+		}
+	}
+	remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", path, err)
+	}
+
+	if _, _, err := p.provide(map[string]string{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without rclone.conf, got %v", err)
+	}
+}
+
+// TestControllerLeavesNoConfig runs controller calls that succeed and fail at
+// every step and checks no rclone config outlives them.
+func TestControllerLeavesNoConfig(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	createReq := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+		Parameters:         map[string]string{"remote": "minio", "path": "base"},
+		Secrets:            testSecrets,
+	}
+	tests := []struct {
+		name   string
+		call   func(*testDriver) error
+		rclone []rcloneResult
+	}{
+		{
+			name: "create succeeds",
+			call: func(td *testDriver) error {
+				_, err := td.cs.CreateVolume(context.Background(), createReq)
+				return err
+			},
+			rclone: []rcloneResult{{}, {}},
+		},
+		{
+			name: "pre-flight fails",
+			call: func(td *testDriver) error {
+				_, err := td.cs.CreateVolume(context.Background(), createReq)
+				return err
+			},
+			rclone: []rcloneResult{{output: "AccessDenied", err: errRcloneFailed}},
+		},
+		{
+			name: "mkdir fails",
+			call: func(td *testDriver) error {
+				_, err := td.cs.CreateVolume(context.Background(), createReq)
+				return err
+			},
+			rclone: []rcloneResult{{}, {output: "quota exceeded", err: errRcloneFailed}},
+		},
+		{
+			name: "invalid parameters",
+			call: func(td *testDriver) error {
+				req := *createReq
+				req.Parameters = map[string]string{"remote": "minio"}
+				_, err := td.cs.CreateVolume(context.Background(), &req)
+				return err
+			},
+		},
+		{
+			name: "delete succeeds",
+			call: func(td *testDriver) error {
+				_, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets})
+				return err
+			},
+			rclone: []rcloneResult{{}},
+		},
+		{
+			name: "delete fails",
+			call: func(td *testDriver) error {
+				_, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets})
+				return err
+			},
+			rclone: []rcloneResult{{output: "connection refused", err: errRcloneFailed}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(tc.rclone...), []runtime.Object{pv}...)
+			td.cs.configs = newConfigProvider(t.TempDir())
+			tc.call(td)
+
+			for _, call := range td.rclone.calls {
+				for _, arg := range call {
+					if strings.HasPrefix(arg, "--config=") && !strings.HasPrefix(arg, "--config="+td.cs.configs.dir+"/") {
+						t.Errorf("expected the config under %s, got %s", td.cs.configs.dir, arg)
+					}
+				}
+			}
+			entries, _ := ioutil.ReadDir(td.cs.configs.dir)
+			for _, e := range entries {
+				t.Errorf("expected no config left behind, found %s", e.Name())
+			}
+		})
+	}
+}
@@ -1,21 +1,51 @@
 package rclone
 
 import (
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	RcloneOps Operations
+	RcloneOps    Operations
+	reporter     *volumeReporter
+	topologyKeys []string
+	locks        *operationLocks
+	configs      *configProvider
+	// volumes finds the PersistentVolumes of existing volumes.
+	volumes *volumeCache
+
+	// created holds the volumes this controller created and did not delete,
+	// which may not have a PersistentVolume yet.
+	createdMu sync.Mutex
+	created   map[string]createdVolume
+}
+
+// createdVolume is a volume created by this controller.
+type createdVolume struct {
+	capacity int64
+	// volume locates the directories of the volume on its remotes.
+	volume *RcloneVolume
+}
+
+// volumeIdNamespace derives volume ids from volume names, so a retried
+// CreateVolume returns the id of the volume it already created.
+var volumeIdNamespace = uuid.MustParse("5f0c3b1e-6a57-4a4e-9f3c-2c1d8e7b9a10")
+
+func volumeIdFor(volumeName string) string {
+	return uuid.NewSHA1(volumeIdNamespace, []byte(volumeName)).String()
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -25,6 +55,9 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	if len(req.GetVolumeCapabilities()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume without capabilities")
 	}
+	if _, err := cs.volumeCapacity(req.GetVolumeId()); err != nil {
+		return nil, statusError(err, codes.Internal)
+	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeContext:      req.VolumeContext,
@@ -52,63 +85,312 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume without capabilities")
 	}
 
-	rcloneConfPath, err := extractRcloneConf(req.Secrets)
+	volumeId := volumeIdFor(volumeName)
+	if err := cs.locks.acquire(volumeId, volumeLockKey(volumeId)); err != nil {
+		return nil, err
+	}
+	defer cs.locks.Release(volumeLockKey(volumeId))
+
+	// Remotes are not sized, the capacity only tells a retry from another
+	// request for the same name.
+	capacity, err := cs.volumeCapacity(volumeId)
+	switch {
+	case err == nil && !capacityFits(capacity, req.GetCapacityRange()):
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with a capacity of %d bytes", volumeName, capacity)
+	case err != nil && !errors.Is(err, errVolumeNotFound):
+		return nil, statusError(err, codes.Internal)
+	}
+
+	rcloneConfPath, removeConf, err := cs.configs.provide(req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+		return nil, statusError(err, codes.Internal)
 	}
-	remote, ok := req.GetParameters()["remote"]
-	if !ok {
-		return nil, status.Errorf(codes.InvalidArgument, "remote key not found in parameters")
+	defer removeConf()
+	multi, err := parseMultiRemote(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	remotePath, ok := req.GetParameters()["path"]
-	if !ok {
-		return nil, status.Errorf(codes.InvalidArgument, "path key not found in parameters")
+	var remote, remotePath string
+	var volumeContext map[string]string
+	if multi != nil {
+		// The volume is the synthesized remote, its members carry the paths.
+		volumeContext = multi.forVolume(volumeName).attributes()
+		volumeContext["remote"] = multiRemoteName
+		volumeContext["path"] = ""
+	} else {
+		var ok bool
+		remote, ok = req.GetParameters()["remote"]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "remote key not found in parameters")
+		}
+		remotePath, ok = req.GetParameters()["path"]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "path key not found in parameters")
+		}
+		volumeContext = map[string]string{
+			"remote": remote,
+			"path":   fmt.Sprintf("%s/%s", remotePath, volumeName),
+		}
+	}
+	mode, err := volumeMode(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if value, ok := req.GetParameters()[mountTypeKey]; ok {
+		if _, err := volumeMountType(req.GetParameters()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		volumeContext[mountTypeKey] = value
+	}
+	if mode == volumeModeSync {
+		if _, err := parseSyncOptions(req.GetParameters()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		for k, v := range req.GetParameters() {
+			switch {
+			case k == volumeModeKey, k == syncIntervalKey, k == conflictPolicyKey, strings.HasPrefix(k, syncFlagPrefix):
+				volumeContext[k] = v
+			}
+		}
+	}
+	if value, ok := req.GetParameters()[uploadTimeoutKey]; ok {
+		if _, err := parseUploadTimeout(req.GetParameters()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		volumeContext[uploadTimeoutKey] = value
+	}
+	if _, err := parseCacheOptions(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parsePrewarmOptions(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, k := range []string{cacheStorageKey, cacheSizeKey, cacheMaxAgeKey, prewarmKey, prewarmWaitKey} {
+		if value, ok := req.GetParameters()[k]; ok {
+			volumeContext[k] = value
+		}
+	}
+	var endpoints map[string]string
+	if value, ok := req.GetParameters()[topologyEndpointsKey]; ok {
+		if len(cs.topologyKeys) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s needs the plugin to run with --topology-keys", topologyEndpointsKey)
+		}
+		if endpoints, err = parseTopologyEndpoints(value); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		flag := req.GetParameters()[endpointFlagKey]
+		if flag == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s needs %s, the rclone flag to pass the endpoint as", topologyEndpointsKey, endpointFlagKey)
+		}
+		volumeContext[topologyEndpointsKey] = value
+		volumeContext[endpointFlagKey] = flag
+	}
+	var topologies []*csi.Topology
+	if len(cs.topologyKeys) > 0 {
+		topologies, err = accessibleTopology(req.GetAccessibilityRequirements(), cs.topologyKeys, endpoints)
+		if err != nil {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
 	}
 
-	if err = cs.RcloneOps.CreateVol(ctx, volumeName, remote, remotePath, rcloneConfPath); err != nil {
-		klog.Errorf("error creating Volume: %s", err)
+	members := []remoteMember{{Remote: remote, Path: remotePath}}
+	if multi != nil {
+		members = multi.Members
+	}
+	if err := cs.preflight(ctx, req, members, rcloneConfPath); err != nil {
+		cs.reporter.provisioned(req.GetParameters(), volumeName, err)
 		return nil, err
 	}
 
+	if multi != nil {
+		for _, member := range multi.writable() {
+			if err = cs.RcloneOps.CreateVol(ctx, volumeName, member.Remote, member.Path, rcloneConfPath); err != nil {
+				break
+			}
+		}
+	} else {
+		err = cs.RcloneOps.CreateVol(ctx, volumeName, remote, remotePath, rcloneConfPath)
+	}
+	cs.reporter.provisioned(req.GetParameters(), volumeName, err)
+	if err != nil {
+		klog.Errorf("error creating Volume: %s", err)
+		return nil, statusError(err, codes.Internal)
+	}
+	volume := &RcloneVolume{ID: volumeId, Remote: remote, RemotePath: volumeContext["path"]}
+	if multi != nil {
+		volume.Multi = multi.forVolume(volumeName)
+	}
+	cs.setCreated(volumeId, &createdVolume{capacity: req.GetCapacityRange().GetRequiredBytes(), volume: volume})
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			VolumeId:      uuid.New().String(),
-			VolumeContext: map[string]string{
-				"remote": remote,
-				"path":   fmt.Sprintf("%s/%s", remotePath, volumeName),
-			},
+			CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
+			VolumeId:           volumeId,
+			VolumeContext:      volumeContext,
+			AccessibleTopology: topologies,
 		},
 	}, nil
 }
 
+// volumeCapacity returns the capacity of volumeId, errVolumeNotFound when the
+// volume does not exist.
+func (cs *controllerServer) volumeCapacity(volumeId string) (int64, error) {
+	if created := cs.createdVolume(volumeId); created != nil {
+		return created.capacity, nil
+	}
+	if cs.volumes == nil {
+		return 0, fmt.Errorf("volume %s: %w", volumeId, errVolumeNotFound)
+	}
+	pv, err := cs.volumes.persistentVolume(volumeId)
+	if err != nil {
+		return 0, err
+	}
+	storage := pv.Spec.Capacity[corev1.ResourceStorage]
+	return storage.Value(), nil
+}
+
+// createdVolume returns volumeId if this controller created it, nil
+// otherwise.
+func (cs *controllerServer) createdVolume(volumeId string) *createdVolume {
+	cs.createdMu.Lock()
+	defer cs.createdMu.Unlock()
+	created, ok := cs.created[volumeId]
+	if !ok {
+		return nil
+	}
+	return &created
+}
+
+// setCreated records volumeId as created, nil forgets the volume.
+func (cs *controllerServer) setCreated(volumeId string, created *createdVolume) {
+	cs.createdMu.Lock()
+	defer cs.createdMu.Unlock()
+	if created == nil {
+		delete(cs.created, volumeId)
+		return
+	}
+	if cs.created == nil {
+		cs.created = map[string]createdVolume{}
+	}
+	cs.created[volumeId] = *created
+}
+
+// capacityFits tells whether an existing volume of capacity satisfies
+// capacityRange.
+func capacityFits(capacity int64, capacityRange *csi.CapacityRange) bool {
+	if capacity < capacityRange.GetRequiredBytes() {
+		return false
+	}
+	return capacityRange.GetLimitBytes() == 0 || capacity <= capacityRange.GetLimitBytes()
+}
+
+// preflight checks that the remotes of a new volume are configured and
+// reachable before anything is created on them.
+func (cs *controllerServer) preflight(ctx context.Context, req *csi.CreateVolumeRequest, members []remoteMember, rcloneConfPath string) error {
+	conf, err := parseRcloneConf(req.GetSecrets()["rclone.conf"])
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, member := range members {
+		if err := conf.checkRemote(member.Remote); err != nil {
+			return err
+		}
+	}
+	check := true
+	if value, ok := req.GetParameters()[preflightKey]; ok {
+		if check, err = strconv.ParseBool(value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s %q, expected true or false", preflightKey, value)
+		}
+	}
+	if !check {
+		return nil
+	}
+	for _, member := range members {
+		if err := cs.RcloneOps.CheckRemote(ctx, member.Remote, member.Path, rcloneConfPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "DeteleVolume must be provided volume id")
 	}
+	if err := cs.locks.acquire(req.GetVolumeId(), volumeLockKey(req.GetVolumeId())); err != nil {
+		return nil, err
+	}
+	defer cs.locks.Release(volumeLockKey(req.GetVolumeId()))
 
-	rcloneConfPath, err := extractRcloneConf(req.Secrets)
+	rcloneConfPath, removeConf, err := cs.configs.provide(req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+		return nil, statusError(err, codes.Internal)
 	}
+	defer removeConf()
 
 	rcloneVol, err := cs.RcloneOps.GetVolumeById(ctx, req.GetVolumeId())
+	if errors.Is(err, errVolumeNotFound) {
+		// A volume this controller created may not have a PV yet.
+		created := cs.createdVolume(req.GetVolumeId())
+		if created == nil {
+			klog.Infof("volume %s not found, assuming it is already deleted", req.GetVolumeId())
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		rcloneVol, err = created.volume, nil
+	}
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err, codes.Internal)
 	}
 
-	err = cs.RcloneOps.DeleteVol(ctx, rcloneVol, rcloneConfPath)
+	if rcloneVol.Multi != nil {
+		// Only the writable members have a directory of the volume.
+		for _, member := range rcloneVol.Multi.writable() {
+			memberVol := &RcloneVolume{ID: rcloneVol.ID, Remote: member.Remote, RemotePath: member.Path}
+			if err = cs.RcloneOps.DeleteVol(ctx, memberVol, rcloneConfPath); err != nil {
+				break
+			}
+		}
+	} else {
+		err = cs.RcloneOps.DeleteVol(ctx, rcloneVol, rcloneConfPath)
+	}
+	if status.Code(statusError(err, codes.Internal)) == codes.NotFound {
+		klog.Infof("directory of volume %s not found, assuming it is already deleted", req.GetVolumeId())
+		err = nil
+	}
+	cs.reporter.deleted(req.GetVolumeId(), err)
 	if err != nil {
 		klog.Errorf("error creating Volume: %s", err)
-		return nil, err
+		return nil, statusError(err, codes.Internal)
 	}
+	cs.setCreated(req.GetVolumeId(), nil)
 
 	return &csi.DeleteVolumeResponse{}, nil
 
 }
 
-func (*controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerExpandVolume not implemented")
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume must be provided volume id")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume must be provided capacity range")
+	}
+
+	// Remotes are not sized, the new capacity is accepted as is and the
+	// mount sees it without a node side resize.
+	cs.createdMu.Lock()
+	if created, ok := cs.created[req.GetVolumeId()]; ok {
+		created.capacity = req.GetCapacityRange().GetRequiredBytes()
+		cs.created[req.GetVolumeId()] = created
+	}
+	cs.createdMu.Unlock()
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         req.GetCapacityRange().GetRequiredBytes(),
+		NodeExpansionRequired: false,
+	}, nil
 }
 
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
@@ -117,24 +399,4 @@ func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.Co
 	}}, nil
 }
 
-func extractRcloneConf(secrets map[string]string) (string, error) {
-	rcloneConfData, ok := secrets["rclone.conf"]
-	if !ok {
-		return "", fmt.Errorf("rclone.conf key in secret not found")
-	}
-	rcloneConf, err := os.CreateTemp("", "rclone.conf")
-	if err != nil {
-		return "", err
-	}
-
-	if _, err = rcloneConf.Write([]byte(rcloneConfData)); err != nil {
-		return "", err
-	}
-
-	if err = rcloneConf.Close(); err != nil {
-		return "", err
-	}
-	return rcloneConf.Name(), nil
-}
-
 // single operand routine.
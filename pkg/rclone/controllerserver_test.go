@@ -0,0 +1,458 @@
+package rclone
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+var testSecrets = map[string]string{"rclone.conf": testRcloneConf}
+
+func TestCreateVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         *csi.CreateVolumeRequest
+		rclone      []rcloneResult
+		wantCode    codes.Code
+		wantCommand []string
+		wantContext map[string]string
+	}{
+		{
+			name:     "missing name",
+			req:      &csi.CreateVolumeRequest{VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "missing capabilities",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "missing rclone.conf",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio", "path": "base"},
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "missing remote",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"path": "base"},
+				Secrets:            testSecrets,
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "missing path",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio"},
+				Secrets:            testSecrets,
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "rclone mkdir fails",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio", "path": "base"},
+				Secrets:            testSecrets,
+			},
+			rclone:      []rcloneResult{{}, {output: "Failed to mkdir: AccessDenied", err: errRcloneFailed}},
+			wantCode:    codes.PermissionDenied,
+			wantCommand: []string{"rclone", "mkdir", "minio:base/pvc-1"},
+		},
+		{
+			name: "success",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio", "path": "base"},
+				Secrets:            testSecrets,
+			},
+			rclone:      []rcloneResult{{}, {}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "mkdir", "minio:base/pvc-1"},
+			wantContext: map[string]string{"remote": "minio", "path": "base/pvc-1"},
+		},
+		{
+			name: "unknown volume mode",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio", "path": "base", "mode": "copy"},
+				Secrets:            testSecrets,
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "sync mode",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         map[string]string{"remote": "minio", "path": "base", "mode": "sync", "conflictPolicy": "newer", "sync/exclude": "*.tmp"},
+				Secrets:            testSecrets,
+			},
+			rclone:      []rcloneResult{{}, {}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "mkdir", "minio:base/pvc-1"},
+			wantContext: map[string]string{"remote": "minio", "path": "base/pvc-1", "mode": "sync", "conflictPolicy": "newer", "sync/exclude": "*.tmp"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(tc.rclone...))
+
+			resp, err := td.cs.CreateVolume(context.Background(), tc.req)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			assertRcloneCommand(t, td.rclone, tc.wantCommand)
+			if tc.wantContext != nil && !reflect.DeepEqual(resp.GetVolume().GetVolumeContext(), tc.wantContext) {
+				t.Errorf("expected volume context %v, got %v", tc.wantContext, resp.GetVolume().GetVolumeContext())
+			}
+		})
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	tests := []struct {
+		name        string
+		req         *csi.DeleteVolumeRequest
+		objects     []runtime.Object
+		rclone      []rcloneResult
+		wantCode    codes.Code
+		wantCommand []string
+	}{
+		{
+			name:     "missing volume id",
+			req:      &csi.DeleteVolumeRequest{Secrets: testSecrets},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "missing rclone.conf",
+			req:      &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			objects:  []runtime.Object{pv},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unknown volume is already deleted",
+			req:      &csi.DeleteVolumeRequest{VolumeId: "vol-2", Secrets: testSecrets},
+			objects:  []runtime.Object{pv},
+			wantCode: codes.OK,
+		},
+		{
+			name:        "success",
+			req:         &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets},
+			objects:     []runtime.Object{pv},
+			rclone:      []rcloneResult{{}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "rmdirs", "minio:base/pvc-1"},
+		},
+		{
+			name:        "directory already gone",
+			req:         &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets},
+			objects:     []runtime.Object{pv},
+			rclone:      []rcloneResult{{output: "ERROR : base/pvc-1: directory not found", err: &fakeexec.FakeExitError{Status: 3}}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "rmdirs", "minio:base/pvc-1"},
+		},
+		{
+			name:        "remote unavailable",
+			req:         &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets},
+			objects:     []runtime.Object{pv},
+			rclone:      []rcloneResult{{output: "Failed to rmdirs: temporary failure", err: &fakeexec.FakeExitError{Status: 5}}},
+			wantCode:    codes.Unavailable,
+			wantCommand: []string{"rclone", "rmdirs", "minio:base/pvc-1"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(tc.rclone...), tc.objects...)
+
+			_, err := td.cs.DeleteVolume(context.Background(), tc.req)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			assertRcloneCommand(t, td.rclone, tc.wantCommand)
+		})
+	}
+}
+
+// assertRcloneCommand checks that the last rclone run had the expected
+// leading arguments, or that rclone did not run when want is nil.
+func assertRcloneCommand(t *testing.T, rclone *fakeRclone, want []string) {
+	t.Helper()
+	if want == nil {
+		if len(rclone.calls) != 0 {
+			t.Errorf("expected no rclone calls, got %v", rclone.calls)
+		}
+		return
+	}
+	if len(rclone.calls) == 0 {
+		t.Fatalf("expected rclone to run")
+	}
+	got := rclone.calls[len(rclone.calls)-1]
+	if len(got) < len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("expected rclone command %v, got %v", want, got)
+	}
+	if !strings.HasPrefix(got[len(got)-1], "--config=") {
+		t.Errorf("expected rclone to be given a config file, got %v", got)
+	}
+}
+
+func TestDeleteVolumeCreatedWithoutPV(t *testing.T) {
+	td := newTestDriver(newFakeRclone(rcloneResult{}, rcloneResult{}, rcloneResult{}))
+	created, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-2",
+		VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+		Parameters:         map[string]string{"remote": "minio", "path": "base"},
+		Secrets:            testSecrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeId := created.GetVolume().GetVolumeId()
+
+	if _, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeId, Secrets: testSecrets}); err != nil {
+		t.Fatal(err)
+	}
+	assertRcloneCommand(t, td.rclone, []string{"rclone", "rmdirs", "minio:base/pvc-2"})
+
+	// The volume is forgotten once its directory is removed.
+	calls := len(td.rclone.calls)
+	if _, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeId, Secrets: testSecrets}); err != nil {
+		t.Fatal(err)
+	}
+	if len(td.rclone.calls) != calls {
+		t.Errorf("expected a deleted volume not to be removed again, got %v", td.rclone.calls[calls:])
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		expansion bool
+		req       *csi.ControllerExpandVolumeRequest
+		wantCode  codes.Code
+	}{
+		{
+			name:     "expansion disabled",
+			req:      &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:      "missing capacity",
+			expansion: true,
+			req:       &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1"},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:      "success",
+			expansion: true,
+			req:       &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}},
+			wantCode:  codes.OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := []DriverOption{WithMode(ModeController)}
+			if tc.expansion {
+				opts = append(opts, WithVolumeExpansion())
+			}
+			d := NewDriver(testNodeID, "unix:///tmp/csi.sock", fake.NewSimpleClientset(), newFakeRclone(), opts...)
+
+			resp, err := NewControllerServer(d).ControllerExpandVolume(context.Background(), tc.req)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if err == nil && (resp.GetCapacityBytes() != 2<<30 || resp.GetNodeExpansionRequired()) {
+				t.Errorf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeIdempotent(t *testing.T) {
+	td := newTestDriver(newFakeRclone(rcloneResult{}, rcloneResult{}, rcloneResult{}, rcloneResult{}, rcloneResult{}, rcloneResult{}))
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+		Parameters:         map[string]string{"remote": "minio", "path": "base"},
+		Secrets:            testSecrets,
+	}
+
+	first, err := td.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := td.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same volume on retry, got %v and %v", first.GetVolume(), second.GetVolume())
+	}
+
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 << 30, LimitBytes: 2 << 30}
+	if _, err := td.cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for another capacity, got %v", err)
+	}
+
+	req.Name = "pvc-2"
+	other, err := td.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.GetVolume().GetVolumeId() == first.GetVolume().GetVolumeId() {
+		t.Errorf("expected a different volume id for another name")
+	}
+}
+
+func TestCreateVolumePreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]string
+		secrets     map[string]string
+		rclone      []rcloneResult
+		wantCode    codes.Code
+		wantCommand []string
+	}{
+		{
+			name:     "unparsable config",
+			params:   map[string]string{"remote": "minio", "path": "base"},
+			secrets:  map[string]string{"rclone.conf": "type = s3\n"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "remote not in config",
+			params:   map[string]string{"remote": "gcs", "path": "base"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "remote without type",
+			params:   map[string]string{"remote": "minio", "path": "base"},
+			secrets:  map[string]string{"rclone.conf": "[minio]\nprovider = Minio\n"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:        "bad credentials",
+			params:      map[string]string{"remote": "minio", "path": "base"},
+			rclone:      []rcloneResult{{output: "ERROR : : error listing: InvalidAccessKeyId: status code: 403", err: errRcloneFailed}},
+			wantCode:    codes.PermissionDenied,
+			wantCommand: []string{"rclone", "lsjson", "--stat", "minio:base"},
+		},
+		{
+			name:        "endpoint unreachable",
+			params:      map[string]string{"remote": "minio", "path": "base"},
+			rclone:      []rcloneResult{{output: "dial tcp: lookup minio on 10.0.0.10:53: no such host", err: errRcloneFailed}},
+			wantCode:    codes.Unavailable,
+			wantCommand: []string{"rclone", "lsjson", "--stat", "minio:base"},
+		},
+		{
+			name:        "fs init denied",
+			params:      map[string]string{"remote": "minio", "path": "base"},
+			rclone:      []rcloneResult{{output: `CRITICAL: Failed to create file system for "minio:base": AccessDenied: Access Denied. status code: 403`, err: errRcloneFailed}},
+			wantCode:    codes.PermissionDenied,
+			wantCommand: []string{"rclone", "lsjson", "--stat", "minio:base"},
+		},
+		{
+			name:        "fs init unknown host",
+			params:      map[string]string{"remote": "minio", "path": "base"},
+			rclone:      []rcloneResult{{output: `CRITICAL: Failed to create file system for "minio:base": dial tcp: lookup minio: no such host`, err: errRcloneFailed}},
+			wantCode:    codes.Unavailable,
+			wantCommand: []string{"rclone", "lsjson", "--stat", "minio:base"},
+		},
+		{
+			name:        "base path not created yet",
+			params:      map[string]string{"remote": "minio", "path": "base"},
+			rclone:      []rcloneResult{{output: "ERROR : base: directory not found", err: errRcloneFailed}, {}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "mkdir", "minio:base/pvc-1"},
+		},
+		{
+			name:        "check disabled",
+			params:      map[string]string{"remote": "minio", "path": "base", preflightKey: "false"},
+			rclone:      []rcloneResult{{}},
+			wantCode:    codes.OK,
+			wantCommand: []string{"rclone", "mkdir", "minio:base/pvc-1"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(tc.rclone...))
+			secrets := tc.secrets
+			if secrets == nil {
+				secrets = testSecrets
+			}
+
+			_, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:         tc.params,
+				Secrets:            secrets,
+			})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			assertRcloneCommand(t, td.rclone, tc.wantCommand)
+			if strings.Contains(status.Convert(err).Message(), "AKIAEXAMPLEKEY") {
+				t.Errorf("expected credentials to be redacted from %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	td := newTestDriver(newFakeRclone(rcloneResult{}, rcloneResult{}), pv)
+	created, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-2",
+		VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+		Parameters:         map[string]string{"remote": "minio", "path": "base"},
+		Secrets:            testSecrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		volumeId string
+		wantCode codes.Code
+	}{
+		{"volume with a PV", "vol-1", codes.OK},
+		{"volume created without a PV yet", created.GetVolume().GetVolumeId(), codes.OK},
+		{"unknown volume", "vol-nope", codes.NotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := td.cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           tc.volumeId,
+				VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+			})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Errorf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+		})
+	}
+}
@@ -1,21 +1,104 @@
 package rclone
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/utils/exec"
 )
 
+// Mode selects which CSI services the plugin serves.
+type Mode string
+
+const (
+	// ModeController serves the controller service, as the provisioner sidecar needs.
+	ModeController Mode = "controller"
+	// ModeNode serves the node service, as kubelet needs.
+	ModeNode Mode = "node"
+	// ModeAll serves both, for single binary setups and tests.
+	ModeAll Mode = "all"
+)
+
+// ParseMode validates a --mode flag value.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeController, ModeNode, ModeAll:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode %q, must be one of controller, node or all", s)
+}
+
+func (m Mode) controller() bool {
+	return m == ModeController || m == ModeAll
+}
+
+func (m Mode) node() bool {
+	return m == ModeNode || m == ModeAll
+}
+
+// CheckEnvironment reports missing settings that mode needs.
+func CheckEnvironment(mode Mode, nodeID string) error {
+	if os.Getenv("POD_NAMESPACE") == "" {
+		return errors.New("POD_NAMESPACE must be set to the namespace mounters run in")
+	}
+	if mode.node() && nodeID == "" {
+		return errors.New("--nodeid must be set in node mode")
+	}
+	return nil
+}
+
+// defaultReconcileInterval is how often mounters are checked for orphans.
+const defaultReconcileInterval = 5 * time.Minute
+
+// defaultShutdownTimeout leaves room for draining within the default pod
+// termination grace period of 30s.
+const defaultShutdownTimeout = 25 * time.Second
+
 type Driver struct {
 	csiDriver *csicommon.CSIDriver
 	endpoint  string
+	nodeID    string
+	mode      Mode
+	expansion bool
+	// topologyKeys are the node labels reported as topology segments.
+	topologyKeys []string
+	// evictConsumers lets the mount watchdog evict the pods that keep a
+	// repaired mount stale.
+	evictConsumers bool
+
+	reconcileInterval time.Duration
+	shutdownTimeout   time.Duration
+	pluginDir         string
+	configDir         string
+	cacheDir          string
+	kubeClient        kubernetes.Interface
+	execute           exec.Interface
+	state             *nodeState
+	locks             *operationLocks
 
 	ns        *nodeServer
 	cap       []*csi.VolumeCapability_AccessMode
 	cscap     []*csi.ControllerServiceCapability
 	rcloneOps Operations
+	reporter  *volumeReporter
+	// volumes caches the PVs the reporter and the background loops look up.
+	volumes *volumeCache
+	// limits applies the bandwidth and transfer limits of volumes to mounter
+	// Deployments, nil with other Operations.
+	limits *limitsManager
 }
 
 var (
@@ -23,48 +106,302 @@ var (
 	DriverVersion = "latest"
 )
 
-func NewDriver(nodeID, endpoint string, kubeClient *kubernetes.Clientset) *Driver {
+// DriverOption customizes a Driver built by NewDriver.
+type DriverOption func(*Driver)
+
+// WithOperations replaces the default mounter Deployment based Operations,
+// for example with NewProcessRclone.
+func WithOperations(ops Operations) DriverOption {
+	return func(d *Driver) {
+		d.rcloneOps = ops
+	}
+}
+
+// WithMode limits the driver to the services of mode. The default is ModeAll.
+func WithMode(mode Mode) DriverOption {
+	return func(d *Driver) {
+		d.mode = mode
+	}
+}
+
+// WithReconcileInterval sets how often mounters are checked for orphans,
+// zero disables the check.
+func WithReconcileInterval(interval time.Duration) DriverOption {
+	return func(d *Driver) {
+		d.reconcileInterval = interval
+	}
+}
+
+// WithVolumeExpansion lets PVCs be resized. Remotes have no fixed size, so
+// the new capacity is only recorded.
+func WithVolumeExpansion() DriverOption {
+	return func(d *Driver) {
+		d.expansion = true
+	}
+}
+
+// WithTopologyKeys reports the given node labels as topology segments and
+// honors accessibility requirements when provisioning. The first key is the
+// one topologyEndpoints are matched against.
+func WithTopologyKeys(keys ...string) DriverOption {
+	return func(d *Driver) {
+		d.topologyKeys = keys
+	}
+}
+
+// WithShutdownTimeout bounds how long in-flight RPCs may run after SIGTERM.
+func WithShutdownTimeout(timeout time.Duration) DriverOption {
+	return func(d *Driver) {
+		d.shutdownTimeout = timeout
+	}
+}
+
+// WithPluginDir keeps node-local state in dir, which should outlive the
+// plugin container.
+func WithPluginDir(dir string) DriverOption {
+	return func(d *Driver) {
+		d.pluginDir = dir
+	}
+}
+
+// WithConfigDir keeps the rclone configs of controller calls under dir,
+// ideally a tmpfs. The default is /dev/shm.
+func WithConfigDir(dir string) DriverOption {
+	return func(d *Driver) {
+		d.configDir = dir
+	}
+}
+
+// WithCacheDir keeps the VFS caches of volumes with cacheStorage host in
+// dir, a node directory mounted at the same path in the plugin.
+func WithCacheDir(dir string) DriverOption {
+	return func(d *Driver) {
+		d.cacheDir = dir
+	}
+}
+
+// WithConsumerEviction lets the mount watchdog evict the pods whose
+// containers keep the stale mount of a repaired target, so their controller
+// replaces them. Nodes then watch all their pods.
+func WithConsumerEviction() DriverOption {
+	return func(d *Driver) {
+		d.evictConsumers = true
+	}
+}
+
+func NewDriver(nodeID, endpoint string, kubeClient kubernetes.Interface, execute exec.Interface, opts ...DriverOption) *Driver {
 	klog.Infof("Starting new %s RcloneDriver in version %s", DriverName, DriverVersion)
 
 	d := &Driver{}
 	d.endpoint = endpoint
-	d.rcloneOps = NewRclone(kubeClient)
+	d.nodeID = nodeID
+	d.mode = ModeAll
+	d.reconcileInterval = defaultReconcileInterval
+	d.kubeClient = kubeClient
+	d.execute = execute
+	d.rcloneOps = NewRclone(kubeClient, execute, nodeID)
+	d.shutdownTimeout = defaultShutdownTimeout
+	d.locks = newOperationLocks()
+	for _, opt := range opts {
+		opt(d)
+	}
+	// The driver shares the cache of its Operations, which startReconcilers
+	// starts.
+	switch ops := d.rcloneOps.(type) {
+	case *Rclone:
+		d.volumes = ops.volumes
+	case *processRclone:
+		d.volumes = ops.volumes
+	default:
+		d.volumes = newVolumeCache(kubeClient, os.Getenv("POD_NAMESPACE"), nodeID)
+	}
+	d.reporter = newVolumeReporter(kubeClient, nodeID, d.volumes)
+	switch ops := d.rcloneOps.(type) {
+	case *Rclone:
+		ops.cacheDir = d.cacheDir
+		d.limits = newLimitsManager(ops, d.reporter)
+	case *processRclone:
+		ops.cacheDir = d.cacheDir
+	}
 
-	d.csiDriver = csicommon.NewCSIDriver(DriverName, DriverVersion, nodeID)
+	var err error
+	if d.state, err = loadNodeState(d.pluginDir); err != nil {
+		klog.Errorf("ignoring unreadable node state in %s: %v", d.pluginDir, err)
+		d.state = &nodeState{path: filepath.Join(d.pluginDir, stateFile), volumes: map[string]publishedVolume{}}
+	}
+
+	// csicommon refuses an empty node id, which the controller does not have.
+	csiNodeID := nodeID
+	if csiNodeID == "" {
+		csiNodeID, _ = os.Hostname()
+	}
+	d.csiDriver = csicommon.NewCSIDriver(DriverName, DriverVersion, csiNodeID)
 	d.csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 	})
-	d.csiDriver.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
+	if d.mode.controller() {
+		cscaps := []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		})
+		}
+		if d.expansion {
+			cscaps = append(cscaps, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+		}
+		d.csiDriver.AddControllerServiceCapabilities(cscaps)
+	}
 
 	return d
 }
 
 func NewNodeServer(d *Driver) *nodeServer {
-	return &nodeServer{
+	mounter := mount.New("")
+	// Node copies of sync mode volumes live next to the node state, so they
+	// survive plugin restarts and are taken over again below.
+	syncDir := filepath.Join(os.TempDir(), "csi-rclone-sync")
+	if d.pluginDir != "" {
+		syncDir = filepath.Join(d.pluginDir, "sync")
+	}
+	// Serving mounters are Deployments, the process mounter cannot serve.
+	serveOps := map[string]Operations{}
+	var mounterClient func(volumeId string) (*rc.Client, error)
+	if r, ok := d.rcloneOps.(*Rclone); ok {
+		serveOps[mountTypeNFS] = NewServeRclone(r, mountTypeNFS, mounter)
+		serveOps[mountTypeWebDAV] = NewServeRclone(r, mountTypeWebDAV, mounter)
+		mounterClient = r.runningMounter
+	}
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
 		mounter: &mount.SafeFormatAndMount{
-			Interface: mount.New(""),
+			Interface: mounter,
 			Exec:      mount.NewOsExec(),
 		},
-		RcloneOps: d.rcloneOps,
+		RcloneOps:    d.rcloneOps,
+		reporter:     d.reporter,
+		kubeClient:   d.kubeClient,
+		nodeID:       d.nodeID,
+		topologyKeys: d.topologyKeys,
+		state:        d.state,
+		locks:        d.locks,
+		syncer:       newSyncManager(d.execute, mounter, syncDir),
+		serveOps:     serveOps,
+		prewarmer:    newPrewarmer(d.reporter, mounterClient),
+		limits:       d.limits,
 	}
+	ns.syncer.restore(d.state.list())
+	ns.watchdog = newMountWatchdog(ns)
+	ns.watchdog.evict = d.evictConsumers
+	return ns
 }
 
 func NewControllerServer(d *Driver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
 		RcloneOps:               d.rcloneOps,
+		reporter:                d.reporter,
+		topologyKeys:            d.topologyKeys,
+		locks:                   d.locks,
+		configs:                 newConfigProvider(d.configDir),
+		volumes:                 d.volumes,
 	}
 }
 
+// Run serves the driver until SIGTERM or SIGINT, then shuts down gracefully.
 func (d *Driver) Run() {
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(d.endpoint,
-		csicommon.NewDefaultIdentityServer(d.csiDriver),
-		NewControllerServer(d),
-		NewNodeServer(d))
-	s.Wait()
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		klog.Infof("received %s, shutting down", sig)
+		close(stopCh)
+	}()
+	d.run(stopCh)
+}
+
+// run serves the driver until stopCh is closed. New RPCs are then refused,
+// in-flight ones get up to shutdownTimeout to finish and the node state is
+// written. Mounts are left running, their mounters do not depend on the
+// plugin.
+func (d *Driver) run(stopCh <-chan struct{}) {
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+	if d.mode.controller() {
+		cs = NewControllerServer(d)
+	}
+	if d.mode.node() {
+		d.ns = NewNodeServer(d)
+		ns = d.ns
+	}
+	d.startReconcilers(stopCh)
+
+	klog.Infof("serving %s mode on %s", d.mode, d.endpoint)
+	s := NewNonBlockingGRPCServer(metricsInterceptor, logGRPC)
+	s.Start(d.endpoint, NewIdentityServer(d), cs, ns)
+
+	served := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(served)
+	}()
+	select {
+	case <-stopCh:
+	case <-served:
+		return
+	}
+
+	if !s.StopWithTimeout(d.shutdownTimeout) {
+		klog.Warningf("in-flight RPCs did not finish within %v, cancelled them", d.shutdownTimeout)
+	}
+	if d.mode.node() {
+		if err := d.state.save(); err != nil {
+			klog.Errorf("writing node state: %v", err)
+		}
+	}
+	klog.Infof("shutdown complete")
+}
+
+// startReconcilers runs the background loops of the driver mode: orphaned
+// mounter collection on the controller, and the mount watchdog, stale
+// mounter cleanup, secret changes, OAuth token refreshes and volume limits on
+// nodes. All but the watchdog only apply to mounter Deployments.
+func (d *Driver) startReconcilers(stopCh <-chan struct{}) {
+	if d.ns != nil {
+		if d.ns.watchdog.evict {
+			d.volumes.startConsumers(stopCh)
+		}
+		go wait.Until(func() {
+			d.ns.watchdog.check(context.Background())
+		}, staleCheckInterval, stopCh)
+	}
+	r, ok := d.rcloneOps.(*Rclone)
+	d.volumes.start(ok && d.mode.node(), stopCh)
+	if !ok {
+		return
+	}
+	if d.mode.node() {
+		go r.watchSecrets(d.reporter, stopCh)
+		go wait.Until(func() {
+			if err := r.syncTokens(context.Background()); err != nil {
+				klog.Errorf("syncing OAuth tokens on node %s: %v", d.nodeID, err)
+			}
+		}, tokenSyncInterval, stopCh)
+		go d.limits.watch(stopCh)
+	}
+	if d.reconcileInterval <= 0 {
+		return
+	}
+	if d.mode.controller() {
+		go wait.Until(func() {
+			if err := r.collectOrphanMounters(context.Background()); err != nil {
+				klog.Errorf("collecting orphaned mounters: %v", err)
+			}
+		}, d.reconcileInterval, stopCh)
+	}
+	if d.mode.node() {
+		mounter := mount.New("")
+		go wait.Until(func() {
+			if err := r.reconcileNodeMounters(context.Background(), mounter); err != nil {
+				klog.Errorf("reconciling mounters on node %s: %v", d.nodeID, err)
+			}
+		}, d.reconcileInterval, stopCh)
+	}
 }
@@ -0,0 +1,134 @@
+package rclone
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// blockingOps holds CreateVol until release is closed, the remote always
+// passes its pre-flight check.
+type blockingOps struct {
+	Operations
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingOps) CreateVol(ctx context.Context, volumeName, remote, remotePath, rcloneConfigPath string) error {
+	close(b.started)
+	<-b.release
+	return nil
+}
+
+func (b *blockingOps) CheckRemote(ctx context.Context, remote, remotePath, rcloneConfigPath string) error {
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	ops := &blockingOps{started: make(chan struct{}), release: make(chan struct{})}
+	d := NewDriver(testNodeID, endpoint, fake.NewSimpleClientset(), newFakeRclone(),
+		WithOperations(ops), WithPluginDir(dir), WithShutdownTimeout(10*time.Second), WithReconcileInterval(0))
+	d.state.add(publishedVolume{VolumeID: "vol-1", TargetPath: "/target", Remote: "minio", RemotePath: "base/pvc-1"})
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.run(stopCh)
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := csi.NewControllerClient(conn).CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+			Parameters:         map[string]string{"remote": "minio", "path": "base"},
+			Secrets:            testSecrets,
+		})
+		created <- err
+	}()
+	<-ops.started
+
+	close(stopCh)
+	identity := csi.NewIdentityClient(conn)
+	for {
+		if _, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{}); err != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("server kept accepting RPCs after shutdown")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the in-flight CreateVolume")
+	default:
+	}
+
+	close(ops.release)
+	if err := <-created; err != nil {
+		t.Errorf("in-flight CreateVolume failed: %v", err)
+	}
+	<-done
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		t.Fatalf("node state not written: %v", err)
+	}
+	if !strings.Contains(string(data), `"volumeId": "vol-1"`) {
+		t.Errorf("expected published volume in state, got %s", data)
+	}
+	state, err := loadNodeState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.list(); len(got) != 1 || got[0].TargetPath != "/target" {
+		t.Errorf("expected state to load back, got %+v", got)
+	}
+}
+
+func TestNodeStateWrittenOnEachChange(t *testing.T) {
+	dir := t.TempDir()
+	state, err := loadNodeState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.add(publishedVolume{VolumeID: "vol-1", TargetPath: "/target-1"})
+	state.add(publishedVolume{VolumeID: "vol-2", TargetPath: "/target-2"})
+	state.remove("/target-1")
+
+	// No save, as after a crash.
+	restored, err := loadNodeState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.list(); len(got) != 1 || got[0].VolumeID != "vol-2" {
+		t.Errorf("expected only vol-2 in the restored state, got %+v", got)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only %s in the plugin dir, got %d files", stateFile, len(entries))
+	}
+}
@@ -0,0 +1,158 @@
+package rclone
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/exec"
+)
+
+// rcloneExitCodes classify rclone exit codes, see
+// https://rclone.org/docs/#exit-code. Exit code 2 is an uncategorized error
+// and 6 a less serious one, both are left to the output patterns.
+var rcloneExitCodes = map[int]codes.Code{
+	1:  codes.InvalidArgument,    // syntax or usage error
+	3:  codes.NotFound,           // directory not found
+	4:  codes.NotFound,           // file not found
+	5:  codes.Unavailable,        // temporary error, retries may fix it
+	7:  codes.FailedPrecondition, // fatal error, like a suspended account
+	8:  codes.ResourceExhausted,  // --max-transfer reached
+	9:  codes.OK,                 // no files transferred with --error-on-no-transfer
+	10: codes.DeadlineExceeded,   // --max-duration reached
+}
+
+// rcloneErrorPatterns classify rclone and backend error output, checked in
+// order and before the exit code, which is often too coarse.
+var rcloneErrorPatterns = []struct {
+	code     codes.Code
+	patterns []string
+}{
+	{codes.FailedPrecondition, []string{
+		"executable file not found", "account suspended", "account disabled",
+	}},
+	{codes.InvalidArgument, []string{
+		"didn't find backend called", "didn't find section in config file", "couldn't find type of fs",
+		"unknown flag",
+	}},
+	// Rate limits come first, some backends report them as 403 or quota.
+	{codes.Unavailable, []string{
+		`\b429\b`, "too many requests", "rate limit", "ratelimitexceeded", "slowdown",
+	}},
+	{codes.ResourceExhausted, []string{
+		"quota", "insufficient storage", "insufficient_storage", `\b507\b`, "storage limit", "no space left on device",
+		"entitytoolarge", "file size limit",
+	}},
+	{codes.PermissionDenied, []string{
+		`\b403\b`, `\b401\b`, "accessdenied", "access denied", "forbidden", "unauthorized", "invalidaccesskeyid",
+		"signaturedoesnotmatch", "invalid_grant", "permission denied", "invalid credentials",
+	}},
+	// Only missing remote objects, a missing Secret or executable must not
+	// pass for a volume that is already gone.
+	{codes.NotFound, []string{
+		"directory not found", "object not found", "nosuchbucket", "nosuchkey",
+	}},
+	{codes.Unavailable, []string{
+		"connection refused", "no such host", "i/o timeout", "network is unreachable", "connection reset",
+		"tls handshake", `\b50[234]\b`, "service unavailable", "context deadline exceeded",
+	}},
+	// rclone reports most backend init failures with this prefix, including
+	// denied credentials and unreachable hosts, so it only classifies what the
+	// classes above did not.
+	{codes.InvalidArgument, []string{
+		"failed to create file system",
+	}},
+}
+
+var rcloneErrorRegexps = func() []*regexp.Regexp {
+	res := []*regexp.Regexp{}
+	for _, class := range rcloneErrorPatterns {
+		res = append(res, regexp.MustCompile(strings.Join(class.patterns, "|")))
+	}
+	return res
+}()
+
+// rcloneErrorCode returns the gRPC code for a failed rclone run with output,
+// from the backend errors in the output or else the exit code of err.
+// Unknown is returned when neither is recognized, OK when the exit code does
+// not denote a failure.
+func rcloneErrorCode(err error, output string) codes.Code {
+	output = strings.ToLower(output)
+	for i, re := range rcloneErrorRegexps {
+		if re.MatchString(output) {
+			return rcloneErrorPatterns[i].code
+		}
+	}
+	var exitErr exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code, ok := rcloneExitCodes[exitErr.ExitStatus()]; ok {
+			return code
+		}
+	}
+	return codes.Unknown
+}
+
+// rcloneError is a failed rclone run, it converts to a gRPC status with the
+// code its exit code and output map to.
+type rcloneError struct {
+	code codes.Code
+	msg  string
+}
+
+func (e *rcloneError) Error() string {
+	return e.msg
+}
+
+func (e *rcloneError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.msg)
+}
+
+// newRcloneError returns the error of an rclone run that failed with err and
+// output, nil when the exit code does not denote a failure.
+func newRcloneError(msg string, err error, output string) error {
+	code := rcloneErrorCode(err, output)
+	switch code {
+	case codes.OK:
+		return nil
+	case codes.Unknown:
+		code = codes.Internal
+	}
+	return &rcloneError{code: code, msg: msg}
+}
+
+// statusError returns err as a gRPC status error. Status errors are kept,
+// rclone, Kubernetes API and context errors are classified, and anything else
+// gets fallback.
+func statusError(err error, fallback codes.Code) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var rcloneErr *rcloneError
+	if errors.As(err, &rcloneErr) {
+		return status.Error(rcloneErr.code, err.Error())
+	}
+	code := fallback
+	switch {
+	case errors.Is(err, errUploadsPending), errors.Is(err, errMountNotReady), errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, errVolumeNotFound):
+		code = codes.NotFound
+	case k8serrors.IsForbidden(err), k8serrors.IsUnauthorized(err):
+		code = codes.PermissionDenied
+	case k8serrors.IsConflict(err):
+		code = codes.Aborted
+	case k8serrors.IsServerTimeout(err), k8serrors.IsTimeout(err), k8serrors.IsTooManyRequests(err),
+		k8serrors.IsServiceUnavailable(err), k8serrors.IsInternalError(err):
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,85 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+func TestRcloneErrorCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		exit   int
+		output string
+		want   codes.Code
+	}{
+		{"access denied", 1, "Failed to mkdir: AccessDenied: Access Denied", codes.PermissionDenied},
+		{"http 403", 2, "googleapi: Error 403: The user does not have sufficient permissions", codes.PermissionDenied},
+		{"403 inside a number", 2, "wrote 14030 bytes", codes.Internal},
+		{"quota", 2, "googleapi: Error 403: The user's Drive storage quota has been exceeded., storageQuotaExceeded", codes.ResourceExhausted},
+		{"webdav insufficient storage", 2, "507 Insufficient Storage", codes.ResourceExhausted},
+		{"rate limited", 2, "googleapi: Error 403: User Rate Limit Exceeded., userRateLimitExceeded", codes.Unavailable},
+		{"s3 slow down", 5, "SlowDown: Please reduce your request rate", codes.Unavailable},
+		{"no such host", 2, "dial tcp: lookup minio: no such host", codes.Unavailable},
+		{"missing remote", 1, `didn't find section in config file ("nope")`, codes.InvalidArgument},
+		{"fs init denied", 1, `2024/10/18 09:12:44 CRITICAL: Failed to create file system for "gdrive:": couldn't find root directory ID: googleapi: Error 403: Request had insufficient authentication scopes., forbidden`, codes.PermissionDenied},
+		{"fs init bad credentials", 1, `2024/10/18 09:12:44 CRITICAL: Failed to create file system for "dropbox:": failed to get current account: invalid_grant: token has been revoked`, codes.PermissionDenied},
+		{"fs init unknown host", 1, `2024/10/18 09:12:44 CRITICAL: Failed to create file system for "sftp:data": NewFs: couldn't connect SSH: dial tcp: lookup sftp.example.com on 10.96.0.10:53: no such host`, codes.Unavailable},
+		{"fs init refused", 1, `2024/10/18 09:12:44 CRITICAL: Failed to create file system for "webdav:": read metadata failed: Propfind "http://webdav:8080/": dial tcp 10.0.0.7:8080: connect: connection refused`, codes.Unavailable},
+		{"fs init misconfigured", 1, `2024/10/18 09:12:44 CRITICAL: Failed to create file system for "secret:": failed to make cipher: password not set in config file`, codes.InvalidArgument},
+		{"missing bucket", 2, "NoSuchBucket: The specified bucket does not exist", codes.NotFound},
+		{"missing secret", 2, `secrets "rclone-secret" not found`, codes.Internal},
+		{"missing config file", 2, "open /etc/rclone.conf: no such file or directory", codes.Internal},
+		{"directory not found exit code", 3, "", codes.NotFound},
+		{"file not found exit code", 4, "", codes.NotFound},
+		{"temporary exit code", 5, "", codes.Unavailable},
+		{"fatal exit code", 7, "", codes.FailedPrecondition},
+		{"transfer limit exit code", 8, "", codes.ResourceExhausted},
+		{"no transfer exit code", 9, "", codes.OK},
+		{"duration exit code", 10, "", codes.DeadlineExceeded},
+		{"uncategorized", 2, "something broke", codes.Internal},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newRcloneError("rclone failed", &fakeexec.FakeExitError{Status: tc.exit}, tc.output)
+			if code := status.Code(err); code != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, code)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	rcloneErr := newRcloneError("rclone mkdir failed", &fakeexec.FakeExitError{Status: 3}, "")
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"nil", nil, codes.OK},
+		{"status error kept", status.Error(codes.Aborted, "busy"), codes.Aborted},
+		{"wrapped rclone error", fmt.Errorf("publishing: %w", rcloneErr), codes.NotFound},
+		{"pending uploads", fmt.Errorf("%w after 1m", errUploadsPending), codes.DeadlineExceeded},
+		{"context deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{"forbidden", k8serrors.NewForbidden(schema.GroupResource{Resource: "deployments"}, "m", errors.New("rbac")), codes.PermissionDenied},
+		{"conflict", k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "s", errors.New("changed")), codes.Aborted},
+		{"api unavailable", k8serrors.NewServiceUnavailable("down"), codes.Unavailable},
+		{"other", errors.New("boom"), codes.Internal},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := status.Code(statusError(tc.err, codes.Internal)); code != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// mountStatusAnnotation holds the mount state of a PV per node and
+	// target as JSON.
+	mountStatusAnnotation = "csi-rclone/mount-status"
+
+	// maxEventMessage keeps event messages and annotations readable when
+	// rclone dumps a lot of output.
+	maxEventMessage = 1024
+
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	podNameKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey = "csi.storage.k8s.io/pod.namespace"
+)
+
+// nodeMountStatus is the state of a target stored per node in
+// mountStatusAnnotation.
+type nodeMountStatus struct {
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	Updated string `json:"updated"`
+}
+
+// volumeReporter records Kubernetes Events for the volume lifecycle and keeps
+// mountStatusAnnotation up to date. Reporting is best effort: failures are
+// logged and never fail the CSI call.
+type volumeReporter struct {
+	kubeClient kubernetes.Interface
+	recorder   record.EventRecorder
+	nodeID     string
+	// volumes resolves volume handles to their PV without listing all PVs
+	// on every report.
+	volumes *volumeCache
+	// statuses writes the status annotations in the background.
+	statuses statusWriter
+}
+
+// statusWriter runs the status annotation updates of the reporter in the
+// order they were queued, from a single goroutine, so a slow or unreachable
+// API server does not hold up the CSI call reporting them.
+type statusWriter struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+	// queued counts the updates not written yet.
+	queued sync.WaitGroup
+}
+
+// enqueue queues update, starting a worker unless one runs.
+func (w *statusWriter) enqueue(update func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queued.Add(1)
+	w.pending = append(w.pending, update)
+	if !w.running {
+		w.running = true
+		go w.drain()
+	}
+}
+
+// drain runs the queued updates until none are left.
+func (w *statusWriter) drain() {
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		update := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		update()
+		w.queued.Done()
+	}
+}
+
+// wait blocks until the updates queued so far are written.
+func (w *statusWriter) wait() {
+	w.queued.Wait()
+}
+
+func newVolumeReporter(kubeClient kubernetes.Interface, nodeID string, volumes *volumeCache) *volumeReporter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return &volumeReporter{
+		kubeClient: kubeClient,
+		recorder:   broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: DriverName, Host: nodeID}),
+		nodeID:     nodeID,
+		volumes:    volumes,
+	}
+}
+
+// provisioned reports the outcome of CreateVolume on the claim, which is only
+// known when the provisioner runs with --extra-create-metadata.
+func (v *volumeReporter) provisioned(parameters map[string]string, volumeName string, err error) {
+	claim := claimReference(parameters[pvcNamespaceKey], parameters[pvcNameKey])
+	if claim == nil {
+		return
+	}
+	if err != nil {
+		v.event(claim, corev1.EventTypeWarning, "ProvisioningFailed", "creating volume %s failed: %v", volumeName, err)
+		return
+	}
+	v.event(claim, corev1.EventTypeNormal, "Provisioned", "created volume %s", volumeName)
+}
+
+// deleted reports the outcome of DeleteVolume on the PV and its claim.
+func (v *volumeReporter) deleted(volumeId string, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting deletion of %s: %v", volumeId, lookupErr)
+		return
+	}
+	if err != nil {
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "DeleteFailed", "deleting volume failed: %v", err)
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeNormal, "Deleted", "deleted volume")
+}
+
+// mounted reports the outcome of NodePublishVolume on the PV, its claim and,
+// when podInfoOnMount is enabled, the consuming pod.
+func (v *volumeReporter) mounted(volumeId, targetPath string, volumeContext map[string]string, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting mount of %s: %v", volumeId, lookupErr)
+		return
+	}
+	pod := podReference(volumeContext[podNamespaceKey], volumeContext[podNameKey])
+	if err != nil {
+		v.volumeEvent(pv, pod, corev1.EventTypeWarning, "MountFailed", "mounting on node %s failed: %v", v.nodeID, err)
+		v.setMountStatus(pv.Name, targetPath, "MountFailed", err.Error())
+		return
+	}
+	v.volumeEvent(pv, pod, corev1.EventTypeNormal, "Mounted", "mounted on node %s at %s", v.nodeID, targetPath)
+	v.setMountStatus(pv.Name, targetPath, "Mounted", "")
+}
+
+// unmounted reports the outcome of NodeUnpublishVolume on the PV and its claim.
+func (v *volumeReporter) unmounted(volumeId, targetPath string, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting unmount of %s: %v", volumeId, lookupErr)
+		return
+	}
+	if err != nil {
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "UnmountFailed", "unmounting on node %s failed: %v", v.nodeID, err)
+		v.setMountStatus(pv.Name, targetPath, "UnmountFailed", err.Error())
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeNormal, "Unmounted", "unmounted on node %s from %s", v.nodeID, targetPath)
+	v.setMountStatus(pv.Name, targetPath, "", "")
+}
+
+// stale reports a published target found with a stale mount on the PV and
+// its claim.
+func (v *volumeReporter) stale(volumeId, targetPath string, cause error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting stale mount of %s: %v", volumeId, lookupErr)
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeWarning, "MountStale", "mount on node %s at %s is stale, repairing it: %v", v.nodeID, targetPath, cause)
+	v.setMountStatus(pv.Name, targetPath, "MountStale", cause.Error())
+}
+
+// repaired reports the outcome of a stale mount repair on the PV and its
+// claim. A failed repair is tried again after retry.
+func (v *volumeReporter) repaired(volumeId, targetPath string, retry time.Duration, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting mount repair of %s: %v", volumeId, lookupErr)
+		return
+	}
+	if err != nil {
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "MountRepairFailed", "repairing the mount on node %s at %s failed, retrying in %v: %v", v.nodeID, targetPath, retry, err)
+		v.setMountStatus(pv.Name, targetPath, "MountRepairFailed", err.Error())
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeNormal, "MountRepaired", "remounted on node %s at %s", v.nodeID, targetPath)
+	v.setMountStatus(pv.Name, targetPath, "Mounted", "")
+}
+
+// evicted reports on pod, the PV and its claim the eviction of pod, whose
+// containers kept the stale mount of volumeId at targetPath.
+func (v *volumeReporter) evicted(volumeId, targetPath string, pod *corev1.Pod, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting eviction for %s: %v", volumeId, lookupErr)
+		return
+	}
+	ref := podReference(pod.Namespace, pod.Name)
+	if err != nil {
+		v.volumeEvent(pv, ref, corev1.EventTypeWarning, "EvictionFailed", "evicting pod %s/%s on node %s, which keeps the stale mount at %s, failed: %v", pod.Namespace, pod.Name, v.nodeID, targetPath, err)
+		return
+	}
+	v.volumeEvent(pv, ref, corev1.EventTypeNormal, "Evicted", "evicted pod %s/%s on node %s, which kept the stale mount at %s", pod.Namespace, pod.Name, v.nodeID, targetPath)
+}
+
+// staleConsumer reports on pod, the PV and its claim that pod keeps the
+// stale mount of volumeId at targetPath, as no controller would replace it
+// when evicted.
+func (v *volumeReporter) staleConsumer(volumeId, targetPath string, pod *corev1.Pod) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting stale consumer of %s: %v", volumeId, lookupErr)
+		return
+	}
+	v.volumeEvent(pv, podReference(pod.Namespace, pod.Name), corev1.EventTypeWarning, "MountStaleInPod", "pod %s/%s on node %s keeps the stale mount at %s, it is not evicted as no controller owns it", pod.Namespace, pod.Name, v.nodeID, targetPath)
+}
+
+// rotated reports a changed node-publish secret applied to the mounter of pv
+// on this node.
+func (v *volumeReporter) rotated(pv *corev1.PersistentVolume, remotes []string, remounted bool, err error) {
+	switch {
+	case err != nil:
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "CredentialsRotationFailed", "applying the new config of remotes %s on node %s failed: %v", strings.Join(remotes, ", "), v.nodeID, err)
+	case remounted:
+		v.volumeEvent(pv, nil, corev1.EventTypeNormal, "CredentialsRotated", "remounted on node %s for the new config of remotes %s", v.nodeID, strings.Join(remotes, ", "))
+	default:
+		v.volumeEvent(pv, nil, corev1.EventTypeNormal, "CredentialsRotated", "updated the config of remotes %s in the mounter on node %s", strings.Join(remotes, ", "), v.nodeID)
+	}
+}
+
+// prewarming reports the progress of a cache pre-warm on the PV and its
+// claim.
+func (v *volumeReporter) prewarming(volumeId string, progress prewarmProgress) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting pre-warm of %s: %v", volumeId, lookupErr)
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeNormal, "Prewarming", "pre-warming the cache on node %s: %d/%d files, %d/%d bytes read", v.nodeID, progress.Files, progress.TotalFiles, progress.Bytes, progress.TotalBytes)
+}
+
+// prewarmed reports the outcome of a cache pre-warm on the PV and its claim.
+func (v *volumeReporter) prewarmed(volumeId string, progress prewarmProgress, err error) {
+	pv, lookupErr := v.volumes.persistentVolume(volumeId)
+	if lookupErr != nil {
+		klog.V(4).Infof("not reporting pre-warm of %s: %v", volumeId, lookupErr)
+		return
+	}
+	if err != nil {
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "PrewarmFailed", "pre-warming the cache on node %s failed after %d files: %v", v.nodeID, progress.Files, err)
+		return
+	}
+	v.volumeEvent(pv, nil, corev1.EventTypeNormal, "Prewarmed", "pre-warmed the cache on node %s: read %d files, %d bytes in %v", v.nodeID, progress.Files, progress.Bytes, progress.Elapsed.Round(time.Second))
+}
+
+// limited reports the limits applied to the mounter of pv on this node and
+// records them in limitsStatusAnnotation.
+func (v *volumeReporter) limited(pv *corev1.PersistentVolume, limits activeLimits, err error) {
+	var value interface{}
+	if err != nil {
+		v.volumeEvent(pv, nil, corev1.EventTypeWarning, "LimitsFailed", "applying the limits on node %s failed: %v", v.nodeID, err)
+		limits.Message = truncate(redactor.Scrub(err.Error()), maxEventMessage)
+	} else {
+		v.volumeEvent(pv, nil, corev1.EventTypeNormal, "LimitsApplied", "applied limits %s on node %s", limits, v.nodeID)
+	}
+	if err != nil || !limits.empty() {
+		limits.Updated = time.Now().UTC().Format(time.RFC3339)
+		value = limits
+	}
+	v.setNodeStatus(pv.Name, limitsStatusAnnotation, value)
+}
+
+func (v *volumeReporter) volumeEvent(pv *corev1.PersistentVolume, pod *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	v.event(pv, eventType, reason, messageFmt, args...)
+	if pv.Spec.ClaimRef != nil {
+		claim := *pv.Spec.ClaimRef
+		if claim.Kind == "" {
+			claim.Kind = "PersistentVolumeClaim"
+		}
+		v.event(&claim, eventType, reason, messageFmt, args...)
+	}
+	if pod != nil {
+		v.event(pod, eventType, reason, messageFmt, args...)
+	}
+}
+
+func (v *volumeReporter) event(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	message := redactor.Scrub(fmt.Sprintf(messageFmt, args...))
+	v.recorder.Event(object, eventType, reason, truncate(message, maxEventMessage))
+}
+
+// setMountStatus records state for targetPath on this node in the PV status
+// annotation. An empty state removes the target, and the node entry with its
+// last target.
+func (v *volumeReporter) setMountStatus(pvName, targetPath, state, message string) {
+	updated := time.Now().UTC().Format(time.RFC3339)
+	v.updateNodeStatus(pvName, mountStatusAnnotation, func(current json.RawMessage) (interface{}, error) {
+		targets := map[string]nodeMountStatus{}
+		if current != nil {
+			if err := json.Unmarshal(current, &targets); err != nil {
+				klog.Warningf("discarding malformed %s of node %s on %s: %v", mountStatusAnnotation, v.nodeID, pvName, err)
+				targets = map[string]nodeMountStatus{}
+			}
+		}
+		if state == "" {
+			delete(targets, targetPath)
+		} else {
+			targets[targetPath] = nodeMountStatus{
+				State:   state,
+				Message: truncate(redactor.Scrub(message), maxEventMessage),
+				Updated: updated,
+			}
+		}
+		if len(targets) == 0 {
+			return nil, nil
+		}
+		return targets, nil
+	})
+}
+
+// setNodeStatus records value for this node in annotation of the PV, a JSON
+// object by node. A nil value removes the node entry.
+func (v *volumeReporter) setNodeStatus(pvName, annotation string, value interface{}) {
+	v.updateNodeStatus(pvName, annotation, func(json.RawMessage) (interface{}, error) {
+		return value, nil
+	})
+}
+
+// updateNodeStatus queues the replacement of the entry of this node in
+// annotation of the PV, a JSON object by node, with what update returns for
+// the current entry, nil when there is none. A nil value removes the node
+// entry.
+func (v *volumeReporter) updateNodeStatus(pvName, annotation string, update func(current json.RawMessage) (interface{}, error)) {
+	v.statuses.enqueue(func() {
+		v.writeNodeStatus(pvName, annotation, update)
+	})
+}
+
+// writeNodeStatus applies update to annotation of the PV, see
+// updateNodeStatus.
+func (v *volumeReporter) writeNodeStatus(pvName, annotation string, update func(current json.RawMessage) (interface{}, error)) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := v.kubeClient.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		statuses := map[string]json.RawMessage{}
+		if raw, ok := pv.Annotations[annotation]; ok {
+			if err := json.Unmarshal([]byte(raw), &statuses); err != nil {
+				klog.Warningf("discarding malformed %s annotation on %s: %v", annotation, pvName, err)
+			}
+		}
+		value, err := update(statuses[v.nodeID])
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			if _, ok := statuses[v.nodeID]; !ok {
+				return nil
+			}
+			delete(statuses, v.nodeID)
+		} else {
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			statuses[v.nodeID] = raw
+		}
+
+		if pv.Annotations == nil {
+			pv.Annotations = map[string]string{}
+		}
+		if len(statuses) == 0 {
+			delete(pv.Annotations, annotation)
+		} else {
+			raw, err := json.Marshal(statuses)
+			if err != nil {
+				return err
+			}
+			pv.Annotations[annotation] = string(raw)
+		}
+		_, err = v.kubeClient.CoreV1().PersistentVolumes().Update(pv)
+		return err
+	})
+	if err != nil {
+		klog.Warningf("updating %s annotation on %s failed: %v", annotation, pvName, err)
+	}
+}
+
+func claimReference(namespace, name string) *corev1.ObjectReference {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: namespace, Name: name}
+}
+
+func podReference(namespace, name string) *corev1.ObjectReference {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+}
+
+// truncate cuts s to at most max bytes, on a rune boundary.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + "..."
+}
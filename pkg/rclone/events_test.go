@@ -0,0 +1,135 @@
+package rclone
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMountStatus(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	pv.Annotations = map[string]string{mountStatusAnnotation: `{"other-node":{"/target":{"state":"Mounted","updated":"2024-01-01T00:00:00Z"}}}`}
+	td := newTestDriver(newFakeRclone(), pv)
+	reporter := td.ns.reporter
+
+	status := func() map[string]map[string]nodeMountStatus {
+		reporter.statuses.wait()
+		pv, err := td.kubeClient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := map[string]map[string]nodeMountStatus{}
+		if raw, ok := pv.Annotations[mountStatusAnnotation]; ok {
+			if err := json.Unmarshal([]byte(raw), &statuses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return statuses
+	}
+	states := func() map[string]string {
+		out := map[string]string{}
+		for target, s := range status()[testNodeID] {
+			out[target] = s.State
+		}
+		return out
+	}
+
+	reporter.mounted("vol-1", "/target-a", nil, nil)
+	reporter.mounted("vol-1", "/target-b", nil, errors.New("bad credentials"))
+	if got := states(); len(got) != 2 || got["/target-a"] != "Mounted" || got["/target-b"] != "MountFailed" {
+		t.Errorf("expected a state per target, got %v", got)
+	}
+	if got := status()[testNodeID]["/target-b"].Message; got != "bad credentials" {
+		t.Errorf("expected the failure in the status, got %q", got)
+	}
+
+	// Unpublishing a target keeps the others of the node.
+	reporter.unmounted("vol-1", "/target-a", nil)
+	if got := states(); len(got) != 1 || got["/target-b"] != "MountFailed" {
+		t.Errorf("expected only /target-b left, got %v", got)
+	}
+
+	reporter.stale("vol-1", "/target-b", errors.New("transport endpoint is not connected"))
+	if got := states()["/target-b"]; got != "MountStale" {
+		t.Errorf("expected the stale target recorded, got %q", got)
+	}
+	reporter.unmounted("vol-1", "/target-b", nil)
+	statuses := status()
+	if _, ok := statuses[testNodeID]; ok {
+		t.Errorf("expected the node entry removed with its last target, got %v", statuses[testNodeID])
+	}
+	if got := statuses["other-node"]["/target"].State; got != "Mounted" {
+		t.Errorf("expected the status of other nodes kept, got %v", statuses)
+	}
+
+	if got := len(td.recorder.Events); got != 10 {
+		t.Errorf("expected 5 events on the PV and its claim, got %d", got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{s: "short", max: 10, want: "short"},
+		{s: "abcdef", max: 3, want: "abc..."},
+		// é is two bytes, cutting after its first byte would split it.
+		{s: "aébc", max: 2, want: "a..."},
+		{s: "aébc", max: 3, want: "aé..."},
+		{s: "日本語", max: 4, want: "日..."},
+	}
+	for _, tc := range tests {
+		got := truncate(tc.s, tc.max)
+		if got != tc.want {
+			t.Errorf("truncate(%q, %d): expected %q, got %q", tc.s, tc.max, tc.want, got)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) split a rune: %q", tc.s, tc.max, got)
+		}
+	}
+}
+
+func TestMountStatusWrittenInBackground(t *testing.T) {
+	td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"))
+	reporter := td.ns.reporter
+	release := make(chan struct{})
+	td.kubeClient.PrependReactor("update", "persistentvolumes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+
+	reported := make(chan struct{})
+	go func() {
+		reporter.mounted("vol-1", "/target-a", nil, nil)
+		reporter.unmounted("vol-1", "/target-a", nil)
+		reporter.mounted("vol-1", "/target-b", nil, nil)
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reporting not to wait for the API server")
+	}
+
+	close(release)
+	reporter.statuses.wait()
+	pv, err := td.kubeClient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]map[string]nodeMountStatus{}
+	if err := json.Unmarshal([]byte(pv.Annotations[mountStatusAnnotation]), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if targets := statuses[testNodeID]; len(targets) != 1 || targets["/target-b"].State != "Mounted" {
+		t.Errorf("expected the updates written in order, got %v", targets)
+	}
+}
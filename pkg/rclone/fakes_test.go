@@ -0,0 +1,350 @@
+package rclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+const (
+	testNamespace = "csi-rclone"
+	testNodeID    = "node-1"
+)
+
+// rcloneResult is the scripted outcome of one rclone invocation.
+type rcloneResult struct {
+	output string
+	err    error
+	// wait, when set, holds the invocation until it is closed.
+	wait <-chan struct{}
+}
+
+var errRcloneFailed = &fakeexec.FakeExitError{Status: 1}
+
+// fakeRclone is an exec.Interface that replays scripted rclone results and
+// records every command line it was asked to run.
+type fakeRclone struct {
+	mu      sync.Mutex
+	results []rcloneResult
+	calls   [][]string
+}
+
+var _ exec.Interface = &fakeRclone{}
+
+func newFakeRclone(results ...rcloneResult) *fakeRclone {
+	return &fakeRclone{results: results}
+}
+
+func (f *fakeRclone) CommandContext(ctx context.Context, name string, args ...string) exec.Cmd {
+	return f.Command(name, args...)
+}
+
+func (f *fakeRclone) LookPath(file string) (string, error) {
+	return "/usr/bin/" + file, nil
+}
+
+func (f *fakeRclone) Command(name string, args ...string) exec.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+
+	result := rcloneResult{err: errors.New("unexpected rclone call")}
+	if len(f.results) > 0 {
+		result, f.results = f.results[0], f.results[1:]
+	}
+	cmd := &fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) {
+				if result.wait != nil {
+					<-result.wait
+				}
+				return []byte(result.output), result.err
+			},
+		},
+	}
+	return fakeexec.InitFakeCmd(cmd, name, args...)
+}
+
+// testPV returns a bound CSI PersistentVolume for volumeId.
+func testPV(name, volumeId, remote, path string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       DriverName,
+					VolumeHandle: volumeId,
+					VolumeAttributes: map[string]string{
+						"remote": remote,
+						"path":   path,
+					},
+				},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "data"},
+		},
+	}
+}
+
+// testDriver wires the controller and node servers to a fake clientset, a
+// scripted rclone and a fake mounter. Creating a mounter Deployment mounts
+// its target in the fake mounter and adds a running mounter pod, like a
+// running rclone would, and so does deleting a mounter pod. Mounter rc calls go to a fake rc answering {}.
+type testDriver struct {
+	kubeClient *fake.Clientset
+	rclone     *fakeRclone
+	mounter    *mount.FakeMounter
+	recorder   *record.FakeRecorder
+	cs         *controllerServer
+	ns         *nodeServer
+}
+
+func newTestDriver(rclone *fakeRclone, objects ...runtime.Object) *testDriver {
+	// The tracker behind NewSimpleClientset is not reachable from reactors,
+	// which cannot call the clientset either.
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, object := range objects {
+		if err := tracker.Add(object); err != nil {
+			panic(err)
+		}
+	}
+	td := &testDriver{
+		kubeClient: fake.NewSimpleClientset(),
+		rclone:     rclone,
+		mounter:    &mount.FakeMounter{},
+		recorder:   record.NewFakeRecorder(100),
+	}
+	td.kubeClient.PrependReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	td.kubeClient.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		return err == nil, w, err
+	})
+	// startMounter mounts the target of deployment and adds its running pod.
+	started := 0
+	startMounter := func(deployment *appsv1.Deployment) {
+		for _, v := range deployment.Spec.Template.Spec.Volumes {
+			if v.Name == "mount" && v.HostPath != nil {
+				td.mounter.Mount("rclone", v.HostPath.Path, "fuse.rclone", nil)
+			}
+		}
+		started++
+		tracker.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-fake-%d", deployment.Name, started), Namespace: deployment.Namespace, Labels: deployment.Spec.Template.Labels},
+			Spec:       deployment.Spec.Template.Spec,
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.9"},
+		})
+	}
+	td.kubeClient.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		startMounter(action.(k8stesting.CreateAction).GetObject().(*appsv1.Deployment))
+		return false, nil, nil
+	})
+	td.kubeClient.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// The Deployment of a deleted mounter pod replaces it.
+		name := action.(k8stesting.DeleteAction).GetName()
+		pod, err := tracker.Get(corev1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), name)
+		if err != nil {
+			return false, nil, nil
+		}
+		volumeId := pod.(*corev1.Pod).Labels["volumeid"]
+		deployment, err := tracker.Get(appsv1.SchemeGroupVersion.WithResource("deployments"), action.GetNamespace(), (&RcloneVolume{ID: volumeId}).deploymentName())
+		if volumeId != "" && err == nil {
+			startMounter(deployment.(*appsv1.Deployment))
+		}
+		return false, nil, nil
+	})
+
+	ops := &Rclone{
+		execute:    rclone,
+		kubeClient: td.kubeClient,
+		namespace:  testNamespace,
+		nodeID:     testNodeID,
+		rcAddress:  func(*corev1.Pod) (string, error) { return testRcAddress(), nil },
+		volumes:    newVolumeCache(td.kubeClient, testNamespace, testNodeID),
+	}
+	locks := newOperationLocks()
+	reporter := &volumeReporter{kubeClient: td.kubeClient, recorder: td.recorder, nodeID: testNodeID, volumes: ops.volumes}
+	driver := csicommon.NewCSIDriver(DriverName, DriverVersion, testNodeID)
+	driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	})
+
+	td.cs = &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(driver),
+		RcloneOps:               ops,
+		reporter:                reporter,
+		locks:                   locks,
+		configs:                 &configProvider{dir: filepath.Join(os.TempDir(), "csi-rclone-test-conf")},
+		volumes:                 ops.volumes,
+	}
+	td.ns = &nodeServer{
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
+		mounter:           &mount.SafeFormatAndMount{Interface: td.mounter, Exec: mount.NewFakeExec(nil)},
+		RcloneOps:         ops,
+		reporter:          reporter,
+		kubeClient:        td.kubeClient,
+		nodeID:            testNodeID,
+		state:             &nodeState{volumes: map[string]publishedVolume{}},
+		locks:             locks,
+		syncer:            newSyncManager(rclone, td.mounter, ""),
+		serveOps: map[string]Operations{
+			mountTypeNFS:    NewServeRclone(ops, mountTypeNFS, td.mounter),
+			mountTypeWebDAV: NewServeRclone(ops, mountTypeWebDAV, td.mounter),
+		},
+		prewarmer: newPrewarmer(reporter, ops.runningMounter),
+		limits:    newLimitsManager(ops, reporter),
+	}
+	td.ns.watchdog = newMountWatchdog(td.ns)
+	return td
+}
+
+var (
+	testRcOnce   sync.Once
+	testRcServer *httptest.Server
+)
+
+// testRcAddress returns the address of a fake rc shared by the tests, which
+// answers every call with an empty result.
+func testRcAddress() string {
+	testRcOnce.Do(func() {
+		testRcServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		}))
+	})
+	return strings.TrimPrefix(testRcServer.URL, "http://")
+}
+
+// fakeRcHandler answers an rc call with params, returning the result to
+// encode as JSON or failing the call with err.
+type fakeRcHandler func(params map[string]interface{}) (result interface{}, err error)
+
+// fakeRcCall is an rc call recorded by fakeRc.
+type fakeRcCall struct {
+	method string
+	// body is the JSON body as sent, params the decoded body.
+	body   string
+	params map[string]interface{}
+}
+
+func (c fakeRcCall) String() string {
+	return c.method + " " + c.body
+}
+
+// testRcPass is the rc password of the mounters of mounterSecret.
+const testRcPass = "test-rc-pass"
+
+// mounterSecret is the mounter Secret of volumeId, with its rc credentials.
+func mounterSecret(volumeId string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: (&RcloneVolume{ID: volumeId}).deploymentName(), Namespace: testNamespace},
+		Data: map[string][]byte{
+			"rclone.conf": []byte(testRcloneConf),
+			rcUserKey:     []byte(rcUser),
+			rcPassKey:     []byte(testRcPass),
+		},
+	}
+}
+
+// fakeRc is the rc API of a mounter, recording every call. Methods with a
+// handler are answered by it, any other method with an empty result. Once
+// password is set, calls without it are refused like rclone does.
+type fakeRc struct {
+	addr     string
+	handlers map[string]fakeRcHandler
+	password string
+
+	mu       sync.Mutex
+	recorded []fakeRcCall
+}
+
+func newFakeRc(t *testing.T, handlers map[string]fakeRcHandler) *fakeRc {
+	f := &fakeRc{handlers: handlers}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		password := f.password
+		f.mu.Unlock()
+		if user, pass, _ := r.BasicAuth(); password != "" && (user != rcUser || pass != password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "authentication required"})
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		call := fakeRcCall{method: strings.TrimPrefix(r.URL.Path, "/"), body: string(body), params: map[string]interface{}{}}
+		json.Unmarshal(body, &call.params)
+		f.mu.Lock()
+		f.recorded = append(f.recorded, call)
+		f.mu.Unlock()
+
+		var result interface{} = struct{}{}
+		if handler, ok := f.handlers[call.method]; ok {
+			var err error
+			if result, err = handler(call.params); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+	f.addr = strings.TrimPrefix(server.URL, "http://")
+	return f
+}
+
+// calls returns the recorded calls of methods, or of all methods when none
+// is given.
+func (f *fakeRc) calls(methods ...string) []fakeRcCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []fakeRcCall{}
+	for _, call := range f.recorded {
+		if len(methods) == 0 || contains(methods, call.method) {
+			out = append(out, call)
+		}
+	}
+	return out
+}
+
+// reset forgets the recorded calls.
+func (f *fakeRc) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recorded = nil
+}
+
+// actions returns the verb and resource of every recorded API call, such as
+// "create secrets".
+func (td *testDriver) actions() []string {
+	out := []string{}
+	for _, a := range td.kubeClient.Actions() {
+		out = append(out, a.GetVerb()+" "+a.GetResource().Resource)
+	}
+	return out
+}
+
+var testVolumeCapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+}
@@ -0,0 +1,146 @@
+package rclone
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+)
+
+// minRcloneVersion is the oldest rclone supporting every default mount flag.
+var minRcloneVersion = [3]int{1, 53, 0}
+
+// bisyncRcloneVersion is the oldest rclone sync mode volumes with a bisync
+// conflict policy run with, it added bisync --conflict-resolve.
+var bisyncRcloneVersion = [3]int{1, 66, 0}
+
+var rcloneVersionPattern = regexp.MustCompile(`rclone v(\d+)\.(\d+)\.(\d+)`)
+
+const fuseDevice = "/dev/fuse"
+
+// rcloneVersionCheck checks that the local rclone is min or newer. A
+// successful check is cached, the binary does not change while the plugin
+// runs.
+type rcloneVersionCheck struct {
+	execute exec.Interface
+	min     [3]int
+	// needs says what requires min, for the error.
+	needs string
+
+	mu      sync.Mutex
+	checked bool
+}
+
+func (c *rcloneVersionCheck) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked {
+		return nil
+	}
+
+	out, err := c.execute.Command("rclone", "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rclone version failed: %v", err)
+	}
+	match := rcloneVersionPattern.FindStringSubmatch(string(out))
+	if match == nil {
+		return fmt.Errorf("cannot parse rclone version from %q", out)
+	}
+	for i := 0; i < 3; i++ {
+		v, _ := strconv.Atoi(match[i+1])
+		if v > c.min[i] {
+			break
+		}
+		if v < c.min[i] {
+			return fmt.Errorf("rclone %s.%s.%s is older than v%d.%d.%d, which %s needs",
+				match[1], match[2], match[3], c.min[0], c.min[1], c.min[2], c.needs)
+		}
+	}
+	c.checked = true
+	return nil
+}
+
+type identityServer struct {
+	*csicommon.DefaultIdentityServer
+	mode       Mode
+	expansion  bool
+	topology   bool
+	execute    exec.Interface
+	volumes    *volumeCache
+	fuseDevice string
+	rclone     *rcloneVersionCheck
+}
+
+func NewIdentityServer(d *Driver) *identityServer {
+	return &identityServer{
+		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d.csiDriver),
+		mode:                  d.mode,
+		expansion:             d.expansion,
+		topology:              len(d.topologyKeys) > 0,
+		execute:               d.execute,
+		volumes:               d.volumes,
+		fuseDevice:            fuseDevice,
+		rclone:                &rcloneVersionCheck{execute: d.execute, min: minRcloneVersion, needs: "the plugin"},
+	}
+}
+
+// Probe reports the plugin healthy when the local rclone is there and
+// supported, FUSE is available on nodes and the volume cache has synced with
+// the Kubernetes API. It makes no API calls.
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if _, err := ids.execute.LookPath("rclone"); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "rclone is not available: %v", err)
+	}
+	if err := ids.rclone.check(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if ids.mode.node() {
+		if _, err := os.Stat(ids.fuseDevice); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "FUSE is not available: %v", err)
+		}
+	}
+	if !ids.volumes.synced() {
+		return nil, status.Error(codes.FailedPrecondition, "the volume cache has not synced with the Kubernetes API yet")
+	}
+	return &csi.ProbeResponse{}, nil
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	caps := []*csi.PluginCapability{}
+	if ids.mode.controller() {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+	if ids.topology {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	if ids.expansion {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+				},
+			},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
+}
@@ -0,0 +1,182 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/exec"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        Mode
+		rclone      []rcloneResult
+		missingFuse bool
+		kubeDown    bool
+		wantCode    codes.Code
+	}{
+		{
+			name:     "healthy node",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{output: "rclone v1.66.0\n- os/version: alpine 3.16\n"}},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "development build",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{output: "rclone v1.69.0-DEV\n"}},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "rclone missing",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{err: errRcloneFailed}},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "rclone too old",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{output: "rclone v1.52.3\n"}},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			// Only sync mode volumes with a bisync policy need v1.66.
+			name:     "rclone without bisync conflict resolution",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{output: "rclone v1.65.2\n"}},
+			wantCode: codes.OK,
+		},
+		{
+			name:        "no fuse on node",
+			mode:        ModeNode,
+			rclone:      []rcloneResult{{output: "rclone v1.66.0\n"}},
+			missingFuse: true,
+			wantCode:    codes.FailedPrecondition,
+		},
+		{
+			name:        "controller needs no fuse",
+			mode:        ModeController,
+			rclone:      []rcloneResult{{output: "rclone v1.66.0\n"}},
+			missingFuse: true,
+			wantCode:    codes.OK,
+		},
+		{
+			name:     "kube API unreachable",
+			mode:     ModeNode,
+			rclone:   []rcloneResult{{output: "rclone v1.66.0\n"}},
+			kubeDown: true,
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			if tc.kubeDown {
+				kubeClient.PrependReactor("list", "persistentvolumes", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			d := NewDriver(testNodeID, "unix:///tmp/csi.sock", kubeClient, newFakeRclone(tc.rclone...), WithMode(tc.mode))
+			ids := NewIdentityServer(d)
+			ids.fuseDevice = filepath.Join(t.TempDir(), "fuse")
+			if !tc.missingFuse {
+				ids.fuseDevice = t.TempDir()
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			d.volumes.start(false, stopCh)
+			if !tc.kubeDown && !cache.WaitForCacheSync(stopCh, d.volumes.synced) {
+				t.Fatal("volume cache not synced")
+			}
+
+			kubeClient.ClearActions()
+			_, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if actions := kubeClient.Actions(); !tc.kubeDown && len(actions) != 0 {
+				t.Errorf("expected no API calls, got %v", actions)
+			}
+		})
+	}
+}
+
+func TestPluginCapabilities(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           Mode
+		nodeID         string
+		opts           []DriverOption
+		wantController bool
+		wantExpansion  bool
+	}{
+		{name: "controller", mode: ModeController, wantController: true},
+		{name: "node", mode: ModeNode, nodeID: testNodeID},
+		{name: "all", mode: ModeAll, nodeID: testNodeID, wantController: true},
+		{
+			name:           "controller with expansion",
+			mode:           ModeController,
+			opts:           []DriverOption{WithVolumeExpansion()},
+			wantController: true,
+			wantExpansion:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]DriverOption{WithMode(tc.mode)}, tc.opts...)
+			d := NewDriver(tc.nodeID, "unix:///tmp/csi.sock", fake.NewSimpleClientset(), exec.New(), opts...)
+
+			resp, err := NewIdentityServer(d).GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			controller, expansion := false, false
+			for _, c := range resp.GetCapabilities() {
+				if c.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+					controller = true
+				}
+				if c.GetVolumeExpansion().GetType() == csi.PluginCapability_VolumeExpansion_ONLINE {
+					expansion = true
+				}
+			}
+			if controller != tc.wantController {
+				t.Errorf("expected CONTROLLER_SERVICE advertised to be %v", tc.wantController)
+			}
+			if expansion != tc.wantExpansion {
+				t.Errorf("expected ONLINE expansion advertised to be %v", tc.wantExpansion)
+			}
+
+			err = d.csiDriver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+			if (err == nil) != tc.wantController {
+				t.Errorf("expected CREATE_DELETE_VOLUME capability to be %v, got %v", tc.wantController, err)
+			}
+			err = d.csiDriver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+			if (err == nil) != tc.wantExpansion {
+				t.Errorf("expected EXPAND_VOLUME capability to be %v, got %v", tc.wantExpansion, err)
+			}
+		})
+	}
+}
+
+func TestMounterImageVersion(t *testing.T) {
+	tag := mounterImage[strings.LastIndex(mounterImage, ":")+1:]
+	for _, min := range [][3]int{minRcloneVersion, bisyncRcloneVersion} {
+		check := &rcloneVersionCheck{execute: newFakeRclone(rcloneResult{output: "rclone v" + tag + "\n"}), min: min, needs: "the mounter"}
+		if err := check.check(); err != nil {
+			t.Errorf("expected the mounter image to run a supported rclone: %v", err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package rclone
+
+import (
+	"errors"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// volumeHandleIndex indexes the PersistentVolumes of the driver by volume
+// handle.
+const volumeHandleIndex = "volumeHandle"
+
+func indexVolumeHandle(obj interface{}) ([]string, error) {
+	pv, ok := obj.(*corev1.PersistentVolume)
+	if !ok || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+		return nil, nil
+	}
+	return []string{pv.Spec.CSI.VolumeHandle}, nil
+}
+
+// podUIDIndex indexes the pods of the node by UID, which is all kubelet
+// target paths tell about their pod.
+const podUIDIndex = "uid"
+
+func indexPodUID(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	return []string{string(pod.UID)}, nil
+}
+
+// volumeCache serves the objects the plugin looks up on every volume event
+// from shared informers instead of listing them: the PersistentVolumes of the
+// driver by volume handle and, on nodes, the mounter Deployments and the
+// mounter pods of the node. Until the informers are synced, and for objects
+// not in the cache yet, the API is asked. Cached objects are shared and must
+// not be modified.
+//
+// PVs are cluster-scoped and do not record the nodes they are used on, so
+// the PV informer lists and watches those of the whole cluster on every
+// node. Claims are only watched one by one for the volumes of the node, see
+// claimWatches.
+type volumeCache struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	nodeID     string
+
+	factory informers.SharedInformerFactory
+	pvs     cache.SharedIndexInformer
+	// deployments holds the mounter Deployments and pods the mounter pods
+	// on the node, both nil until started on a node.
+	deployments cache.SharedIndexInformer
+	pods        cache.SharedIndexInformer
+	// consumers holds all pods on the node, nil unless started with
+	// startConsumers.
+	consumers cache.SharedIndexInformer
+}
+
+func newVolumeCache(kubeClient kubernetes.Interface, namespace, nodeID string) *volumeCache {
+	c := &volumeCache{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		nodeID:     nodeID,
+		factory:    informers.NewSharedInformerFactory(kubeClient, 0),
+	}
+	c.pvs = c.factory.Core().V1().PersistentVolumes().Informer()
+	c.pvs.AddIndexers(cache.Indexers{volumeHandleIndex: indexVolumeHandle})
+	return c
+}
+
+// start runs the informers until stopCh is closed. Nodes also watch the
+// mounter Deployments in the namespace of the plugin and the mounter pods
+// scheduled on the node.
+func (c *volumeCache) start(node bool, stopCh <-chan struct{}) {
+	if node {
+		mounters := informers.NewSharedInformerFactoryWithOptions(c.kubeClient, 0,
+			informers.WithNamespace(c.namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = "volumeid"
+			}))
+		c.deployments = mounters.Apps().V1().Deployments().Informer()
+		mounters.Start(stopCh)
+		nodePods := informers.NewSharedInformerFactoryWithOptions(c.kubeClient, 0,
+			informers.WithNamespace(c.namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = "volumeid"
+				options.FieldSelector = c.nodePodSelector()
+			}))
+		c.pods = nodePods.Core().V1().Pods().Informer()
+		nodePods.Start(stopCh)
+	}
+	c.factory.Start(stopCh)
+}
+
+// startConsumers runs an informer of all pods scheduled on the node, in
+// every namespace, until stopCh is closed. The mount watchdog looks up the
+// pods of stale targets in it.
+func (c *volumeCache) startConsumers(stopCh <-chan struct{}) {
+	nodePods := informers.NewSharedInformerFactoryWithOptions(c.kubeClient, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = c.nodePodSelector()
+		}))
+	c.consumers = nodePods.Core().V1().Pods().Informer()
+	c.consumers.AddIndexers(cache.Indexers{podUIDIndex: indexPodUID})
+	nodePods.Start(stopCh)
+}
+
+// synced tells whether the informers have listed their objects.
+func (c *volumeCache) synced() bool {
+	return c.pvs.HasSynced() && (c.deployments == nil || c.deployments.HasSynced()) &&
+		(c.pods == nil || c.pods.HasSynced()) && (c.consumers == nil || c.consumers.HasSynced())
+}
+
+// nodePodSelector selects the pods scheduled on the node.
+func (c *volumeCache) nodePodSelector() string {
+	return fields.OneTermEqualSelector("spec.nodeName", c.nodeID).String()
+}
+
+// persistentVolume returns the PersistentVolume of volumeId.
+func (c *volumeCache) persistentVolume(volumeId string) (*corev1.PersistentVolume, error) {
+	if pv := c.cachedPersistentVolume(volumeId); pv != nil {
+		return pv, nil
+	}
+	// The PV may have been created after the last event the cache saw.
+	return getPersistentVolume(c.kubeClient, volumeId)
+}
+
+// cachedPersistentVolume returns the PersistentVolume of volumeId from the
+// cache alone, nil when it is not there.
+func (c *volumeCache) cachedPersistentVolume(volumeId string) *corev1.PersistentVolume {
+	if !c.pvs.HasSynced() {
+		return nil
+	}
+	objects, err := c.pvs.GetIndexer().ByIndex(volumeHandleIndex, volumeId)
+	if err != nil || len(objects) == 0 {
+		return nil
+	}
+	return objects[0].(*corev1.PersistentVolume)
+}
+
+// namedPersistentVolume returns the PersistentVolume called name.
+func (c *volumeCache) namedPersistentVolume(name string) (*corev1.PersistentVolume, error) {
+	if c.pvs.HasSynced() {
+		if obj, exists, err := c.pvs.GetStore().GetByKey(name); err == nil && exists {
+			return obj.(*corev1.PersistentVolume), nil
+		}
+	}
+	return c.kubeClient.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+}
+
+// deployment returns the mounter Deployment called name. Once synced, the
+// cache is trusted: a Deployment it misses is reported as not found.
+func (c *volumeCache) deployment(name string) (*appsv1.Deployment, error) {
+	if c.deployments != nil && c.deployments.HasSynced() {
+		obj, exists, err := c.deployments.GetStore().GetByKey(c.namespace + "/" + name)
+		if err != nil || !exists {
+			return nil, k8serrors.NewNotFound(appsv1.Resource("deployments"), name)
+		}
+		return obj.(*appsv1.Deployment), nil
+	}
+	return c.kubeClient.AppsV1().Deployments(c.namespace).Get(name, metav1.GetOptions{})
+}
+
+// nodeDeployments returns the mounter Deployments scheduled on nodeID,
+// sorted by name.
+func (c *volumeCache) nodeDeployments(nodeID string) ([]*appsv1.Deployment, error) {
+	all := []*appsv1.Deployment{}
+	if c.deployments != nil && c.deployments.HasSynced() {
+		for _, obj := range c.deployments.GetStore().List() {
+			all = append(all, obj.(*appsv1.Deployment))
+		}
+	} else {
+		deployments, err := c.kubeClient.AppsV1().Deployments(c.namespace).List(metav1.ListOptions{LabelSelector: "volumeid"})
+		if err != nil {
+			return nil, err
+		}
+		for i := range deployments.Items {
+			all = append(all, &deployments.Items[i])
+		}
+	}
+	out := []*appsv1.Deployment{}
+	for _, deployment := range all {
+		if deployment.Spec.Template.Spec.NodeName == nodeID {
+			out = append(out, deployment)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// nodeMounterPods returns the mounter pods scheduled on the node.
+func (c *volumeCache) nodeMounterPods() ([]*corev1.Pod, error) {
+	out := []*corev1.Pod{}
+	if c.pods != nil && c.pods.HasSynced() {
+		for _, obj := range c.pods.GetStore().List() {
+			if pod := obj.(*corev1.Pod); pod.Spec.NodeName == c.nodeID {
+				out = append(out, pod)
+			}
+		}
+		return out, nil
+	}
+	pods, err := c.kubeClient.CoreV1().Pods(c.namespace).List(metav1.ListOptions{
+		LabelSelector: "volumeid",
+		FieldSelector: c.nodePodSelector(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		out = append(out, &pods.Items[i])
+	}
+	return out, nil
+}
+
+// nodePod returns the pod of the node with uid from the consumers informer,
+// nil when it is not there.
+func (c *volumeCache) nodePod(uid types.UID) (*corev1.Pod, error) {
+	if c.consumers == nil || !c.consumers.HasSynced() {
+		return nil, errors.New("the pods of the node are not cached yet")
+	}
+	objects, err := c.consumers.GetIndexer().ByIndex(podUIDIndex, string(uid))
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+	return objects[0].(*corev1.Pod), nil
+}
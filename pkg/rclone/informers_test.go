@@ -0,0 +1,33 @@
+package rclone
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestVolumeCacheReports(t *testing.T) {
+	td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"))
+	reporter := td.ns.reporter
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	reporter.volumes.start(true, stopCh)
+	if !cache.WaitForCacheSync(stopCh, reporter.volumes.synced) {
+		t.Fatal("volume cache not synced")
+	}
+
+	td.kubeClient.ClearActions()
+	reporter.mounted("vol-1", "/target", nil, errors.New("bad credentials"))
+	reporter.unmounted("vol-1", "/target", nil)
+	if contains(td.actions(), "list persistentvolumes") {
+		t.Errorf("expected the PV looked up in the cache, got actions %v", td.actions())
+	}
+	if len(td.recorder.Events) != 4 {
+		t.Errorf("expected events on the PV and its claim, got %d", len(td.recorder.Events))
+	}
+
+	if _, err := reporter.volumes.persistentVolume("vol-3"); err == nil {
+		t.Errorf("expected an unknown volume not found")
+	}
+}
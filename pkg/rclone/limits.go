@@ -0,0 +1,439 @@
+package rclone
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// Annotations of PVs and their claims limiting the mounters of a volume.
+// Those of the claim take precedence.
+const (
+	// bwLimitAnnotation is a --bwlimit value, a rate or a timetable.
+	bwLimitAnnotation   = "csi-rclone/bwlimit"
+	tpsLimitAnnotation  = "csi-rclone/tpslimit"
+	transfersAnnotation = "csi-rclone/transfers"
+
+	// limitsStatusAnnotation holds the limits active per node on a PV as
+	// JSON.
+	limitsStatusAnnotation = "csi-rclone/limits-status"
+)
+
+// defaultTransfers is what --transfers returns to when its annotation is
+// removed.
+const defaultTransfers = 4
+
+// volumeLimits are the limits set for a volume, empty when unset.
+type volumeLimits struct {
+	BwLimit   string
+	TPSLimit  string
+	Transfers string
+}
+
+// activeLimits are the limits in effect at one time, as recorded in
+// limitsStatusAnnotation.
+type activeLimits struct {
+	BwLimit   string `json:"bwlimit,omitempty"`
+	TPSLimit  string `json:"tpslimit,omitempty"`
+	Transfers string `json:"transfers,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Updated   string `json:"updated,omitempty"`
+}
+
+func (l activeLimits) empty() bool {
+	return l.BwLimit == "" && l.TPSLimit == "" && l.Transfers == ""
+}
+
+func (l activeLimits) String() string {
+	parts := []string{}
+	for _, p := range []struct{ name, value string }{{"bwlimit", l.BwLimit}, {"tpslimit", l.TPSLimit}, {"transfers", l.Transfers}} {
+		if p.value != "" {
+			parts = append(parts, p.name+"="+p.value)
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// limitsFor reads the limits annotations of pv and its claim, which may be
+// nil.
+func limitsFor(pv *corev1.PersistentVolume, claim *corev1.PersistentVolumeClaim) (volumeLimits, error) {
+	value := func(key string) string {
+		if claim != nil {
+			if v, ok := claim.Annotations[key]; ok {
+				return strings.TrimSpace(v)
+			}
+		}
+		return strings.TrimSpace(pv.Annotations[key])
+	}
+	limits := volumeLimits{
+		BwLimit:   value(bwLimitAnnotation),
+		TPSLimit:  value(tpsLimitAnnotation),
+		Transfers: value(transfersAnnotation),
+	}
+	if limits.TPSLimit != "" {
+		if tps, err := strconv.ParseFloat(limits.TPSLimit, 64); err != nil || tps < 0 {
+			return limits, fmt.Errorf("invalid %s %q, expected transactions per second such as 10", tpsLimitAnnotation, limits.TPSLimit)
+		}
+	}
+	if limits.Transfers != "" {
+		if n, err := strconv.Atoi(limits.Transfers); err != nil || n < 1 {
+			return limits, fmt.Errorf("invalid %s %q, expected a number of transfers such as 2", transfersAnnotation, limits.Transfers)
+		}
+	}
+	return limits, nil
+}
+
+// active returns the limits to set on a mounter. The bandwidth limit is
+// passed to rclone as it is, timetables included.
+func (l volumeLimits) active() activeLimits {
+	return activeLimits{BwLimit: l.BwLimit, TPSLimit: l.TPSLimit, Transfers: l.Transfers}
+}
+
+// appliedLimits are the limits in effect on the mounter pod of a volume, as
+// last reported.
+type appliedLimits struct {
+	pod    types.UID
+	limits activeLimits
+}
+
+// limitsManager applies the limits annotations of volumes to their mounters
+// on this node through rc, without remounting.
+type limitsManager struct {
+	r        *Rclone
+	reporter *volumeReporter
+	claims   *claimWatches
+
+	mu      sync.Mutex
+	applied map[string]appliedLimits
+}
+
+func newLimitsManager(r *Rclone, reporter *volumeReporter) *limitsManager {
+	m := &limitsManager{r: r, reporter: reporter, applied: map[string]appliedLimits{}}
+	m.claims = &claimWatches{
+		kubeClient: r.kubeClient,
+		watches:    map[types.NamespacedName]*claimWatch{},
+		handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldClaim, claim := oldObj.(*corev1.PersistentVolumeClaim), newObj.(*corev1.PersistentVolumeClaim)
+				if claim.Spec.VolumeName == "" || !limitsChanged(oldClaim.Annotations, claim.Annotations) {
+					return
+				}
+				pv, err := m.r.volumes.namedPersistentVolume(claim.Spec.VolumeName)
+				if err != nil {
+					klog.Errorf("applying limits of claim %s/%s: %v", claim.Namespace, claim.Name, err)
+					return
+				}
+				if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+					return
+				}
+				if err := m.apply(context.Background(), pv); err != nil {
+					klog.Errorf("applying limits of volume %s: %v", pv.Spec.CSI.VolumeHandle, err)
+				}
+			},
+		},
+	}
+	return m
+}
+
+// claimWatches keeps an informer per claim of the volumes with a mounter on
+// this node. Like secretWatches, each is limited to its claim by a field
+// selector, so no other claim is listed or watched.
+type claimWatches struct {
+	kubeClient kubernetes.Interface
+	handler    cache.ResourceEventHandler
+
+	mu      sync.Mutex
+	watches map[types.NamespacedName]*claimWatch
+}
+
+type claimWatch struct {
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+}
+
+// update watches the claims of refs and stops watching the others.
+func (w *claimWatches) update(refs map[types.NamespacedName]bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ref, watch := range w.watches {
+		if !refs[ref] {
+			close(watch.stop)
+			delete(w.watches, ref)
+		}
+	}
+	for ref := range refs {
+		if _, ok := w.watches[ref]; ok {
+			continue
+		}
+		name := ref.Name
+		informer := coreinformers.NewFilteredPersistentVolumeClaimInformer(w.kubeClient, ref.Namespace, 0, cache.Indexers{}, func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})
+		informer.AddEventHandler(w.handler)
+		watch := &claimWatch{informer: informer, stop: make(chan struct{})}
+		w.watches[ref] = watch
+		go informer.Run(watch.stop)
+	}
+}
+
+// get returns the claim namespace/name from its watch once synced, from the
+// API otherwise.
+func (w *claimWatches) get(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	w.mu.Lock()
+	watch, ok := w.watches[types.NamespacedName{Namespace: namespace, Name: name}]
+	w.mu.Unlock()
+	if ok && watch.informer.HasSynced() {
+		obj, exists, err := watch.informer.GetStore().GetByKey(namespace + "/" + name)
+		if err != nil || !exists {
+			return nil, k8serrors.NewNotFound(corev1.Resource("persistentvolumeclaims"), name)
+		}
+		return obj.(*corev1.PersistentVolumeClaim), nil
+	}
+	return w.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+}
+
+// watch applies the limits of the volumes with a mounter on this node until
+// stopCh is closed: once the volume cache is synced, then on changes of their
+// annotations on the PVs and the watched claims, and to each mounter pod
+// that starts. The claims watched follow the mounter Deployments and PVs in
+// the volume cache, which must be started.
+func (m *limitsManager) watch(stopCh <-chan struct{}) {
+	refresh := func() {
+		// Partial caches would stop the watches of volumes not seen yet.
+		if m.r.volumes.synced() {
+			m.claims.update(m.nodeClaimRefs())
+		}
+	}
+	m.r.volumes.deployments.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { refresh() },
+		UpdateFunc: func(interface{}, interface{}) { refresh() },
+		DeleteFunc: func(interface{}) { refresh() },
+	})
+	m.r.volumes.pvs.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { refresh() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			refresh()
+			oldPV, pv := oldObj.(*corev1.PersistentVolume), newObj.(*corev1.PersistentVolume)
+			if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName || !limitsChanged(oldPV.Annotations, pv.Annotations) {
+				return
+			}
+			if err := m.apply(context.Background(), pv); err != nil {
+				klog.Errorf("applying limits of volume %s: %v", pv.Spec.CSI.VolumeHandle, err)
+			}
+		},
+		DeleteFunc: func(interface{}) { refresh() },
+	})
+	// A restarted mounter starts without the limits, and a failed apply is
+	// retried when its pod changes.
+	m.r.volumes.pods.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, newObj interface{}) {
+			pod := newObj.(*corev1.Pod)
+			if pod.Status.Phase != corev1.PodRunning || !m.r.volumes.synced() {
+				return
+			}
+			if err := m.applyVolume(context.Background(), pod.Labels["volumeid"]); err != nil {
+				klog.Errorf("applying limits of volume %s: %v", pod.Labels["volumeid"], err)
+			}
+		},
+	})
+
+	if cache.WaitForCacheSync(stopCh, m.r.volumes.synced) {
+		refresh()
+		if err := m.sync(context.Background()); err != nil {
+			klog.Errorf("applying volume limits on node %s: %v", m.r.nodeID, err)
+		}
+	}
+	<-stopCh
+	m.claims.update(nil)
+}
+
+// nodeClaimRefs returns the claims of the volumes with a mounter on this
+// node, from the volume cache alone.
+func (m *limitsManager) nodeClaimRefs() map[types.NamespacedName]bool {
+	refs := map[types.NamespacedName]bool{}
+	deployments, err := m.r.volumes.nodeDeployments(m.r.nodeID)
+	if err != nil {
+		return refs
+	}
+	for _, deployment := range deployments {
+		pv := m.r.volumes.cachedPersistentVolume(deployment.Labels["volumeid"])
+		if pv != nil && pv.Spec.ClaimRef != nil {
+			refs[types.NamespacedName{Namespace: pv.Spec.ClaimRef.Namespace, Name: pv.Spec.ClaimRef.Name}] = true
+		}
+	}
+	return refs
+}
+
+// limitsChanged tells whether the limits annotations differ between two
+// versions of an object. Other updates, such as those of the status
+// annotations the nodes write, are ignored.
+func limitsChanged(a, b map[string]string) bool {
+	for _, key := range []string{bwLimitAnnotation, tpsLimitAnnotation, transfersAnnotation} {
+		if a[key] != b[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// sync applies the limits of every volume with a mounter on this node.
+func (m *limitsManager) sync(ctx context.Context) error {
+	deployments, err := m.r.volumes.nodeDeployments(m.r.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments {
+		if err := m.applyVolume(ctx, deployment.Labels["volumeid"]); err != nil {
+			klog.Errorf("applying limits of volume %s: %v", deployment.Labels["volumeid"], err)
+		}
+	}
+	return nil
+}
+
+// applyVolume applies the limits of the volume volumeId.
+func (m *limitsManager) applyVolume(ctx context.Context, volumeId string) error {
+	pv, err := m.r.volumes.persistentVolume(volumeId)
+	if err != nil {
+		return err
+	}
+	return m.apply(ctx, pv)
+}
+
+// volumeLimits reads the limits of pv and its claim.
+func (m *limitsManager) volumeLimits(pv *corev1.PersistentVolume) (volumeLimits, error) {
+	var claim *corev1.PersistentVolumeClaim
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		var err error
+		claim, err = m.claims.get(ref.Namespace, ref.Name)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return volumeLimits{}, err
+		}
+	}
+	return limitsFor(pv, claim)
+}
+
+// apply sets the limits of pv on its running mounter on this node, unless
+// they are already in effect there, and reports those in effect.
+func (m *limitsManager) apply(ctx context.Context, pv *corev1.PersistentVolume) error {
+	volumeId := pv.Spec.CSI.VolumeHandle
+	pod, err := m.nodeMounter(volumeId)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pod == nil {
+		delete(m.applied, volumeId)
+		return nil
+	}
+
+	limits, err := m.volumeLimits(pv)
+	want := limits.active()
+	if err != nil {
+		want = activeLimits{Message: err.Error()}
+	}
+	previous, known := m.applied[volumeId]
+	if !known || previous.pod != pod.UID {
+		// A new mounter starts with the limits of its command line.
+		previous = appliedLimits{pod: pod.UID}
+	}
+	if previous.limits == want {
+		return nil
+	}
+	if err != nil {
+		m.applied[volumeId] = appliedLimits{pod: pod.UID, limits: want}
+		m.reporter.limited(pv, want, err)
+		return nil
+	}
+
+	client, err := m.r.mounterClient(pod)
+	if err == nil {
+		err = setLimits(ctx, client, previous.limits, want)
+	}
+	if err != nil {
+		// Not recorded, the next event of the volume or its mounter tries
+		// again.
+		m.reporter.limited(pv, want, err)
+		return err
+	}
+	m.applied[volumeId] = appliedLimits{pod: pod.UID, limits: want}
+	if known || !want.empty() {
+		m.reporter.limited(pv, want, nil)
+	}
+	return nil
+}
+
+// setLimits changes the limits of a mounter from previous to want. Limits no
+// longer set return to the rclone defaults. rclone switches the slots of a
+// bandwidth timetable itself.
+func setLimits(ctx context.Context, client *rc.Client, previous, want activeLimits) error {
+	if want.BwLimit != previous.BwLimit {
+		rate := want.BwLimit
+		if rate == "" {
+			rate = "off"
+		}
+		if _, err := client.BwLimit(ctx, rate); err != nil {
+			return err
+		}
+	}
+	options := map[string]interface{}{}
+	if want.TPSLimit != previous.TPSLimit {
+		tps := 0.0
+		if want.TPSLimit != "" {
+			tps, _ = strconv.ParseFloat(want.TPSLimit, 64)
+		}
+		options["TPSLimit"] = tps
+	}
+	if want.Transfers != previous.Transfers {
+		transfers := defaultTransfers
+		if want.Transfers != "" {
+			transfers, _ = strconv.Atoi(want.Transfers)
+		}
+		options["Transfers"] = transfers
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return client.OptionsSet(ctx, map[string]map[string]interface{}{"main": options})
+}
+
+// nodeMounter returns the running mounter pod of volumeId if its Deployment
+// runs on this node, nil otherwise.
+func (m *limitsManager) nodeMounter(volumeId string) (*corev1.Pod, error) {
+	deployment, err := m.r.volumes.deployment((&RcloneVolume{ID: volumeId}).deploymentName())
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deployment.Spec.Template.Spec.NodeName != m.r.nodeID {
+		return nil, nil
+	}
+	pods, err := m.r.volumes.nodeMounterPods()
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if pod.Labels["volumeid"] == volumeId && pod.Status.Phase == corev1.PodRunning {
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,266 @@
+package rclone
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLimitsFor(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	pv.Annotations = map[string]string{bwLimitAnnotation: "10M", transfersAnnotation: "8"}
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{bwLimitAnnotation: "1M", tpsLimitAnnotation: "5"},
+	}}
+
+	limits, err := limitsFor(pv, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (volumeLimits{BwLimit: "1M", TPSLimit: "5", Transfers: "8"}); limits != want {
+		t.Errorf("expected %+v, got %+v", want, limits)
+	}
+
+	// rclone validates the bandwidth limit when it is set.
+	for key, value := range map[string]string{tpsLimitAnnotation: "-1", transfersAnnotation: "0"} {
+		claim.Annotations = map[string]string{key: value}
+		if _, err := limitsFor(pv, claim); err == nil {
+			t.Errorf("expected %s %q to be invalid", key, value)
+		}
+	}
+}
+
+// limitedMounter returns the mounter Deployment of vol-1 on this node.
+func limitedMounter() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-1", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-1"}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{NodeName: testNodeID, Containers: []corev1.Container{{Name: "rclone-mounter"}}},
+		}},
+	}
+}
+
+// limitedMounterPod returns the running pod of limitedMounter.
+func limitedMounterPod() *corev1.Pod {
+	pod := servingPod(true)
+	pod.Spec.NodeName = testNodeID
+	return pod
+}
+
+func TestApplyLimits(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	pv.Annotations = map[string]string{bwLimitAnnotation: "08:00,512k 18:00,10M", transfersAnnotation: "2"}
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", Annotations: map[string]string{tpsLimitAnnotation: "10"}},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+	}
+	td := newTestDriver(newFakeRclone(), pv, claim, limitedMounter(), mounterSecret("vol-1"), limitedMounterPod())
+	rc := newFakeRc(t, nil)
+	rc.password = testRcPass
+	td.ns.RcloneOps.(*Rclone).rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+	calls := func() []string {
+		defer rc.reset()
+		out := []string{}
+		for _, call := range rc.calls() {
+			out = append(out, call.String())
+		}
+		return out
+	}
+	m := td.ns.limits
+
+	status := func() map[string]activeLimits {
+		td.ns.reporter.statuses.wait()
+		pv, err := td.kubeClient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := map[string]activeLimits{}
+		if raw, ok := pv.Annotations[limitsStatusAnnotation]; ok {
+			if err := json.Unmarshal([]byte(raw), &statuses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return statuses
+	}
+
+	// The timetable is rclone's to follow.
+	if err := m.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`core/bwlimit {"rate":"08:00,512k 18:00,10M"}`,
+		`options/set {"main":{"TPSLimit":10,"Transfers":2}}`,
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rc calls %q, got %q", want, got)
+	}
+	if got := status()[testNodeID]; got.BwLimit != "08:00,512k 18:00,10M" || got.TPSLimit != "10" || got.Transfers != "2" {
+		t.Errorf("expected the applied limits in the status, got %+v", got)
+	}
+
+	// Nothing changed, and the mounter is never restarted.
+	td.kubeClient.ClearActions()
+	if err := m.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("expected no rc calls, got %q", got)
+	}
+	for _, action := range td.actions() {
+		if strings.HasPrefix(action, "update deployments") || strings.HasPrefix(action, "delete pods") {
+			t.Errorf("expected the mounter left running, got %q", action)
+		}
+	}
+
+	// The claim drops its limit.
+	claim.Annotations = nil
+	if _, err := td.kubeClient.CoreV1().PersistentVolumeClaims("default").Update(claim); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), []string{`options/set {"main":{"TPSLimit":0}}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rc calls %q, got %q", want, got)
+	}
+
+	// A restarted mounter starts without the limits.
+	if err := td.kubeClient.CoreV1().Pods(testNamespace).Delete(limitedMounterPod().Name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	restarted := limitedMounterPod()
+	restarted.UID = types.UID("uid-restarted")
+	if _, err := td.kubeClient.CoreV1().Pods(testNamespace).Create(restarted); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.applyVolume(context.Background(), "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		`core/bwlimit {"rate":"08:00,512k 18:00,10M"}`,
+		`options/set {"main":{"Transfers":2}}`,
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rc calls %q, got %q", want, got)
+	}
+
+	// All limits removed.
+	pv, _ = td.kubeClient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	pv.Annotations = nil
+	if err := m.apply(context.Background(), pv); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		`core/bwlimit {"rate":"off"}`,
+		`options/set {"main":{"Transfers":4}}`,
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rc calls %q, got %q", want, got)
+	}
+	if got, ok := status()[testNodeID]; ok {
+		t.Errorf("expected no limits status, got %+v", got)
+	}
+}
+
+func TestWatchLimits(t *testing.T) {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+	}
+	other := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-2"},
+	}
+	td := newTestDriver(newFakeRclone(), pv, claim, other, limitedMounter(), mounterSecret("vol-1"), limitedMounterPod())
+	rc := newFakeRc(t, nil)
+	rc.password = testRcPass
+	ops := td.ns.RcloneOps.(*Rclone)
+	ops.rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ops.volumes.start(true, stopCh)
+	go td.ns.limits.watch(stopCh)
+
+	// Only the claim of the volume on the node is watched.
+	claimWatches := func() []string {
+		watches := []string{}
+		for _, action := range td.kubeClient.Actions() {
+			if watch, ok := action.(k8stesting.WatchAction); ok && action.GetResource().Resource == "persistentvolumeclaims" {
+				watches = append(watches, action.GetNamespace()+" "+watch.GetWatchRestrictions().Fields.String())
+			}
+		}
+		return watches
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(claimWatches()) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected a watch of the claim: %v", err)
+	}
+	if want := []string{"default metadata.name=data"}; !reflect.DeepEqual(claimWatches(), want) {
+		t.Errorf("expected claim watches %q, got %q", want, claimWatches())
+	}
+
+	// Syncing reads the caches, not the API.
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		claims := td.ns.limits.claims
+		claims.mu.Lock()
+		defer claims.mu.Unlock()
+		watch, ok := claims.watches[types.NamespacedName{Namespace: "default", Name: "data"}]
+		return ok && watch.informer.HasSynced(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	td.kubeClient.ClearActions()
+	if err := td.ns.limits.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if actions := td.actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got %q", actions)
+	}
+
+	claim.Annotations = map[string]string{transfersAnnotation: "2"}
+	if _, err := td.kubeClient.CoreV1().PersistentVolumeClaims("default").Update(claim); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(rc.calls("options/set")) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the limits of the claim applied: %v", err)
+	}
+	if got, want := rc.calls("options/set")[0].String(), `options/set {"main":{"Transfers":2}}`; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// The replacement of a mounter gets the limits once it runs.
+	rc.reset()
+	if err := td.kubeClient.CoreV1().Pods(testNamespace).Delete(limitedMounterPod().Name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	restarted := limitedMounterPod()
+	restarted.UID = types.UID("uid-restarted")
+	restarted.Status.Phase = corev1.PodPending
+	if _, err := td.kubeClient.CoreV1().Pods(testNamespace).Create(restarted); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Status.Phase = corev1.PodRunning
+	if _, err := td.kubeClient.CoreV1().Pods(testNamespace).Update(restarted); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(rc.calls("options/set")) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the limits applied to the restarted mounter: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package rclone
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationLocks hands out non-blocking locks by key, so a concurrent
+// duplicate of a running operation fails fast with Aborted instead of racing
+// it on the same mounter Secret and Deployment. The CO retries later and then
+// gets the result of the finished operation.
+type operationLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func newOperationLocks() *operationLocks {
+	return &operationLocks{held: map[string]bool{}}
+}
+
+func volumeLockKey(volumeId string) string {
+	return "volume/" + volumeId
+}
+
+func targetLockKey(targetPath string) string {
+	return "target/" + targetPath
+}
+
+// TryAcquire takes all keys, or none of them when one is already held.
+func (l *operationLocks) TryAcquire(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if l.held[key] {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.held[key] = true
+	}
+	return true
+}
+
+func (l *operationLocks) Release(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.held, key)
+	}
+}
+
+// acquire is TryAcquire returning the Aborted error the CSI spec asks for
+// when an operation on the same volume is pending.
+func (l *operationLocks) acquire(volumeId string, keys ...string) error {
+	if !l.TryAcquire(keys...) {
+		return status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeId)
+	}
+	return nil
+}
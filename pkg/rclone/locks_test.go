@@ -0,0 +1,93 @@
+package rclone
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLocks(t *testing.T) {
+	l := newOperationLocks()
+	if !l.TryAcquire("a", "b") {
+		t.Fatal("expected free keys to be acquired")
+	}
+	if l.TryAcquire("b", "c") {
+		t.Fatal("expected a held key to block the acquire")
+	}
+	if !l.TryAcquire("c") {
+		t.Fatal("expected a failed acquire to take no keys")
+	}
+	l.Release("a", "b")
+	if !l.TryAcquire("a", "b") {
+		t.Fatal("expected released keys to be acquired again")
+	}
+}
+
+func TestConcurrentOperationsAborted(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	tests := []struct {
+		name string
+		held string
+		call func(td *testDriver) error
+	}{
+		{
+			name: "publish of a volume being published",
+			held: volumeLockKey("vol-1"),
+			call: func(td *testDriver) error {
+				_, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(target))
+				return err
+			},
+		},
+		{
+			name: "unpublish of a target being published",
+			held: targetLockKey(target),
+			call: func(td *testDriver) error {
+				_, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-2", TargetPath: target})
+				return err
+			},
+		},
+		{
+			name: "create of a volume being deleted",
+			held: volumeLockKey(volumeIdFor("pvc-1")),
+			call: func(td *testDriver) error {
+				_, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "pvc-1",
+					VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+					Parameters:         map[string]string{"remote": "minio", "path": "base"},
+					Secrets:            testSecrets,
+				})
+				return err
+			},
+		},
+		{
+			name: "delete of a volume being deleted",
+			held: volumeLockKey("vol-1"),
+			call: func(td *testDriver) error {
+				_, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1", Secrets: testSecrets})
+				return err
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone())
+			td.cs.locks.TryAcquire(tc.held)
+
+			if code := status.Code(tc.call(td)); code != codes.Aborted {
+				t.Fatalf("expected code %v, got %v", codes.Aborted, code)
+			}
+			if len(td.kubeClient.Actions()) != 0 {
+				t.Errorf("expected no API calls while aborted, got %v", td.actions())
+			}
+			td.cs.locks.Release(tc.held)
+			if !td.cs.locks.TryAcquire(tc.held) {
+				t.Errorf("expected the aborted call to leave the lock alone")
+			}
+		})
+	}
+}
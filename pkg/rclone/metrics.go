@@ -0,0 +1,333 @@
+package rclone
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "csi_rclone"
+
+// otherVolumesLabel collects the stats of every volume beyond the per-volume
+// series limit so the label cardinality stays bounded.
+const otherVolumesLabel = "_other"
+
+var (
+	rpcTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_total",
+		Help:      "Number of CSI RPCs handled, by method and gRPC status code.",
+	}, []string{"method", "code"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of CSI RPCs, by method and gRPC status code.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "code"})
+
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Time taken to mount or unmount a volume, by operation.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"operation"})
+
+	mountFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "Number of failed mount or unmount operations, by operation and reason.",
+	}, []string{"operation", "reason"})
+
+	prewarmRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prewarm_total",
+		Help:      "Number of finished cache pre-warms, by result.",
+	}, []string{"result"})
+
+	prewarmActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prewarm_in_progress",
+		Help:      "Number of cache pre-warms running.",
+	})
+
+	prewarmFilesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prewarm_read_files_total",
+		Help:      "Files read into VFS caches by pre-warms.",
+	})
+
+	prewarmBytesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prewarm_read_bytes_total",
+		Help:      "Bytes read into VFS caches by pre-warms.",
+	})
+
+	staleMounts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_mounts_total",
+		Help:      "Number of published targets found with a stale mount.",
+	})
+
+	mountRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_repairs_total",
+		Help:      "Number of repairs of stale mounts, by result.",
+	}, []string{"result"})
+)
+
+// metricsInterceptor records the count and latency of every CSI RPC.
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	method := path.Base(info.FullMethod)
+	code := status.Code(err).String()
+	rpcTotal.WithLabelValues(method, code).Inc()
+	rpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// observeMountOperation records the duration of a mount or unmount and, when
+// it failed, a bounded failure reason.
+func observeMountOperation(operation string, start time.Time, err error) {
+	mountDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		mountFailures.WithLabelValues(operation, failureReason(err)).Inc()
+	}
+}
+
+// observePrewarm records the result of a finished pre-warm.
+func observePrewarm(err error) {
+	switch {
+	case err == nil:
+		prewarmRuns.WithLabelValues("success").Inc()
+	case errors.Is(err, context.Canceled):
+		prewarmRuns.WithLabelValues("cancelled").Inc()
+	default:
+		prewarmRuns.WithLabelValues("failed").Inc()
+	}
+}
+
+// observeMountRepair records the duration and result of a stale mount
+// repair.
+func observeMountRepair(start time.Time, err error) {
+	observeMountOperation("repair", start, err)
+	if err != nil {
+		mountRepairs.WithLabelValues("failed").Inc()
+		return
+	}
+	mountRepairs.WithLabelValues("success").Inc()
+}
+
+func failureReason(err error) string {
+	if reason := k8serrors.ReasonForError(err); reason != metav1.StatusReasonUnknown {
+		return string(reason)
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code().String()
+	}
+	return "Unknown"
+}
+
+type volumeMetric struct {
+	desc  *prometheus.Desc
+	value func(*volumeStats) float64
+}
+
+type volumeStats struct {
+	up   float64
+	core rc.CoreStats
+	vfs  rc.VfsStats
+}
+
+func newVolumeDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "volume", name), help, []string{"volume_id"}, nil)
+}
+
+func diskCacheValue(f func(*volumeStats) float64) func(*volumeStats) float64 {
+	return func(s *volumeStats) float64 {
+		if s.vfs.DiskCache == nil {
+			return 0
+		}
+		return f(s)
+	}
+}
+
+var volumeMetrics = []volumeMetric{
+	{newVolumeDesc("mounter_up", "Whether the mounter rc API answered the last scrape."),
+		func(s *volumeStats) float64 { return s.up }},
+	{newVolumeDesc("transferred_bytes", "Bytes transferred by the mounter since it started."),
+		func(s *volumeStats) float64 { return s.core.Bytes }},
+	{newVolumeDesc("transfers", "Completed transfers since the mounter started."),
+		func(s *volumeStats) float64 { return s.core.Transfers }},
+	{newVolumeDesc("checks", "Completed checks since the mounter started."),
+		func(s *volumeStats) float64 { return s.core.Checks }},
+	{newVolumeDesc("errors", "Errors reported by the mounter since it started."),
+		func(s *volumeStats) float64 { return s.core.Errors }},
+	{newVolumeDesc("speed_bytes", "Current transfer speed of the mounter in bytes per second."),
+		func(s *volumeStats) float64 { return s.core.Speed }},
+	{newVolumeDesc("vfs_cache_bytes", "Bytes used by the VFS disk cache."),
+		diskCacheValue(func(s *volumeStats) float64 { return s.vfs.DiskCache.BytesUsed })},
+	{newVolumeDesc("vfs_cache_files", "Files held in the VFS disk cache."),
+		diskCacheValue(func(s *volumeStats) float64 { return s.vfs.DiskCache.Files })},
+	{newVolumeDesc("vfs_cache_errored_files", "Files in the VFS disk cache that failed to upload."),
+		diskCacheValue(func(s *volumeStats) float64 { return s.vfs.DiskCache.ErroredFiles })},
+	{newVolumeDesc("vfs_uploads_in_progress", "VFS write-back uploads currently in progress."),
+		diskCacheValue(func(s *volumeStats) float64 { return s.vfs.DiskCache.UploadsInProgress })},
+	{newVolumeDesc("vfs_uploads_queued", "VFS write-back uploads waiting to start."),
+		diskCacheValue(func(s *volumeStats) float64 { return s.vfs.DiskCache.UploadsQueued })},
+}
+
+// mounterStatsCollector scrapes core/stats and vfs/stats from the rc API of
+// every mounter running on this node, found in the volume cache. Only the
+// first maxVolumes volumes (by ID) get their own series, the rest are summed
+// under otherVolumesLabel.
+type mounterStatsCollector struct {
+	volumes    *volumeCache
+	maxVolumes int
+	// client returns an rc client of a mounter pod.
+	client func(pod *corev1.Pod) (*rc.Client, error)
+}
+
+func (c *mounterStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range volumeMetrics {
+		ch <- m.desc
+	}
+}
+
+func (c *mounterStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	pods, err := c.volumes.nodeMounterPods()
+	if err != nil {
+		klog.Warningf("metrics: listing mounter pods failed: %v", err)
+		return
+	}
+
+	// The pods are shared with the cache and only read.
+	running := []*corev1.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning {
+			running = append(running, pod)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Labels["volumeid"] < running[j].Labels["volumeid"]
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats := make([]volumeStats, len(running))
+	var wg sync.WaitGroup
+	for i := range running {
+		wg.Add(1)
+		go func(pod *corev1.Pod, s *volumeStats) {
+			defer wg.Done()
+			*s = c.scrape(ctx, pod)
+		}(running[i], &stats[i])
+	}
+	wg.Wait()
+
+	byLabel := map[string]*volumeStats{}
+	for i, pod := range running {
+		label := pod.Labels["volumeid"]
+		if i >= c.maxVolumes {
+			label = otherVolumesLabel
+		}
+		acc, ok := byLabel[label]
+		if !ok {
+			acc = &volumeStats{}
+			byLabel[label] = acc
+		}
+		acc.add(&stats[i])
+	}
+
+	for label, s := range byLabel {
+		for _, m := range volumeMetrics {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, m.value(s), label)
+		}
+	}
+}
+
+func (c *mounterStatsCollector) scrape(ctx context.Context, pod *corev1.Pod) volumeStats {
+	s := volumeStats{}
+	client, err := c.client(pod)
+	if err != nil {
+		klog.V(4).Infof("metrics: no rc client for %s: %v", pod.Name, err)
+		return s
+	}
+	core, err := client.CoreStats(ctx)
+	if err != nil {
+		klog.V(4).Infof("metrics: core/stats on %s failed: %v", pod.Name, err)
+		return s
+	}
+	s.core = *core
+	if vfs, err := client.VfsStats(ctx, ""); err != nil {
+		klog.V(4).Infof("metrics: vfs/stats on %s failed: %v", pod.Name, err)
+	} else {
+		s.vfs = *vfs
+	}
+	s.up = 1
+	return s
+}
+
+func (s *volumeStats) add(o *volumeStats) {
+	s.up += o.up
+	s.core.Bytes += o.core.Bytes
+	s.core.Errors += o.core.Errors
+	s.core.Transfers += o.core.Transfers
+	s.core.Checks += o.core.Checks
+	s.core.Speed += o.core.Speed
+	if o.vfs.DiskCache == nil {
+		return
+	}
+	if s.vfs.DiskCache == nil {
+		copied := *o.vfs.DiskCache
+		s.vfs.DiskCache = &copied
+		return
+	}
+	s.vfs.DiskCache.BytesUsed += o.vfs.DiskCache.BytesUsed
+	s.vfs.DiskCache.Files += o.vfs.DiskCache.Files
+	s.vfs.DiskCache.ErroredFiles += o.vfs.DiskCache.ErroredFiles
+	s.vfs.DiskCache.UploadsInProgress += o.vfs.DiskCache.UploadsInProgress
+	s.vfs.DiskCache.UploadsQueued += o.vfs.DiskCache.UploadsQueued
+}
+
+// ServeMetrics exposes the driver metrics on addr under /metrics. It blocks
+// until the HTTP server fails.
+func (d *Driver) ServeMetrics(addr string, maxVolumes int) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		rpcTotal, rpcDuration, mountDuration, mountFailures,
+		prewarmRuns, prewarmActive, prewarmFilesRead, prewarmBytesRead,
+		staleMounts, mountRepairs,
+	)
+	if r, ok := d.rcloneOps.(*Rclone); ok && d.mode.node() {
+		registry.MustRegister(&mounterStatsCollector{
+			volumes:    r.volumes,
+			maxVolumes: maxVolumes,
+			client:     r.mounterClient,
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	klog.Infof("Serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
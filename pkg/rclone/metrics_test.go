@@ -0,0 +1,128 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestMetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	failed := rpcTotal.WithLabelValues("NodePublishVolume", codes.NotFound.String())
+	succeeded := rpcTotal.WithLabelValues("NodePublishVolume", codes.OK.String())
+	failedBefore, succeededBefore := testutil.ToFloat64(failed), testutil.ToFloat64(succeeded)
+
+	notFound := status.Error(codes.NotFound, "volume not found")
+	_, err := metricsInterceptor(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		return nil, notFound
+	})
+	if err != notFound {
+		t.Errorf("expected the handler error returned, got %v", err)
+	}
+	resp, err := metricsInterceptor(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		return "published", nil
+	})
+	if err != nil || resp != "published" {
+		t.Errorf("expected the handler response returned, got %v, %v", resp, err)
+	}
+
+	if got := testutil.ToFloat64(failed) - failedBefore; got != 1 {
+		t.Errorf("expected one failed RPC counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(succeeded) - succeededBefore; got != 1 {
+		t.Errorf("expected one successful RPC counted, got %v", got)
+	}
+}
+
+func TestMounterStatsCollector(t *testing.T) {
+	mounterPod := func(volumeId, nodeID string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-" + volumeId, Namespace: testNamespace, Labels: map[string]string{"volumeid": volumeId}},
+			Spec:       corev1.PodSpec{NodeName: nodeID},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+	td := newTestDriver(newFakeRclone(),
+		mounterPod("vol-a", testNodeID, corev1.PodRunning),
+		mounterPod("vol-b", testNodeID, corev1.PodRunning),
+		mounterPod("vol-c", testNodeID, corev1.PodRunning),
+		mounterPod("vol-d", testNodeID, corev1.PodRunning),
+		mounterPod("vol-e", testNodeID, corev1.PodPending),
+		mounterPod("vol-f", "other-node", corev1.PodRunning),
+	)
+	ops := td.ns.RcloneOps.(*Rclone)
+
+	stats := func(bytes, queued float64) map[string]fakeRcHandler {
+		return map[string]fakeRcHandler{
+			"core/stats": func(map[string]interface{}) (interface{}, error) {
+				return rc.CoreStats{Bytes: bytes}, nil
+			},
+			"vfs/stats": func(map[string]interface{}) (interface{}, error) {
+				return rc.VfsStats{DiskCache: &rc.DiskCacheStats{UploadsQueued: queued}}, nil
+			},
+		}
+	}
+	servers := map[string]*fakeRc{
+		"vol-a": newFakeRc(t, stats(100, 1)),
+		"vol-b": newFakeRc(t, stats(200, 0)),
+		"vol-c": newFakeRc(t, stats(300, 2)),
+		"vol-e": newFakeRc(t, stats(400, 4)),
+		"vol-f": newFakeRc(t, stats(500, 8)),
+	}
+	collector := &mounterStatsCollector{
+		volumes:    ops.volumes,
+		maxVolumes: 2,
+		client: func(pod *corev1.Pod) (*rc.Client, error) {
+			server, ok := servers[pod.Labels["volumeid"]]
+			if !ok {
+				return nil, errors.New("no rc")
+			}
+			return rc.New(server.addr), nil
+		},
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ops.volumes.start(true, stopCh)
+	if !cache.WaitForCacheSync(stopCh, ops.volumes.synced) {
+		t.Fatal("volume cache not synced")
+	}
+	td.kubeClient.ClearActions()
+
+	// vol-c and vol-d, whose rc does not answer, are beyond the cap. Pending
+	// mounters and those of other nodes are not scraped.
+	want := `
+# HELP csi_rclone_volume_mounter_up Whether the mounter rc API answered the last scrape.
+# TYPE csi_rclone_volume_mounter_up gauge
+csi_rclone_volume_mounter_up{volume_id="_other"} 1
+csi_rclone_volume_mounter_up{volume_id="vol-a"} 1
+csi_rclone_volume_mounter_up{volume_id="vol-b"} 1
+# HELP csi_rclone_volume_transferred_bytes Bytes transferred by the mounter since it started.
+# TYPE csi_rclone_volume_transferred_bytes gauge
+csi_rclone_volume_transferred_bytes{volume_id="_other"} 300
+csi_rclone_volume_transferred_bytes{volume_id="vol-a"} 100
+csi_rclone_volume_transferred_bytes{volume_id="vol-b"} 200
+# HELP csi_rclone_volume_vfs_uploads_queued VFS write-back uploads waiting to start.
+# TYPE csi_rclone_volume_vfs_uploads_queued gauge
+csi_rclone_volume_vfs_uploads_queued{volume_id="_other"} 2
+csi_rclone_volume_vfs_uploads_queued{volume_id="vol-a"} 1
+csi_rclone_volume_vfs_uploads_queued{volume_id="vol-b"} 0
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(want),
+		"csi_rclone_volume_mounter_up", "csi_rclone_volume_transferred_bytes", "csi_rclone_volume_vfs_uploads_queued"); err != nil {
+		t.Error(err)
+	}
+	if actions := td.actions(); len(actions) != 0 {
+		t.Errorf("expected the mounter pods read from the cache, got actions %v", actions)
+	}
+}
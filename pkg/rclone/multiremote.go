@@ -0,0 +1,189 @@
+package rclone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parameters of volumes spanning several remotes. Members are separated by
+// commas, each is remote:path with an optional :ro suffix, and combine
+// members are prefixed with the directory they appear as, dir=remote:path.
+const (
+	unionKey       = "union"
+	combineKey     = "combine"
+	unionPolicyKey = "unionPolicy"
+)
+
+// multiRemoteName is the remote synthesized into the config of a volume
+// spanning several remotes.
+const multiRemoteName = "csi-rclone-volume"
+
+type remoteMember struct {
+	// Dir is the directory of the member in a combine remote.
+	Dir      string
+	Remote   string
+	Path     string
+	ReadOnly bool
+}
+
+// multiRemote is an rclone union or combine of remote members.
+type multiRemote struct {
+	Type    string
+	Policy  string
+	Members []remoteMember
+}
+
+// parseMultiRemote reads a union or combine from volume attributes, nil when
+// the volume has a single remote.
+func parseMultiRemote(attributes map[string]string) (*multiRemote, error) {
+	union, isUnion := attributes[unionKey]
+	combine, isCombine := attributes[combineKey]
+	switch {
+	case isUnion && isCombine:
+		return nil, fmt.Errorf("%s and %s cannot be used together", unionKey, combineKey)
+	case isUnion:
+		m := &multiRemote{Type: unionKey, Policy: attributes[unionPolicyKey]}
+		return m, m.parseMembers(union)
+	case isCombine:
+		if _, ok := attributes[unionPolicyKey]; ok {
+			return nil, fmt.Errorf("%s only applies to %s", unionPolicyKey, unionKey)
+		}
+		m := &multiRemote{Type: combineKey}
+		return m, m.parseMembers(combine)
+	}
+	return nil, nil
+}
+
+func (m *multiRemote) parseMembers(value string) error {
+	dirs := map[string]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		member := remoteMember{}
+		if m.Type == combineKey {
+			i := strings.Index(field, "=")
+			if i <= 0 {
+				return fmt.Errorf("invalid %s member %q, expected dir=remote:path", m.Type, field)
+			}
+			member.Dir, field = field[:i], field[i+1:]
+			if dirs[member.Dir] || strings.ContainsAny(member.Dir, "/ ") {
+				return fmt.Errorf("invalid %s directory %q", m.Type, member.Dir)
+			}
+			dirs[member.Dir] = true
+		}
+		if strings.HasSuffix(field, ":ro") {
+			member.ReadOnly = true
+			field = strings.TrimSuffix(field, ":ro")
+		}
+		i := strings.Index(field, ":")
+		if i <= 0 {
+			return fmt.Errorf("invalid %s member %q, expected remote:path", m.Type, field)
+		}
+		member.Remote, member.Path = field[:i], strings.Trim(field[i+1:], "/")
+		if member.Remote == multiRemoteName {
+			return fmt.Errorf("%s member cannot be %s itself", m.Type, multiRemoteName)
+		}
+		m.Members = append(m.Members, member)
+	}
+	if len(m.Members) == 0 {
+		return fmt.Errorf("%s needs at least one member", m.Type)
+	}
+	return nil
+}
+
+// forVolume returns m with the writable members pointing at the directory of
+// volumeName, where CreateVolume creates it. Read-only members are shared.
+func (m *multiRemote) forVolume(volumeName string) *multiRemote {
+	out := &multiRemote{Type: m.Type, Policy: m.Policy}
+	for _, member := range m.Members {
+		if !member.ReadOnly {
+			member.Path = strings.TrimPrefix(member.Path+"/"+volumeName, "/")
+		}
+		out.Members = append(out.Members, member)
+	}
+	return out
+}
+
+// writable returns the members CreateVolume and DeleteVolume act on.
+func (m *multiRemote) writable() []remoteMember {
+	out := []remoteMember{}
+	for _, member := range m.Members {
+		if !member.ReadOnly {
+			out = append(out, member)
+		}
+	}
+	return out
+}
+
+// String returns m in the attribute format parseMultiRemote reads.
+func (m *multiRemote) String() string {
+	fields := []string{}
+	for _, member := range m.Members {
+		field := member.Remote + ":" + member.Path
+		if member.Dir != "" {
+			field = member.Dir + "=" + field
+		}
+		if member.ReadOnly {
+			field += ":ro"
+		}
+		fields = append(fields, field)
+	}
+	return strings.Join(fields, ",")
+}
+
+// attributes returns the volume attributes describing m.
+func (m *multiRemote) attributes() map[string]string {
+	attributes := map[string]string{m.Type: m.String()}
+	if m.Policy != "" {
+		attributes[unionPolicyKey] = m.Policy
+	}
+	return attributes
+}
+
+// volumeConfig returns the rclone config a volume is mounted with, the
+// rclone.conf of its secret and the section of multi, if the volume spans
+// several remotes.
+func volumeConfig(rcloneConfData string, multi *multiRemote) string {
+	if multi == nil {
+		return rcloneConfData
+	}
+	return rcloneConfData + multi.configSection()
+}
+
+// volumeRemotes returns the remotes a volume with attributes reads and
+// writes through.
+func volumeRemotes(attributes map[string]string, multi *multiRemote) []string {
+	if multi == nil {
+		return []string{attributes["remote"]}
+	}
+	remotes := []string{multiRemoteName}
+	for _, member := range multi.Members {
+		remotes = append(remotes, member.Remote)
+	}
+	return remotes
+}
+
+// configSection returns the rclone config section of the synthesized remote.
+func (m *multiRemote) configSection() string {
+	upstreams := []string{}
+	for _, member := range m.Members {
+		upstream := member.Remote + ":" + member.Path
+		switch {
+		case m.Type == combineKey:
+			upstream = member.Dir + "=" + upstream
+		case member.ReadOnly:
+			upstream += ":ro"
+		}
+		if strings.Contains(upstream, " ") {
+			upstream = `"` + upstream + `"`
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	section := fmt.Sprintf("\n[%s]\ntype = %s\nupstreams = %s\n", multiRemoteName, m.Type, strings.Join(upstreams, " "))
+	if m.Policy != "" {
+		section += fmt.Sprintf("create_policy = %s\n", m.Policy)
+	}
+	return section
+}
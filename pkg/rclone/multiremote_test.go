@@ -0,0 +1,139 @@
+package rclone
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseMultiRemote(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       *multiRemote
+		wantErr    bool
+	}{
+		{
+			name:       "single remote",
+			attributes: map[string]string{"remote": "minio", "path": "base"},
+		},
+		{
+			name:       "union",
+			attributes: map[string]string{unionKey: "ref:datasets/v1:ro, scratch:team-a/", unionPolicyKey: "ff"},
+			want: &multiRemote{Type: unionKey, Policy: "ff", Members: []remoteMember{
+				{Remote: "ref", Path: "datasets/v1", ReadOnly: true},
+				{Remote: "scratch", Path: "team-a"},
+			}},
+		},
+		{
+			name:       "combine",
+			attributes: map[string]string{combineKey: "images=minio:images:ro,logs=gcs:logs"},
+			want: &multiRemote{Type: combineKey, Members: []remoteMember{
+				{Dir: "images", Remote: "minio", Path: "images", ReadOnly: true},
+				{Dir: "logs", Remote: "gcs", Path: "logs"},
+			}},
+		},
+		{name: "union and combine", attributes: map[string]string{unionKey: "a:x", combineKey: "b=b:y"}, wantErr: true},
+		{name: "member without remote", attributes: map[string]string{unionKey: "datasets"}, wantErr: true},
+		{name: "combine without dir", attributes: map[string]string{combineKey: "minio:images"}, wantErr: true},
+		{name: "duplicate combine dir", attributes: map[string]string{combineKey: "a=minio:x,a=gcs:y"}, wantErr: true},
+		{name: "no members", attributes: map[string]string{unionKey: " , "}, wantErr: true},
+		{name: "policy on combine", attributes: map[string]string{combineKey: "a=minio:x", unionPolicyKey: "ff"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMultiRemote(tc.attributes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMultiRemoteVolume(t *testing.T) {
+	m, err := parseMultiRemote(map[string]string{unionKey: "ref:datasets/v1:ro,scratch:team a", unionPolicyKey: "ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := m.forVolume("pvc-1")
+	if got, want := volume.String(), "ref:datasets/v1:ro,scratch:team a/pvc-1"; got != want {
+		t.Errorf("expected members %q, got %q", want, got)
+	}
+	want := "\n[csi-rclone-volume]\ntype = union\nupstreams = ref:datasets/v1:ro \"scratch:team a/pvc-1\"\ncreate_policy = ff\n"
+	if got := volume.configSection(); got != want {
+		t.Errorf("expected config section %q, got %q", want, got)
+	}
+	reparsed, err := parseMultiRemote(volume.attributes())
+	if err != nil || !reflect.DeepEqual(reparsed, volume) {
+		t.Errorf("expected attributes to parse back to %+v, got %+v (%v)", volume, reparsed, err)
+	}
+}
+
+func TestMultiRemoteCreateDeleteVolume(t *testing.T) {
+	td := newTestDriver(newFakeRclone(rcloneResult{}, rcloneResult{}, rcloneResult{}, rcloneResult{}))
+	resp, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{testVolumeCapability},
+		Parameters:         map[string]string{unionKey: "minio:datasets:ro,minio:scratch,drive:scratch", preflightKey: "false"},
+		Secrets:            testSecrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContext := map[string]string{"remote": multiRemoteName, "path": "", unionKey: "minio:datasets:ro,minio:scratch/pvc-1,drive:scratch/pvc-1"}
+	if ctx := resp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(ctx, wantContext) {
+		t.Errorf("expected volume context %v, got %v", wantContext, ctx)
+	}
+
+	pv := testPV("pv-1", resp.GetVolume().GetVolumeId(), multiRemoteName, "")
+	pv.Spec.CSI.VolumeAttributes = resp.GetVolume().GetVolumeContext()
+	if _, err := td.kubeClient.CoreV1().PersistentVolumes().Create(pv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := td.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId(), Secrets: testSecrets}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, call := range td.rclone.calls {
+		got = append(got, strings.Join(call[1:3], " "))
+	}
+	want := []string{"mkdir minio:scratch/pvc-1", "mkdir drive:scratch/pvc-1", "rmdirs minio:scratch/pvc-1", "rmdirs drive:scratch/pvc-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rclone to act on the writable members %v, got %v", want, got)
+	}
+}
+
+func TestMultiRemotePublish(t *testing.T) {
+	td := newTestDriver(newFakeRclone())
+	req := testPublishRequest(filepath.Join(t.TempDir(), "target"))
+	req.VolumeContext = map[string]string{combineKey: "images=minio:images:ro,scratch=minio:scratch/pvc-1"}
+
+	if _, err := td.ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	secret, err := td.kubeClient.CoreV1().Secrets(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := secret.StringData["rclone.conf"]
+	if !strings.HasPrefix(conf, testRcloneConf) || !strings.Contains(conf, "[csi-rclone-volume]\ntype = combine\nupstreams = images=minio:images scratch=minio:scratch/pvc-1\n") {
+		t.Errorf("expected the combine remote in the mounter config, got %q", conf)
+	}
+	deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deployment.Spec.Template.Spec.Containers[0].Args[1]; got != "csi-rclone-volume:/" {
+		t.Errorf("expected the synthesized remote to be mounted, got %s", got)
+	}
+}
@@ -2,6 +2,7 @@ package rclone
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume/util"
 
@@ -21,8 +23,31 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
-	mounter   *mount.SafeFormatAndMount
-	RcloneOps Operations
+	mounter      *mount.SafeFormatAndMount
+	RcloneOps    Operations
+	reporter     *volumeReporter
+	kubeClient   kubernetes.Interface
+	nodeID       string
+	topologyKeys []string
+	state        *nodeState
+	locks        *operationLocks
+	syncer       *syncManager
+	// serveOps serve volumes of the nfs and webdav mount types.
+	serveOps  map[string]Operations
+	prewarmer *prewarmer
+	// limits applies volume limits to new mounters, nil without mounter
+	// Deployments.
+	limits   *limitsManager
+	watchdog *mountWatchdog
+}
+
+// mounterLogLines is how much of the mounter output is attached to mount errors.
+const mounterLogLines = 20
+
+// targetUnmounter is implemented by Operations whose publish targets of a
+// volume share one mount, which outlives all but the last target.
+type targetUnmounter interface {
+	UnmountTarget(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error
 }
 
 type mountPoint struct {
@@ -31,36 +56,72 @@ type mountPoint struct {
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.Infof("NodePublishVolume: called with args %+v", *req)
 	if err := validatePublishVolumeRequest(req); err != nil {
 		return nil, err
 	}
 
 	targetPath := req.GetTargetPath()
 	volumeId := req.GetVolumeId()
+	// Pods sharing the volume share its mounter, so publishes of one volume
+	// are serialized as well as those of one target.
+	lockKeys := []string{volumeLockKey(volumeId), targetLockKey(targetPath)}
+	if err := ns.locks.acquire(volumeId, lockKeys...); err != nil {
+		return nil, err
+	}
+	defer ns.locks.Release(lockKeys...)
+
 	rcloneConfData, ok := req.GetSecrets()["rclone.conf"]
 	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume:missing rclone.conf key, did you set csi.storage.k8s.io/node-publish-secret-name?")
 	}
+	redactor.setVolume(volumeId, rcloneConfData)
 
+	multi, err := parseMultiRemote(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
 	remote, ok := req.GetVolumeContext()["remote"]
+	remotePath, hasPath := req.GetVolumeContext()["path"]
+	if multi != nil {
+		// Mount the union or combine of the members, synthesized into the
+		// config next to the remotes it spans.
+		remote, ok, hasPath = multiRemoteName, true, true
+	}
+	rcloneConfData = volumeConfig(rcloneConfData, multi)
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: remote key not found in parameters")
 	}
-	remotePath, ok := req.GetVolumeContext()["path"]
-	if !ok {
+	if !hasPath {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: path key not found in parameters")
 	}
+	mode, err := volumeMode(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	mountType, err := volumeMountType(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	prewarm, err := parsePrewarmOptions(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	ops := ns.RcloneOps
+	if mountType != mountTypeFuse && mode != volumeModeSync {
+		if ops = ns.serveOps[mountType]; ops == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "NodePublishVolume: %s %s needs the deployment mounter", mountTypeKey, mountType)
+		}
+	}
 
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+				return nil, statusError(err, codes.Internal)
 			}
 			notMnt = true
 		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, statusError(err, codes.Internal)
 		}
 	}
 
@@ -68,9 +129,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		// testing original mount point, make sure the mount link is valid
 		if _, err := ioutil.ReadDir(targetPath); err == nil {
 			klog.Infof("already mounted to target %s", targetPath)
+			if prewarm != nil && prewarm.Wait {
+				// A retry of a publish that timed out waiting.
+				if err := ns.prewarmer.wait(ctx, targetPath); err != nil {
+					return nil, statusError(err, codes.DeadlineExceeded)
+				}
+			}
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
-		// todo: mount link is invalid, now unmount and remount later (built-in functionality)
+		// The mount is stale, it is mounted again below. Published targets
+		// going stale later are repaired by the mount watchdog.
 		klog.Warningf("ReadDir %s failed with %v, unmount this directory", targetPath, err)
 
 		if err := ns.mounter.Unmount(targetPath); err != nil {
@@ -79,45 +147,101 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
-	var mountArgs map[string]string
+	// The endpoint of the zone applies to sync mode copies as well.
+	endpointFlags := map[string]string{}
+	if endpoints, ok := req.GetVolumeContext()[topologyEndpointsKey]; ok {
+		flag := req.GetVolumeContext()[endpointFlagKey]
+		if endpoint, err := ns.topologyEndpoint(endpoints); err != nil {
+			klog.Warningf("using the configured endpoint of remote %s: %v", remote, err)
+		} else {
+			endpointFlags[flag] = endpoint
+		}
+	}
+
+	if mode == volumeModeSync {
+		return ns.publishSync(ctx, req, remote, remotePath, rcloneConfData, endpointFlags)
+	}
+
+	mountArgs := map[string]string{}
 	for k, v := range req.GetVolumeContext() {
 		if strings.HasPrefix(k, "mount/") {
 			mountKey := k[6:]
 			mountArgs[mountKey] = v
 		}
 	}
+	for k, v := range endpointFlags {
+		mountArgs[k] = v
+	}
+
+	cache, err := parseCacheOptions(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
 
 	rcloneVol := &RcloneVolume{
 		ID:         volumeId,
 		Remote:     remote,
 		RemotePath: remotePath,
+		Cache:      cache,
 	}
-	err = ns.RcloneOps.Mount(ctx, rcloneVol, targetPath, rcloneConfData, mountArgs)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	start := time.Now()
+	err = ops.Mount(ctx, rcloneVol, targetPath, rcloneConfData, mountArgs)
+	if err == nil {
+		if err = ns.waitForMount(ctx, ops, rcloneVol, targetPath); err != nil {
+			if logs, logErr := ops.MounterLogs(ctx, rcloneVol, mounterLogLines); logErr == nil && logs != "" {
+				err = fmt.Errorf("%w, mounter output: %s", err, logs)
+			}
+		}
 	}
-
-	err = ns.WaitForMountAvailable(targetPath)
+	observeMountOperation("mount", start, err)
+	ns.reporter.mounted(volumeId, targetPath, req.GetVolumeContext(), err)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err, codes.Internal)
+	}
+	ns.state.add(publishedVolume{VolumeID: volumeId, TargetPath: targetPath, Remote: remote, RemotePath: remotePath, MountType: mountType})
+	if ns.limits != nil {
+		// Best effort, the periodic sync retries.
+		if err := ns.limits.applyVolume(ctx, volumeId); err != nil {
+			klog.Warningf("applying limits of volume %s: %v", volumeId, err)
+		}
 	}
 
+	if prewarm != nil {
+		ns.prewarmer.start(volumeId, targetPath, prewarm)
+		if prewarm.Wait {
+			if err := ns.prewarmer.wait(ctx, targetPath); err != nil {
+				return nil, statusError(err, codes.DeadlineExceeded)
+			}
+		}
+	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) WaitForMountAvailable(mountpoint string) error {
-	for {
-		select {
-		case <-time.After(100 * time.Millisecond):
-			notMnt, _ := ns.mounter.IsLikelyNotMountPoint(mountpoint)
-			if !notMnt {
-				return nil
-			}
-			break
-		case <-time.After(1 * time.Minute):
-			return errors.New("Wait for Mount available timeout")
-		}
+// publishSync publishes a sync mode volume, a node copy of the remote
+// bind-mounted at the target. endpointFlags are passed to the rclone
+// commands along with the sync flags of the volume.
+func (ns *nodeServer) publishSync(ctx context.Context, req *csi.NodePublishVolumeRequest, remote, remotePath, rcloneConfData string, endpointFlags map[string]string) (*csi.NodePublishVolumeResponse, error) {
+	opts, err := parseSyncOptions(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	for k, v := range endpointFlags {
+		opts.flags = append(opts.flags, fmt.Sprintf("--%s=%s", k, v))
 	}
+	rcloneVol := &RcloneVolume{
+		ID:         req.GetVolumeId(),
+		Remote:     remote,
+		RemotePath: remotePath,
+	}
+	start := time.Now()
+	err = ns.syncer.Publish(ctx, rcloneVol, req.GetTargetPath(), rcloneConfData, opts)
+	observeMountOperation("mount", start, err)
+	ns.reporter.mounted(req.GetVolumeId(), req.GetTargetPath(), req.GetVolumeContext(), err)
+	if err != nil {
+		return nil, statusError(err, codes.Internal)
+	}
+	ns.state.add(publishedVolume{VolumeID: req.GetVolumeId(), TargetPath: req.GetTargetPath(), Remote: remote, RemotePath: remotePath, Sync: true})
+	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func validatePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
@@ -148,7 +272,6 @@ func validateUnPublishVolumeRequest(req *csi.NodeUnpublishVolumeRequest) error {
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.Infof("NodeUnPublishVolume: called with args %+v", *req)
 	if err := validateUnPublishVolumeRequest(req); err != nil {
 		return nil, err
 	}
@@ -156,18 +279,121 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
 	}
+	lockKeys := []string{volumeLockKey(req.GetVolumeId()), targetLockKey(targetPath)}
+	if err := ns.locks.acquire(req.GetVolumeId(), lockKeys...); err != nil {
+		return nil, err
+	}
+	defer ns.locks.Release(lockKeys...)
+
+	// Reads of a pre-warm would keep the mount busy.
+	ns.prewarmer.stop(ctx, targetPath)
+
+	if ns.syncer.Published(req.GetVolumeId(), targetPath) {
+		start := time.Now()
+		err := ns.syncer.Unpublish(ctx, req.GetVolumeId(), targetPath)
+		observeMountOperation("unmount", start, err)
+		ns.reporter.unmounted(req.GetVolumeId(), targetPath, err)
+		if err != nil {
+			return nil, statusError(err, codes.Internal)
+		}
+		ns.state.remove(targetPath)
+		ns.forgetSecrets(req.GetVolumeId())
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
 
 	rcloneVol, err := ns.RcloneOps.GetVolumeById(ctx, req.GetVolumeId())
+	if errors.Is(err, errVolumeNotFound) {
+		// The PV may already be gone, the mounter is found by volume id alone.
+		rcloneVol, err = &RcloneVolume{ID: req.GetVolumeId()}, nil
+	}
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err, codes.Internal)
 	}
 
-	ns.RcloneOps.Unmount(ctx, rcloneVol)
-	util.UnmountPath(req.GetTargetPath(), ns.mounter)
+	start := time.Now()
+	ops := ns.RcloneOps
+	if served := ns.serveOps[servedMountType(ns.mounter, targetPath)]; served != nil {
+		// A kernel mount hangs once its server is gone, so it goes first.
+		if err := util.UnmountPath(targetPath, ns.mounter); err != nil {
+			return nil, statusError(err, codes.Internal)
+		}
+		ops = served
+	}
+	if shared, ok := ops.(targetUnmounter); ok {
+		err = shared.UnmountTarget(ctx, rcloneVol, targetPath)
+	} else {
+		err = ops.Unmount(ctx, rcloneVol)
+	}
+	if errors.Is(err, errUploadsPending) {
+		// Keep the mounter and the target, the retry waits for the rest.
+		observeMountOperation("unmount", start, err)
+		ns.reporter.unmounted(req.GetVolumeId(), req.GetTargetPath(), err)
+		return nil, statusError(err, codes.DeadlineExceeded)
+	}
+	if unmountErr := util.UnmountPath(req.GetTargetPath(), ns.mounter); err == nil {
+		err = unmountErr
+	}
+	observeMountOperation("unmount", start, err)
+	ns.reporter.unmounted(req.GetVolumeId(), req.GetTargetPath(), err)
+	if err != nil {
+		// Kept in the node state, kubelet retries the unpublish.
+		return nil, statusError(err, codes.Internal)
+	}
+	ns.state.remove(req.GetTargetPath())
+	ns.forgetSecrets(req.GetVolumeId())
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// forgetSecrets stops masking the secrets of volumeId once none of its
+// targets is published on the node.
+func (ns *nodeServer) forgetSecrets(volumeId string) {
+	for _, v := range ns.state.list() {
+		if v.VolumeID == volumeId {
+			return
+		}
+	}
+	redactor.dropVolume(volumeId)
+}
+
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil || len(ns.topologyKeys) == 0 {
+		return resp, err
+	}
+
+	segments, err := nodeTopology(ns.kubeClient, ns.nodeID, ns.topologyKeys)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeGetInfo: %v", err)
+	}
+	if len(segments) > 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: segments}
+	}
+	return resp, nil
+}
+
+// topologyEndpoint returns the endpoint for this node from a
+// topologyEndpointsKey volume attribute.
+func (ns *nodeServer) topologyEndpoint(value string) (string, error) {
+	if len(ns.topologyKeys) == 0 {
+		return "", errors.New("no topology keys are configured on this node")
+	}
+	endpoints, err := parseTopologyEndpoints(value)
+	if err != nil {
+		return "", err
+	}
+	segments, err := nodeTopology(ns.kubeClient, ns.nodeID, ns.topologyKeys)
+	if err != nil {
+		return "", err
+	}
+	zone := segments[ns.topologyKeys[0]]
+	endpoint, ok := endpoints[zone]
+	if !ok {
+		return "", fmt.Errorf("no endpoint for %s=%q", ns.topologyKeys[0], zone)
+	}
+	return endpoint, nil
+}
+
 func (*nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method NodeExpandVolume not implemented")
 }
@@ -0,0 +1,290 @@
+package rclone
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPublishRequest(targetPath string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol-1",
+		TargetPath:       targetPath,
+		VolumeCapability: testVolumeCapability,
+		Secrets:          map[string]string{"rclone.conf": testRcloneConf},
+		VolumeContext:    map[string]string{"remote": "minio", "path": "base/pvc-1"},
+	}
+}
+
+func TestNodePublishVolumeValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*csi.NodePublishVolumeRequest)
+	}{
+		{"missing volume id", func(r *csi.NodePublishVolumeRequest) { r.VolumeId = "" }},
+		{"missing target path", func(r *csi.NodePublishVolumeRequest) { r.TargetPath = "" }},
+		{"missing capability", func(r *csi.NodePublishVolumeRequest) { r.VolumeCapability = nil }},
+		{"missing rclone.conf", func(r *csi.NodePublishVolumeRequest) { r.Secrets = nil }},
+		{"missing remote", func(r *csi.NodePublishVolumeRequest) { delete(r.VolumeContext, "remote") }},
+		{"missing path", func(r *csi.NodePublishVolumeRequest) { delete(r.VolumeContext, "path") }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone())
+			req := testPublishRequest(filepath.Join(t.TempDir(), "target"))
+			tc.modify(req)
+
+			_, err := td.ns.NodePublishVolume(context.Background(), req)
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Fatalf("expected InvalidArgument, got %v (%v)", code, err)
+			}
+			if actions := td.actions(); len(actions) != 0 {
+				t.Errorf("expected no API calls, got %v", actions)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeDeployment(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		wantArgs      []string
+		unwantedArgs  []string
+	}{
+		{
+			name:          "default flags",
+			volumeContext: map[string]string{},
+			wantArgs:      []string{"--vfs-cache-mode=full", "--rc-addr=0.0.0.0:5572", "--allow-other=true"},
+		},
+		{
+			name:          "mount flags override defaults",
+			volumeContext: map[string]string{"mount/vfs-cache-mode": "writes", "mount/read-only": ""},
+			wantArgs:      []string{"--vfs-cache-mode=writes", "--read-only"},
+			unwantedArgs:  []string{"--vfs-cache-mode=full"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"))
+			targetPath := filepath.Join(t.TempDir(), "target")
+			req := testPublishRequest(targetPath)
+			for k, v := range tc.volumeContext {
+				req.VolumeContext[k] = v
+			}
+
+			if _, err := td.ns.NodePublishVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+
+			name := "rclone-mounter-vol-1"
+			deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("mounter deployment not created: %v", err)
+			}
+			pod := deployment.Spec.Template.Spec
+			if pod.NodeName != testNodeID {
+				t.Errorf("expected mounter pinned to %s, got %q", testNodeID, pod.NodeName)
+			}
+			if pod.Volumes[0].HostPath == nil || pod.Volumes[0].HostPath.Path != targetPath {
+				t.Errorf("expected target %s to be mounted from the host, got %+v", targetPath, pod.Volumes[0])
+			}
+			if pod.Volumes[1].Secret == nil || pod.Volumes[1].Secret.SecretName != name {
+				t.Errorf("expected config from secret %s, got %+v", name, pod.Volumes[1])
+			}
+
+			args := pod.Containers[0].Args
+			if !reflect.DeepEqual(args[:3], []string{"mount", "minio:/base/pvc-1", targetPath}) {
+				t.Errorf("unexpected mount arguments %v", args[:3])
+			}
+			for _, want := range tc.wantArgs {
+				if !contains(args, want) {
+					t.Errorf("expected argument %s in %v", want, args)
+				}
+			}
+			for _, unwanted := range tc.unwantedArgs {
+				if contains(args, unwanted) {
+					t.Errorf("unexpected argument %s in %v", unwanted, args)
+				}
+			}
+
+			secret, err := td.kubeClient.CoreV1().Secrets(testNamespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("mounter secret not created: %v", err)
+			}
+			if secret.StringData["rclone.conf"] != testRcloneConf {
+				t.Errorf("expected rclone.conf to be copied to the mounter secret")
+			}
+			if contains(args, "--rc-no-auth") {
+				t.Errorf("expected the rc API to need credentials, got %v", args)
+			}
+			if pass := secret.StringData[rcPassKey]; len(pass) < 32 || secret.StringData[rcUserKey] != rcUser {
+				t.Errorf("expected generated rc credentials in the mounter secret, got user %q and password %q", secret.StringData[rcUserKey], pass)
+			}
+			env := map[string]string{}
+			for _, e := range pod.Containers[0].Env {
+				if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name == name {
+					env[e.Name] = e.ValueFrom.SecretKeyRef.Key
+				}
+			}
+			if env["RCLONE_RC_USER"] != rcUserKey || env["RCLONE_RC_PASS"] != rcPassKey {
+				t.Errorf("expected the rc credentials from the mounter secret, got %v", pod.Containers[0].Env)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeSecretHash(t *testing.T) {
+	hash := func(conf string) string {
+		sum := sha256.Sum256([]byte(conf))
+		return hex.EncodeToString(sum[:])[:63]
+	}
+	rotatedConf := testRcloneConf + "\n[extra]\ntype = local\n"
+
+	tests := []struct {
+		name        string
+		republish   string
+		wantActions []string
+	}{
+		{
+			name:        "same config keeps mounter",
+			republish:   testRcloneConf,
+			wantActions: []string{"get secrets", "get deployments"},
+		},
+		{
+			name:      "changed config recreates mounter",
+			republish: rotatedConf,
+			wantActions: []string{
+				"get secrets", "delete secrets", "create secrets",
+				"get deployments", "delete deployments", "delete deployments", "create deployments",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone())
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if _, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(targetPath)); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+
+			// Mount again as kubelet would after a restart of the node plugin.
+			td.kubeClient.ClearActions()
+			vol := &RcloneVolume{ID: "vol-1", Remote: "minio", RemotePath: "base/pvc-1"}
+			if err := td.ns.RcloneOps.Mount(context.Background(), vol, targetPath, tc.republish, map[string]string{}); err != nil {
+				t.Fatalf("Mount failed: %v", err)
+			}
+
+			if actions := mounterActions(td); !reflect.DeepEqual(actions, tc.wantActions) {
+				t.Errorf("expected actions %v, got %v", tc.wantActions, actions)
+			}
+			deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := deployment.Labels["hash"]; got != hash(tc.republish) {
+				t.Errorf("expected hash label %s, got %s", hash(tc.republish), got)
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		failDelete bool
+		wantCode   codes.Code
+	}{
+		{
+			name:     "volume without PV",
+			wantCode: codes.OK,
+		},
+		{
+			name:     "success",
+			objects:  []runtime.Object{testPV("pv-1", "vol-1", "minio", "base/pvc-1")},
+			wantCode: codes.OK,
+		},
+		{
+			name:       "mounter not deleted",
+			objects:    []runtime.Object{testPV("pv-1", "vol-1", "minio", "base/pvc-1")},
+			failDelete: true,
+			wantCode:   codes.PermissionDenied,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), tc.objects...)
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if _, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(targetPath)); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			if tc.failDelete {
+				td.kubeClient.PrependReactor("delete", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, k8serrors.NewForbidden(appsv1.Resource("deployments"), "rclone-mounter-vol-1", errors.New("rbac"))
+				})
+			}
+
+			_, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "vol-1",
+				TargetPath: targetPath,
+			})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if tc.wantCode != codes.OK {
+				if len(td.ns.state.list()) != 1 {
+					t.Errorf("expected %s kept in the node state for the retry", targetPath)
+				}
+				return
+			}
+
+			if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{}); err == nil {
+				t.Errorf("expected mounter deployment to be deleted")
+			}
+			if notMnt, _ := td.mounter.IsLikelyNotMountPoint(targetPath); !notMnt {
+				t.Errorf("expected %s to be unmounted", targetPath)
+			}
+		})
+	}
+}
+
+// mounterActions filters the recorded API calls down to the mounter Secret
+// and Deployment.
+func mounterActions(td *testDriver) []string {
+	out := []string{}
+	for _, a := range td.actions() {
+		switch a {
+		case "list persistentvolumes", "get persistentvolumes", "update persistentvolumes":
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
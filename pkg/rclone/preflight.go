@@ -0,0 +1,99 @@
+package rclone
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// preflightKey set to "false" skips the connectivity check of CreateVolume,
+// for remotes whose base path cannot be listed.
+const preflightKey = "preflight"
+
+// preflightTimeout bounds the connectivity check of a remote.
+var preflightTimeout = 30 * time.Second
+
+// rcloneConfig maps the remotes of an rclone.conf to their options.
+type rcloneConfig map[string]map[string]string
+
+// parseRcloneConf reads the sections of an rclone.conf.
+func parseRcloneConf(data string) (rcloneConfig, error) {
+	conf := rcloneConfig{}
+	var section map[string]string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("rclone.conf line %d: invalid section %q", n, line)
+			}
+			section = map[string]string{}
+			conf[line[1:len(line)-1]] = section
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rclone.conf line %d: expected key = value", n)
+		}
+		if section == nil {
+			return nil, fmt.Errorf("rclone.conf line %d: option outside of a remote section", n)
+		}
+		section[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return conf, scanner.Err()
+}
+
+// checkRemote confirms remote is configured with a backend type. Remotes
+// defined on the command line, such as ":s3,provider=AWS:", are not in the
+// config and pass.
+func (c rcloneConfig) checkRemote(remote string) error {
+	if strings.HasPrefix(remote, ":") {
+		return nil
+	}
+	section, ok := c[remote]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "remote %q is not defined in rclone.conf, check the secret or the remote parameter", remote)
+	}
+	if section["type"] == "" {
+		return status.Errorf(codes.InvalidArgument, "remote %q in rclone.conf has no backend type", remote)
+	}
+	return nil
+}
+
+// CheckRemote lists the base path of remote to confirm it is reachable with
+// the configured credentials. A base path that does not exist yet passes,
+// CreateVolume creates it.
+func (r *Rclone) CheckRemote(ctx context.Context, remote, remotePath, rcloneConfigPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	target := fmt.Sprintf("%s:%s", remote, remotePath)
+	out, err := r.execute.CommandContext(ctx, "rclone", "lsjson", "--stat", target, "--config="+rcloneConfigPath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	output := redactor.Scrub(string(out))
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Errorf(codes.Unavailable, "remote %s did not answer within %v, check the endpoint and network access", target, preflightTimeout)
+	}
+	code := rcloneErrorCode(err, output)
+	switch code {
+	case codes.NotFound:
+		klog.Infof("base path %s does not exist yet", target)
+		return nil
+	case codes.PermissionDenied:
+		return status.Errorf(code, "remote %s denied access, check the credentials in rclone.conf: %s", target, output)
+	case codes.InvalidArgument:
+		return status.Errorf(code, "remote %s is misconfigured: %s", target, output)
+	}
+	return status.Errorf(codes.Unavailable, "remote %s is not reachable: %s", target, output)
+}
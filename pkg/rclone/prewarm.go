@@ -0,0 +1,372 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+// Volume attributes of cache pre-warming. prewarmKey lists paths or glob
+// patterns, relative to the volume root and separated by commas, whose files
+// are read into the VFS cache after the mount is up. A pattern matching a
+// directory pre-warms everything under it.
+const (
+	prewarmKey     = "prewarm"
+	prewarmWaitKey = "prewarmWait"
+)
+
+// prewarmProgressInterval is how often a running pre-warm reports progress.
+var prewarmProgressInterval = 30 * time.Second
+
+// prewarmReadSize is the chunk files are read in, cancellation is checked
+// between chunks.
+const prewarmReadSize = 1 << 20
+
+// prewarmOptions are the pre-warm settings of a volume.
+type prewarmOptions struct {
+	Patterns []string
+	// Wait makes NodePublishVolume return once the pre-warm finished.
+	Wait bool
+}
+
+// parsePrewarmOptions reads the pre-warm attributes, nil when prewarmKey is
+// not set.
+func parsePrewarmOptions(attributes map[string]string) (*prewarmOptions, error) {
+	value, ok := attributes[prewarmKey]
+	if !ok {
+		if _, ok := attributes[prewarmWaitKey]; ok {
+			return nil, fmt.Errorf("%s needs %s", prewarmWaitKey, prewarmKey)
+		}
+		return nil, nil
+	}
+	opts := &prewarmOptions{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		clean := filepath.Clean(pattern)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid %s pattern %q, expected a path relative to the volume root", prewarmKey, pattern)
+		}
+		if _, err := filepath.Match(clean, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", prewarmKey, pattern, err)
+		}
+		opts.Patterns = append(opts.Patterns, clean)
+	}
+	if len(opts.Patterns) == 0 {
+		return nil, fmt.Errorf("%s lists no paths", prewarmKey)
+	}
+	if wait, ok := attributes[prewarmWaitKey]; ok {
+		var err error
+		if opts.Wait, err = strconv.ParseBool(wait); err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected true or false", prewarmWaitKey, wait)
+		}
+	}
+	return opts, nil
+}
+
+// refreshDirs returns the directories to read into the directory cache for
+// patterns, those to list with their subdirectories and those to list
+// alone. A plain path to a directory under root is listed with its
+// subdirectories, a plain path to a file only has its parent listed. A
+// pattern has the part before its first wildcard listed with its
+// subdirectories. The volume root, "", is never listed recursively, which
+// would list the whole remote.
+func refreshDirs(root string, patterns []string) (recursive, flat []string) {
+	var deep, shallow []string
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, "/")
+		static := 0
+		for static < len(parts) && !strings.ContainsAny(parts[static], `*?[\`) {
+			static++
+		}
+		if static < len(parts) {
+			deep = append(deep, strings.Join(parts[:static], "/"))
+			continue
+		}
+		info, err := os.Stat(filepath.Join(root, pattern))
+		switch {
+		case err != nil:
+			// Nothing to pre-warm there.
+		case info.IsDir():
+			deep = append(deep, pattern)
+		default:
+			shallow = append(shallow, filepath.Dir(pattern))
+		}
+	}
+	for _, dir := range deep {
+		if dir == "" || dir == "." {
+			shallow = append(shallow, "")
+		} else if !covered(dir, recursive) {
+			recursive = append(removeCovered(recursive, dir), dir)
+		}
+	}
+	seen := map[string]bool{}
+	for _, dir := range shallow {
+		if dir == "." {
+			dir = ""
+		}
+		if !covered(dir, recursive) && !seen[dir] {
+			seen[dir] = true
+			flat = append(flat, dir)
+		}
+	}
+	return recursive, flat
+}
+
+// covered tells whether dir is one of dirs or under one of them.
+func covered(dir string, dirs []string) bool {
+	for _, d := range dirs {
+		if dir == d || strings.HasPrefix(dir, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCovered returns dirs without those under dir.
+func removeCovered(dirs []string, dir string) []string {
+	out := dirs[:0]
+	for _, d := range dirs {
+		if !covered(d, []string{dir}) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// prewarmFiles returns the files under root matched by patterns, with
+// directories expanded, and their total size.
+func prewarmFiles(root string, patterns []string) ([]string, int64, error) {
+	seen := map[string]bool{}
+	files := []string{}
+	var total int64
+	add := func(path string, info os.FileInfo) {
+		if info.Mode().IsRegular() && !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+			total += info.Size()
+		}
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				add(path, info)
+				return nil
+			})
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, total, nil
+}
+
+// prewarmProgress is how far a pre-warm got.
+type prewarmProgress struct {
+	Files      int64
+	TotalFiles int64
+	Bytes      int64
+	TotalBytes int64
+	Elapsed    time.Duration
+}
+
+// prewarmJob is the pre-warm of one published target.
+type prewarmJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	files  int64
+	bytes  int64
+	err    error
+}
+
+// prewarmer reads the files of published volumes into their VFS cache in
+// the background, one job per target.
+type prewarmer struct {
+	reporter *volumeReporter
+	// mounterClient returns an rc client of the mounter of a volume, nil
+	// when it has none. The directory cache is not refreshed without one.
+	mounterClient func(volumeId string) (*rc.Client, error)
+
+	mu   sync.Mutex
+	jobs map[string]*prewarmJob
+}
+
+func newPrewarmer(reporter *volumeReporter, mounterClient func(volumeId string) (*rc.Client, error)) *prewarmer {
+	return &prewarmer{reporter: reporter, mounterClient: mounterClient, jobs: map[string]*prewarmJob{}}
+}
+
+// start pre-warms the volume published at targetPath, unless that is
+// already running.
+func (p *prewarmer) start(volumeId, targetPath string, opts *prewarmOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.jobs[targetPath]; ok {
+		select {
+		case <-job.done:
+		default:
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &prewarmJob{cancel: cancel, done: make(chan struct{})}
+	p.jobs[targetPath] = job
+	prewarmActive.Inc()
+	go func() {
+		defer prewarmActive.Dec()
+		defer close(job.done)
+		start := time.Now()
+		job.err = p.run(ctx, job, volumeId, targetPath, opts.Patterns)
+		observePrewarm(job.err)
+		progress := prewarmProgress{
+			Files:   atomic.LoadInt64(&job.files),
+			Bytes:   atomic.LoadInt64(&job.bytes),
+			Elapsed: time.Since(start),
+		}
+		if !errors.Is(job.err, context.Canceled) {
+			p.reporter.prewarmed(volumeId, progress, job.err)
+		}
+	}()
+}
+
+// wait blocks until the pre-warm of targetPath finished or ctx is done. A
+// failed pre-warm is reported, but does not fail the wait.
+func (p *prewarmer) wait(ctx context.Context, targetPath string) error {
+	p.mu.Lock()
+	job, ok := p.jobs[targetPath]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-job.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the pre-warm of %s: %w", targetPath, ctx.Err())
+	}
+}
+
+// stop cancels the pre-warm of targetPath and waits for it to let go of the
+// mount, bounded by ctx.
+func (p *prewarmer) stop(ctx context.Context, targetPath string) {
+	p.mu.Lock()
+	job, ok := p.jobs[targetPath]
+	delete(p.jobs, targetPath)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	job.cancel()
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+	}
+}
+
+func (p *prewarmer) run(ctx context.Context, job *prewarmJob, volumeId, targetPath string, patterns []string) error {
+	start := time.Now()
+	if p.mounterClient != nil {
+		// Listing the directories once through rc beats the lookups of the
+		// walk below, one remote call per directory.
+		if client, err := p.mounterClient(volumeId); err != nil || client == nil {
+			klog.Warningf("not refreshing the directory cache of volume %s: %v", volumeId, err)
+		} else {
+			recursive, flat := refreshDirs(targetPath, patterns)
+			refreshDirCache(ctx, client, volumeId, recursive, true)
+			refreshDirCache(ctx, client, volumeId, flat, false)
+		}
+	}
+
+	files, totalBytes, err := prewarmFiles(targetPath, patterns)
+	if err != nil {
+		return err
+	}
+	klog.Infof("pre-warming %d files (%d bytes) of volume %s", len(files), totalBytes, volumeId)
+	progress := func() prewarmProgress {
+		return prewarmProgress{
+			Files:      atomic.LoadInt64(&job.files),
+			TotalFiles: int64(len(files)),
+			Bytes:      atomic.LoadInt64(&job.bytes),
+			TotalBytes: totalBytes,
+			Elapsed:    time.Since(start),
+		}
+	}
+	p.reporter.prewarming(volumeId, progress())
+
+	lastReport := time.Now()
+	buf := make([]byte, prewarmReadSize)
+	for _, file := range files {
+		if err := readFile(ctx, file, buf, &job.bytes); err != nil {
+			return err
+		}
+		atomic.AddInt64(&job.files, 1)
+		prewarmFilesRead.Inc()
+		if time.Since(lastReport) >= prewarmProgressInterval {
+			lastReport = time.Now()
+			p.reporter.prewarming(volumeId, progress())
+		}
+	}
+	return nil
+}
+
+// refreshDirCache reads dirs of volumeId into the directory cache of its
+// mounter, logging what failed.
+func refreshDirCache(ctx context.Context, client *rc.Client, volumeId string, dirs []string, recursive bool) {
+	if len(dirs) == 0 {
+		return
+	}
+	result, err := client.VfsRefresh(ctx, "", dirs, recursive)
+	if err != nil {
+		klog.Warningf("refreshing the directory cache of volume %s: %v", volumeId, err)
+		return
+	}
+	for dir, outcome := range result {
+		if outcome != "OK" {
+			klog.Warningf("refreshing %q of volume %s: %s", dir, volumeId, outcome)
+		}
+	}
+}
+
+// readFile reads path to the end, adding the bytes read to *read.
+func readFile(ctx context.Context, path string, buf []byte, read *int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.Read(buf)
+		atomic.AddInt64(read, int64(n))
+		prewarmBytesRead.Add(float64(n))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
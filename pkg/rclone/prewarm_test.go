@@ -0,0 +1,232 @@
+package rclone
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParsePrewarmOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       *prewarmOptions
+		wantErr    bool
+	}{
+		{
+			name:       "unset",
+			attributes: map[string]string{},
+		},
+		{
+			name:       "paths and patterns",
+			attributes: map[string]string{prewarmKey: "datasets/train/*.parquet, labels.csv,", prewarmWaitKey: "true"},
+			want:       &prewarmOptions{Patterns: []string{"datasets/train/*.parquet", "labels.csv"}, Wait: true},
+		},
+		{
+			name:       "escaping the volume",
+			attributes: map[string]string{prewarmKey: "../other"},
+			wantErr:    true,
+		},
+		{
+			name:       "absolute path",
+			attributes: map[string]string{prewarmKey: "/etc"},
+			wantErr:    true,
+		},
+		{
+			name:       "bad pattern",
+			attributes: map[string]string{prewarmKey: "data/[a"},
+			wantErr:    true,
+		},
+		{
+			name:       "no paths",
+			attributes: map[string]string{prewarmKey: " , "},
+			wantErr:    true,
+		},
+		{
+			name:       "wait without paths",
+			attributes: map[string]string{prewarmWaitKey: "true"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid wait",
+			attributes: map[string]string{prewarmKey: "data", prewarmWaitKey: "soon"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parsePrewarmOptions(tc.attributes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if !reflect.DeepEqual(opts, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, opts)
+			}
+		})
+	}
+}
+
+func TestRefreshDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"datasets/train", "datasets/test", "models"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"labels.csv", "datasets/train/part-1", "models/latest.bin"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		patterns      []string
+		wantRecursive []string
+		wantFlat      []string
+	}{
+		{
+			name:     "top-level file",
+			patterns: []string{"labels.csv"},
+			wantFlat: []string{""},
+		},
+		{
+			name:          "top-level directory",
+			patterns:      []string{"datasets"},
+			wantRecursive: []string{"datasets"},
+		},
+		{
+			name:     "top-level wildcard",
+			patterns: []string{"*/meta", "*.csv"},
+			wantFlat: []string{""},
+		},
+		{
+			name:          "nested file and pattern",
+			patterns:      []string{"datasets/train/*.parquet", "datasets/train/part-1", "models/latest.bin"},
+			wantRecursive: []string{"datasets/train"},
+			wantFlat:      []string{"models"},
+		},
+		{
+			name:          "directory covering others",
+			patterns:      []string{"datasets/train/*", "datasets/test", "datasets"},
+			wantRecursive: []string{"datasets"},
+		},
+		{
+			name:     "missing path",
+			patterns: []string{"nope"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			recursive, flat := refreshDirs(root, tc.patterns)
+			if !reflect.DeepEqual(recursive, tc.wantRecursive) || !reflect.DeepEqual(flat, tc.wantFlat) {
+				t.Errorf("expected recursive %q and flat %q, got %q and %q", tc.wantRecursive, tc.wantFlat, recursive, flat)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumePrewarm(t *testing.T) {
+	td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"), servingPod(true))
+	rc := newFakeRc(t, map[string]fakeRcHandler{
+		"vfs/refresh": func(map[string]interface{}) (interface{}, error) {
+			return map[string]interface{}{"result": map[string]string{}}, nil
+		},
+	})
+	td.ns.RcloneOps.(*Rclone).rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+	targetPath := filepath.Join(t.TempDir(), "target")
+	files := map[string]int{"train/a.bin": 100, "train/b.bin": 20, "train/notes.txt": 5, "labels.csv": 3, "other.csv": 7}
+	for name, size := range files {
+		path := filepath.Join(targetPath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := testPublishRequest(targetPath)
+	req.VolumeContext[prewarmKey] = "train/*.bin,labels.csv"
+	req.VolumeContext[prewarmWaitKey] = "true"
+	if _, err := td.ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+
+	refreshed := []string{}
+	for _, call := range rc.calls("vfs/refresh") {
+		for k, v := range call.params {
+			if strings.HasPrefix(k, "dir") {
+				if call.params["recursive"] == "true" {
+					refreshed = append(refreshed, v.(string)+" recursive")
+				} else {
+					refreshed = append(refreshed, v.(string))
+				}
+			}
+		}
+	}
+	if want := []string{"train recursive", ""}; !sameElements(refreshed, want) {
+		t.Errorf("expected vfs/refresh of %q, got %q", want, refreshed)
+	}
+	events := []string{}
+	for len(td.recorder.Events) > 0 {
+		events = append(events, <-td.recorder.Events)
+	}
+	wantEvents := []string{
+		"Normal Prewarming pre-warming the cache on node " + testNodeID + ": 0/3 files, 0/123 bytes read",
+		"Normal Prewarmed pre-warmed the cache on node " + testNodeID + ": read 3 files, 123 bytes",
+	}
+	for _, want := range wantEvents {
+		found := false
+		for _, event := range events {
+			found = found || strings.HasPrefix(event, want)
+		}
+		if !found {
+			t.Errorf("expected event %q in %q", want, events)
+		}
+	}
+
+	td.ns.prewarmer.stop(context.Background(), targetPath)
+	if len(td.ns.prewarmer.jobs) != 0 {
+		t.Errorf("expected no pre-warm left, got %v", td.ns.prewarmer.jobs)
+	}
+}
+
+func TestPrewarmCancelled(t *testing.T) {
+	p := newTestDriver(newFakeRclone()).ns.prewarmer
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := &prewarmJob{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.run(ctx, job, "vol-1", root, []string{"*"}); err != context.Canceled {
+		t.Errorf("expected a cancelled pre-warm, got %v", err)
+	}
+}
+
+func sameElements(a, b []string) bool {
+	count := map[string]int{}
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
@@ -0,0 +1,306 @@
+package rclone
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/utils/exec"
+)
+
+// processMountLogSize bounds the mounter output kept for MounterLogs.
+const processMountLogSize = 64 * 1024
+
+// processRclone runs `rclone mount` as a child of the plugin instead of a
+// mounter Deployment. It needs no cluster, which makes it suitable for tests
+// and single-node setups, but mounts do not survive a plugin restart.
+//
+// A volume gets one rclone process, further publish targets of it bind-mount
+// the first: two processes would share the VFS cache of the volume.
+type processRclone struct {
+	*Rclone
+	configDir string
+	mounter   mount.Interface
+
+	mu     sync.Mutex
+	mounts map[string]*processMount
+}
+
+type processMount struct {
+	cmd exec.Cmd
+	// args are the rclone command line, run again by Remount.
+	args []string
+	// target is the mount point of rclone, the other targets bind-mount it.
+	target     string
+	targets    map[string]bool
+	configPath string
+	output     *boundedBuffer
+	done       chan struct{}
+}
+
+func (m *processMount) running() bool {
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// withMountPoint returns args, from buildMountArgs, mounting at targetPath.
+func withMountPoint(args []string, targetPath string) []string {
+	out := append([]string{}, args...)
+	out[2] = targetPath
+	return out
+}
+
+var (
+	_ Operations      = &processRclone{}
+	_ targetUnmounter = &processRclone{}
+)
+
+// NewProcessRclone returns Operations that mount volumes with local rclone
+// processes. Volume creation and deletion behave as with NewRclone.
+func NewProcessRclone(kubeClient kubernetes.Interface, execute exec.Interface, nodeID string) (Operations, error) {
+	configDir, err := ioutil.TempDir("", "csi-rclone-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(configDir, 0700); err != nil {
+		return nil, err
+	}
+	return &processRclone{
+		Rclone:    NewRclone(kubeClient, execute, nodeID).(*Rclone),
+		configDir: configDir,
+		mounter:   mount.New(""),
+		mounts:    map[string]*processMount{},
+	}, nil
+}
+
+func (r *processRclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, parameters map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return err
+	}
+	targets := map[string]bool{}
+	if m, ok := r.mounts[rcloneVolume.ID]; ok {
+		if !m.running() {
+			// The previous rclone exited, start a new one. The watchdog
+			// repairs the other targets by binding them again.
+			targets = m.targets
+		} else if m.targets[targetPath] {
+			return nil
+		} else {
+			klog.Infof("binding the rclone mount of volume %s at %s to %s", rcloneVolume.ID, m.target, targetPath)
+			if err := r.mounter.Mount(m.target, targetPath, "", []string{"bind"}); err != nil {
+				return err
+			}
+			m.targets[targetPath] = true
+			return nil
+		}
+	}
+	flags := defaultMountFlags(rcloneVolume)
+	for k := range flags {
+		// The rc API of a local mount would clash between volumes.
+		if strings.HasPrefix(k, "rc") {
+			delete(flags, k)
+		}
+	}
+	if cache := rcloneVolume.Cache; cache != nil {
+		switch cache.Storage {
+		case cacheStorageHost:
+			dir, err := r.hostCacheDir(rcloneVolume)
+			if err != nil {
+				return err
+			}
+			flags["cache-dir"] = dir
+		case cacheStorageEmptyDir:
+			return status.Errorf(codes.FailedPrecondition, "%s %s needs the deployment mounter", cacheStorageKey, cacheStorageEmptyDir)
+		}
+	}
+	configPath := filepath.Join(r.configDir, rcloneVolume.normalizedVolumeId()+".conf")
+	if err := ioutil.WriteFile(configPath, []byte(rcloneConfigData), 0600); err != nil {
+		return err
+	}
+
+	args := buildMountArgs(rcloneVolume, targetPath, flags, parameters)
+	args = append(args, "--config="+configPath)
+
+	klog.Infof("starting rclone mount of %s:%s at %s", rcloneVolume.Remote, rcloneVolume.RemotePath, targetPath)
+	if err := r.start(rcloneVolume, args, configPath, targets); err != nil {
+		os.Remove(configPath)
+		return err
+	}
+	return nil
+}
+
+// Remount starts the rclone mount of rcloneVolume again with the same
+// command line at targetPath, after the stale mount of the previous one is
+// gone. A target bound to a still running rclone is bound again.
+func (r *processRclone) Remount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.mounts[rcloneVolume.ID]
+	if !ok {
+		return fmt.Errorf("no rclone mount of volume %s to restart: %w", rcloneVolume.ID, errVolumeNotFound)
+	}
+	if m.running() {
+		if targetPath != m.target {
+			klog.Infof("binding the rclone mount of volume %s at %s to %s again", rcloneVolume.ID, m.target, targetPath)
+			return r.mounter.Mount(m.target, targetPath, "", []string{"bind"})
+		}
+		m.cmd.Stop()
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	klog.Infof("restarting rclone mount of %s:%s at %s", rcloneVolume.Remote, rcloneVolume.RemotePath, targetPath)
+	return r.start(rcloneVolume, withMountPoint(m.args, targetPath), m.configPath, m.targets)
+}
+
+// start runs rclone with args as the mount of rcloneVolume, shared by targets.
+// The caller holds r.mu.
+func (r *processRclone) start(rcloneVolume *RcloneVolume, args []string, configPath string, targets map[string]bool) error {
+	m := &processMount{
+		cmd:        r.execute.Command("rclone", args...),
+		args:       args,
+		target:     args[2],
+		targets:    targets,
+		configPath: configPath,
+		output:     &boundedBuffer{max: processMountLogSize},
+		done:       make(chan struct{}),
+	}
+	m.targets[m.target] = true
+	m.cmd.SetStdout(m.output)
+	m.cmd.SetStderr(m.output)
+	if err := m.cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		if err := m.cmd.Wait(); err != nil {
+			klog.Warningf("rclone mount of volume %s exited: %v", rcloneVolume.ID, err)
+		}
+		close(m.done)
+	}()
+	r.mounts[rcloneVolume.ID] = m
+	return nil
+}
+
+// UnmountTarget releases targetPath of rcloneVolume, stopping rclone with the
+// last target. The caller unmounts targetPath.
+func (r *processRclone) UnmountTarget(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error {
+	r.mu.Lock()
+	if m, ok := r.mounts[rcloneVolume.ID]; ok {
+		delete(m.targets, targetPath)
+		if len(m.targets) > 0 {
+			if m.target == targetPath {
+				// The bind mounts share the mount of rclone, any of them
+				// can be bound from.
+				for target := range m.targets {
+					m.target = target
+					break
+				}
+			}
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	r.mu.Unlock()
+	return r.Unmount(ctx, rcloneVolume)
+}
+
+// Unmount stops the rclone mount of rcloneVolume, whatever its targets.
+func (r *processRclone) Unmount(ctx context.Context, rcloneVolume *RcloneVolume) error {
+	r.mu.Lock()
+	m, ok := r.mounts[rcloneVolume.ID]
+	delete(r.mounts, rcloneVolume.ID)
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	defer os.Remove(m.configPath)
+	defer func() {
+		if err := r.removeCache(rcloneVolume.ID); err != nil {
+			klog.Warningf("removing the VFS cache of volume %s: %v", rcloneVolume.ID, err)
+		}
+	}()
+	if !m.running() {
+		return nil
+	}
+	// rclone unmounts the target when it gets SIGTERM.
+	m.cmd.Stop()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *processRclone) MounterLogs(ctx context.Context, rcloneVolume *RcloneVolume, lines int64) (string, error) {
+	r.mu.Lock()
+	m, ok := r.mounts[rcloneVolume.ID]
+	r.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no rclone mount running for volume %s", rcloneVolume.ID)
+	}
+
+	out := strings.Split(strings.TrimRight(m.output.String(), "\n"), "\n")
+	if int64(len(out)) > lines {
+		out = out[int64(len(out))-lines:]
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// MounterReady tells whether the rclone mount of rcloneVolume is running, it
+// has no rc API to ask for more.
+func (r *processRclone) MounterReady(ctx context.Context, rcloneVolume *RcloneVolume) (bool, error) {
+	r.mu.Lock()
+	m, ok := r.mounts[rcloneVolume.ID]
+	r.mu.Unlock()
+	if !ok {
+		return false, fmt.Errorf("no rclone mount running for volume %s", rcloneVolume.ID)
+	}
+	if !m.running() {
+		return false, fmt.Errorf("rclone mount of volume %s exited", rcloneVolume.ID)
+	}
+	return true, nil
+}
+
+// boundedBuffer keeps the last max bytes written to it.
+type boundedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Write(p)
+	if over := b.buf.Len() - b.max; over > 0 {
+		b.buf.Next(over)
+	}
+	return len(p), nil
+}
+
+func (b *boundedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
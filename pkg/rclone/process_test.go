@@ -0,0 +1,120 @@
+package rclone
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+// runningRclone is an exec.Interface whose commands run until stopped.
+type runningRclone struct {
+	mu      sync.Mutex
+	started [][]string
+	stopped int
+}
+
+func (f *runningRclone) Command(name string, args ...string) exec.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = append(f.started, append([]string{name}, args...))
+	return &runningCmd{FakeCmd: &fakeexec.FakeCmd{}, exec: f, stop: make(chan struct{})}
+}
+
+func (f *runningRclone) CommandContext(ctx context.Context, name string, args ...string) exec.Cmd {
+	return f.Command(name, args...)
+}
+
+func (f *runningRclone) LookPath(file string) (string, error) {
+	return "/usr/bin/" + file, nil
+}
+
+type runningCmd struct {
+	*fakeexec.FakeCmd
+	exec *runningRclone
+	once sync.Once
+	stop chan struct{}
+}
+
+func (c *runningCmd) Wait() error {
+	<-c.stop
+	return nil
+}
+
+func (c *runningCmd) Stop() {
+	c.once.Do(func() {
+		c.exec.mu.Lock()
+		c.exec.stopped++
+		c.exec.mu.Unlock()
+		close(c.stop)
+	})
+}
+
+func TestProcessMountSharedBetweenTargets(t *testing.T) {
+	execute := &runningRclone{}
+	mounter := &mount.FakeMounter{}
+	ops, err := NewProcessRclone(fake.NewSimpleClientset(), execute, testNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ops.(*processRclone)
+	r.mounter = mounter
+
+	ctx := context.Background()
+	vol := &RcloneVolume{ID: "vol-1", Remote: "minio", RemotePath: "base/pvc-1"}
+	dir := t.TempDir()
+	targetA, targetB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, target := range []string{targetA, targetB, targetB} {
+		if err := r.Mount(ctx, vol, target, testRcloneConf, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(execute.started) != 1 || execute.started[0][3] != targetA {
+		t.Fatalf("expected one rclone mounting %s, got %v", targetA, execute.started)
+	}
+	if len(mounter.Log) != 1 || mounter.Log[0].Source != targetA || mounter.Log[0].Target != targetB {
+		t.Fatalf("expected %s bind-mounted to %s, got %v", targetA, targetB, mounter.Log)
+	}
+
+	// Unpublishing the target of rclone leaves the bound one served.
+	if err := r.UnmountTarget(ctx, vol, targetA); err != nil {
+		t.Fatal(err)
+	}
+	if execute.stopped != 0 {
+		t.Errorf("expected rclone kept for %s, got %d stopped", targetB, execute.stopped)
+	}
+	if ready, err := r.MounterReady(ctx, vol); !ready || err != nil {
+		t.Errorf("expected the mount ready, got %v, %v", ready, err)
+	}
+	if got := r.mounts["vol-1"].target; got != targetB {
+		t.Errorf("expected further targets bound from %s, got %s", targetB, got)
+	}
+
+	// Publishing it again, and repairing it, binds the remaining target.
+	if err := r.Mount(ctx, vol, targetA, testRcloneConf, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remount(ctx, vol, targetA); err != nil {
+		t.Fatal(err)
+	}
+	if len(execute.started) != 1 || len(mounter.Log) != 3 || mounter.Log[1].Target != targetA || mounter.Log[2].Target != targetA {
+		t.Errorf("expected %s bound to the running rclone, got %v, %v", targetA, execute.started, mounter.Log)
+	}
+
+	for _, target := range []string{targetA, targetB} {
+		if err := r.UnmountTarget(ctx, vol, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if execute.stopped != 1 {
+		t.Errorf("expected rclone stopped with the last target, got %d stopped", execute.stopped)
+	}
+	if _, err := r.MounterReady(ctx, vol); err == nil {
+		t.Error("expected no mount left")
+	}
+}
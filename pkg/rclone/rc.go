@@ -0,0 +1,163 @@
+package rclone
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// rcAddress returns the rc endpoint of a running mounter pod. Served
+// mounters answer on the loopback address of the node.
+func rcAddress(pod *corev1.Pod) (string, error) {
+	if port, ok := pod.Annotations[rcPortAnnotation]; ok {
+		return net.JoinHostPort(serveHost, port), nil
+	}
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("mounter pod %s has no IP yet", pod.Name)
+	}
+	return rc.PodAddress(pod.Status.PodIP), nil
+}
+
+// Keys of the mounter Secret holding the credentials of the rc API of the
+// mounter, generated per volume. The mounter reads them from its environment.
+const (
+	rcUserKey = "rc-user"
+	rcPassKey = "rc-pass"
+	rcUser    = "csi-rclone"
+)
+
+// newRcPassword returns a random rc password.
+func newRcPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rcCredentialsEnv sets the rc credentials of a mounter from its Secret.
+func rcCredentialsEnv(secretName string) []corev1.EnvVar {
+	fromSecret := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+			Key:                  key,
+		}}
+	}
+	return []corev1.EnvVar{
+		{Name: "RCLONE_RC_USER", ValueFrom: fromSecret(rcUserKey)},
+		{Name: "RCLONE_RC_PASS", ValueFrom: fromSecret(rcPassKey)},
+	}
+}
+
+// secretValue returns the value of key in secret, which may not have been
+// converted to Data yet.
+func secretValue(secret *corev1.Secret, key string) string {
+	if data, ok := secret.Data[key]; ok {
+		return string(data)
+	}
+	return secret.StringData[key]
+}
+
+// mounterClient returns an rc client of a running mounter pod, logged in
+// with the credentials in the mounter Secret of its volume.
+func (r Rclone) mounterClient(pod *corev1.Pod) (*rc.Client, error) {
+	addr, err := r.mounterAddress(pod)
+	if err != nil {
+		return nil, err
+	}
+	name := (&RcloneVolume{ID: pod.Labels["volumeid"]}).deploymentName()
+	secret, err := r.kubeClient.CoreV1().Secrets(r.namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("mounter pod %s has no Secret with its rc credentials", pod.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, pass := secretValue(secret, rcUserKey), secretValue(secret, rcPassKey)
+	if pass == "" {
+		// Mounters created before the rc API had credentials run without.
+		return rc.New(addr), nil
+	}
+	return rc.New(addr, rc.WithAuth(user, pass)), nil
+}
+
+// defaultUploadTimeout bounds the wait for pending VFS uploads on unmount
+// when the volume does not set uploadTimeoutKey.
+const defaultUploadTimeout = time.Minute
+
+// uploadTimeoutKey is the volume attribute holding the upload wait bound.
+const uploadTimeoutKey = "uploadTimeout"
+
+// uploadPollInterval is how often vfs/stats is asked while uploads are pending.
+var uploadPollInterval = time.Second
+
+// errUploadsPending is returned when a mounter still has VFS uploads queued
+// once the upload timeout is hit.
+var errUploadsPending = errors.New("uploads still pending")
+
+// parseUploadTimeout reads uploadTimeoutKey from volume attributes. Zero is
+// refused, as it would not leave the mounter any time to upload.
+func parseUploadTimeout(attributes map[string]string) (time.Duration, error) {
+	value, ok := attributes[uploadTimeoutKey]
+	if !ok {
+		return defaultUploadTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive duration such as 5m", uploadTimeoutKey, value)
+	}
+	return timeout, nil
+}
+
+// pendingUploads returns the uploads in progress and queued in the VFS cache
+// of the mounter of client.
+func pendingUploads(ctx context.Context, client *rc.Client) (int, error) {
+	stats, err := client.VfsStats(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	if stats.DiskCache == nil {
+		return 0, nil
+	}
+	return int(stats.DiskCache.UploadsInProgress + stats.DiskCache.UploadsQueued), nil
+}
+
+// waitForUploads blocks until the mounter name, reached through client, has
+// uploaded everything
+// written through the VFS cache, or fails with errUploadsPending after
+// timeout. A mounter whose rc API does not answer cannot be waited for, it is
+// left to flush on its own while shutting down.
+func waitForUploads(ctx context.Context, client *rc.Client, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		pending, err := pendingUploads(ctx, client)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%w after %v", errUploadsPending, timeout)
+			}
+			klog.Warningf("cannot read pending uploads of mounter %s, not waiting for them: %v", name, err)
+			return nil
+		}
+		if pending == 0 {
+			return nil
+		}
+		klog.Infof("waiting for %d uploads of mounter %s", pending, name)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %d files not uploaded after %v", errUploadsPending, pending, timeout)
+		case <-time.After(uploadPollInterval):
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pendingUploadsRc answers vfs/stats with the pending uploads in turn,
+// repeating the last one. A negative number fails the call.
+func pendingUploadsRc(t *testing.T, pending ...int) *fakeRc {
+	var mu sync.Mutex
+	return newFakeRc(t, map[string]fakeRcHandler{
+		"vfs/stats": func(map[string]interface{}) (interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			n := pending[0]
+			if len(pending) > 1 {
+				pending = pending[1:]
+			}
+			if n < 0 {
+				return nil, errors.New("rc failed")
+			}
+			return map[string]interface{}{"diskCache": map[string]int{"uploadsInProgress": n, "uploadsQueued": 0}}, nil
+		},
+	})
+}
+
+func TestWaitForUploads(t *testing.T) {
+	uploadPollInterval = 10 * time.Millisecond
+	tests := []struct {
+		name    string
+		pending []int
+		wantErr error
+	}{
+		{name: "nothing pending", pending: []int{0}},
+		{name: "uploads finish", pending: []int{3, 1, 0}},
+		{name: "uploads stuck", pending: []int{2}, wantErr: errUploadsPending},
+		{name: "rc not answering", pending: []int{-1}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := waitForUploads(context.Background(), rc.New(pendingUploadsRc(t, tc.pending...).addr), "mounter", 200*time.Millisecond)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseUploadTimeout(t *testing.T) {
+	tests := []struct {
+		attributes map[string]string
+		want       time.Duration
+		wantErr    bool
+	}{
+		{attributes: map[string]string{}, want: defaultUploadTimeout},
+		{attributes: map[string]string{uploadTimeoutKey: "5m"}, want: 5 * time.Minute},
+		{attributes: map[string]string{uploadTimeoutKey: "soon"}, wantErr: true},
+		{attributes: map[string]string{uploadTimeoutKey: "-1s"}, wantErr: true},
+		{attributes: map[string]string{uploadTimeoutKey: "0"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseUploadTimeout(tc.attributes)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tc.attributes, tc.wantErr, err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: expected %v, got %v", tc.attributes, tc.want, got)
+		}
+	}
+}
+
+func TestNodeUnpublishVolumePendingUploads(t *testing.T) {
+	uploadPollInterval = 10 * time.Millisecond
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	pv.Spec.CSI.VolumeAttributes[uploadTimeoutKey] = "100ms"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-1-abc", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-1"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	td := newTestDriver(newFakeRclone(), pv, pod)
+	rc := pendingUploadsRc(t, 1)
+	td.ns.RcloneOps.(*Rclone).rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+	targetPath := filepath.Join(t.TempDir(), "target")
+	if _, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(targetPath)); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	_, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: targetPath})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Fatalf("expected code %v, got %v (%v)", codes.DeadlineExceeded, code, err)
+	}
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected mounter to keep running while uploads are pending: %v", err)
+	}
+	if notMnt, _ := td.mounter.IsLikelyNotMountPoint(targetPath); notMnt {
+		t.Errorf("expected %s to stay mounted", targetPath)
+	}
+}
+
+func TestMounterClientLogsIn(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-1-abc", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-1"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	fake := newFakeRc(t, nil)
+	fake.password = testRcPass
+
+	td := newTestDriver(newFakeRclone(), mounterSecret("vol-1"))
+	ops := td.ns.RcloneOps.(*Rclone)
+	ops.rcAddress = func(*corev1.Pod) (string, error) { return fake.addr, nil }
+	client, err := ops.mounterClient(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.VfsStats(context.Background(), ""); err != nil {
+		t.Errorf("expected the credentials of the mounter secret accepted, got %v", err)
+	}
+	if _, err := rc.New(fake.addr).VfsStats(context.Background(), ""); err == nil {
+		t.Errorf("expected a call without credentials refused")
+	}
+
+	td = newTestDriver(newFakeRclone())
+	ops = td.ns.RcloneOps.(*Rclone)
+	ops.rcAddress = func(*corev1.Pod) (string, error) { return fake.addr, nil }
+	if _, err := ops.mounterClient(pod); err == nil {
+		t.Errorf("expected no client without the mounter secret")
+	}
+}
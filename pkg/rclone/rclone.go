@@ -31,35 +31,56 @@ type Operations interface {
 	Unmount(ctx context.Context, rcloneVolume *RcloneVolume) error
 	CleanupMountPoint(ctx context.Context, secrets, pameters map[string]string) error
 	GetVolumeById(ctx context.Context, volumeId string) (*RcloneVolume, error)
+	MounterLogs(ctx context.Context, rcloneVolume *RcloneVolume, lines int64) (string, error)
+	MounterReady(ctx context.Context, rcloneVolume *RcloneVolume) (bool, error)
+	Remount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error
+	CheckRemote(ctx context.Context, remote, remotePath, rcloneConfigPath string) error
 }
 
+// mounterImage is the image of the mounters, its rclone is at least
+// minRcloneVersion and bisyncRcloneVersion. rclone serve nfs needs v1.65 and
+// the credential rotation rc fscache/clear.
+const mounterImage = "rclone/rclone:1.68.2"
+
+// errVolumeNotFound is returned when no PersistentVolume has the requested volume handle.
+var errVolumeNotFound = errors.New("volume not found")
+
 type Rclone struct {
 	execute    exec.Interface
-	kubeClient *kubernetes.Clientset
+	kubeClient kubernetes.Interface
 	namespace  string
+	nodeID     string
+	// rcAddress finds the rc endpoint of a mounter pod, rcAddress by default.
+	rcAddress func(pod *corev1.Pod) (string, error)
+	// cacheDir holds the host VFS caches of volumes on the node, at the
+	// same path in the plugin and on the host. Empty disables host caches.
+	cacheDir string
+	// volumes caches the PVs and mounter Deployments the background loops
+	// look up.
+	volumes *volumeCache
 }
 
 type RcloneVolume struct {
 	Remote     string
 	RemotePath string
 	ID         string
+	// UploadTimeout bounds the wait for pending VFS uploads on unmount, zero
+	// when the volume is not known and defaultUploadTimeout applies.
+	UploadTimeout time.Duration
+	// Multi is set when the volume is a union or combine of remotes.
+	Multi *multiRemote
+	// Cache is set when the volume places or sizes its VFS cache.
+	Cache *vfsCache
 }
 
-func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, parameters map[string]string) error {
-	//mountingTargetPath := filepath.Dir(targetPath)
-	//mountingFolderName := filepath.Base(targetPath)
-	mountArgs := []string{}
-	//containerMountPath := fmt.Sprintf("/mount/%s", mountingFolderName)
-	mountArgs = append(mountArgs, "mount")
-	mountArgs = append(mountArgs, fmt.Sprintf("%s:/%s", rcloneVolume.Remote, rcloneVolume.RemotePath))
-	mountArgs = append(mountArgs, targetPath)
+// defaultMountFlags are the rclone mount flags used unless a volume overrides them.
+func defaultMountFlags(rcloneVolume *RcloneVolume) map[string]string {
 	defaultFlags := map[string]string{}
 	defaultFlags["rc"] = ""
 	defaultFlags["rc-addr"] = "0.0.0.0:5572"
 	defaultFlags["rc-enable-metrics"] = ""
 	defaultFlags["rc-web-gui"] = ""
 	defaultFlags["rc-web-gui-no-open-browser"] = ""
-	defaultFlags["rc-no-auth"] = ""
 	defaultFlags["volname"] = rcloneVolume.ID
 	defaultFlags["devname"] = rcloneVolume.ID
 	defaultFlags["cache-info-age"] = "72h"
@@ -71,6 +92,21 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 
 	defaultFlags["allow-other"] = "true"
 	defaultFlags["allow-non-empty"] = "true"
+	if rcloneVolume.Cache != nil {
+		for k, v := range rcloneVolume.Cache.mountFlags(mounterCacheDir) {
+			defaultFlags[k] = v
+		}
+	}
+	return defaultFlags
+}
+
+// buildMountArgs returns the rclone mount command line for rcloneVolume, with
+// parameters overriding defaultFlags.
+func buildMountArgs(rcloneVolume *RcloneVolume, targetPath string, defaultFlags, parameters map[string]string) []string {
+	mountArgs := []string{}
+	mountArgs = append(mountArgs, "mount")
+	mountArgs = append(mountArgs, fmt.Sprintf("%s:/%s", rcloneVolume.Remote, rcloneVolume.RemotePath))
+	mountArgs = append(mountArgs, targetPath)
 	// Add default flags
 	for k, v := range defaultFlags {
 		// Exclude overriden flags
@@ -91,6 +127,19 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 			mountArgs = append(mountArgs, fmt.Sprintf("--%s", k))
 		}
 	}
+	return mountArgs
+}
+
+func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, parameters map[string]string) error {
+	flags := defaultMountFlags(rcloneVolume)
+	// The mounter pod names its mount, so that its PreStop hook leaves alone
+	// a mount repaired by the pod replacing it.
+	flags["devname"] = rcloneVolume.ID + ":$(POD_NAME)"
+	mountArgs := buildMountArgs(rcloneVolume, targetPath, flags, parameters)
+	devname := rcloneVolume.ID + ":$POD_NAME"
+	if v, ok := parameters["devname"]; ok {
+		devname = v
+	}
 
 	// create target, os.Mkdirall is noop if it exists
 	err := os.MkdirAll(targetPath, 0750)
@@ -98,16 +147,134 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 		return err
 	}
 
-	//deploymentName := fmt.Sprintf("%s%d", rcloneVolume.deploymentName(), uuid.New().ID())
-	deploymentName := rcloneVolume.deploymentName()
-	h := sha256.New()
-	h.Write([]byte(rcloneConfigData))
-	secretHash := hex.EncodeToString(h.Sum(nil))[:63]
 	mountPropagation := corev1.MountPropagationBidirectional
 	hostPathCreate := corev1.HostPathDirectoryOrCreate
+	volumes := []corev1.Volume{
+		{
+			Name: "mount",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: targetPath,
+					Type: &hostPathCreate,
+				},
+			},
+		},
+	}
+	container := corev1.Container{
+		Name:    "rclone-mounter",
+		Image:   mounterImage,
+		Command: []string{"rclone"},
+		Args:    mountArgs,
+		Env: []corev1.EnvVar{
+			{
+				Name:      "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+			},
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "api",
+				ContainerPort: 5572,
+				Protocol:      "TCP",
+			},
+		},
+		Lifecycle: &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{Command: []string{"sh", "-c", preStopUnmount(devname, targetPath)}},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:             "mount",
+				MountPath:        targetPath,
+				MountPropagation: &mountPropagation,
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{
+				Add: []corev1.Capability{"SYS_ADMIN"},
+			},
+			Privileged: pointer.BoolPtr(true),
+		},
+		LivenessProbe: &corev1.Probe{
+			InitialDelaySeconds: 1,
+			TimeoutSeconds:      5,
+			PeriodSeconds:       10,
+			SuccessThreshold:    1,
+			FailureThreshold:    10,
+			Handler: corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"sh", "-c", fmt.Sprintf("ls -lah %s", targetPath)},
+				},
+			},
+		},
+		ReadinessProbe: rcReadinessProbe(),
+	}
+	return r.applyMounter(rcloneVolume, targetPath, rcloneConfigData, volumes, container, nil, false)
+}
+
+// preStopUnmount is the PreStop command of a FUSE mounter: it unmounts
+// targetPath only while the mount there is its own, named devname.
+func preStopUnmount(devname, targetPath string) string {
+	return fmt.Sprintf(`if awk -v d="%s" -v t=%q '$1 == d && $2 == t { found = 1 } END { exit !found }' /proc/mounts; then umount %q; fi`,
+		devname, targetPath, targetPath)
+}
+
+// targetPathAnnotation records on a mounter Deployment the publish target it
+// serves, which the node reconciler checks against the pods of the node.
+const targetPathAnnotation = "csi-rclone/target-path"
+
+// mounterConfigDir is where mounters find their writable rclone config.
+const mounterConfigDir = "/root/.config/rclone"
+
+// configHash labels mounters and their Secret with the config they run with.
+func configHash(rcloneConfigData string) string {
+	h := sha256.New()
+	h.Write([]byte(rcloneConfigData))
+	return hex.EncodeToString(h.Sum(nil))[:63]
+}
+
+// rcReadinessProbe reports a mounter ready once its rc API listens. The API
+// needs the credentials of the mounter, so the probe does not call it.
+func rcReadinessProbe() *corev1.Probe {
+	return &corev1.Probe{
+		InitialDelaySeconds: 1,
+		TimeoutSeconds:      5,
+		PeriodSeconds:       10,
+		SuccessThreshold:    1,
+		FailureThreshold:    10,
+		Handler: corev1.Handler{
+			TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(5572)},
+		},
+	}
+}
+
+// applyMounter creates the mounter Secret and Deployment of rcloneVolume,
+// running container with volumes and the rclone config, unless they already
+// exist for the same config. The Deployment and its pods get annotations,
+// the pods run in the host network with hostNetwork.
+func (r *Rclone) applyMounter(rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, volumes []corev1.Volume, container corev1.Container, annotations map[string]string, hostNetwork bool) error {
+	//deploymentName := fmt.Sprintf("%s%d", rcloneVolume.deploymentName(), uuid.New().ID())
+	deploymentName := rcloneVolume.deploymentName()
+	if cache := rcloneVolume.Cache; cache != nil {
+		hostDir := ""
+		if cache.Storage == cacheStorageHost {
+			var err error
+			if hostDir, err = r.hostCacheDir(rcloneVolume); err != nil {
+				return err
+			}
+		}
+		if volume := cache.volume(hostDir); volume != nil {
+			volumes = append(volumes, *volume)
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      volume.Name,
+				MountPath: mounterCacheDir,
+			})
+		}
+	}
 	pvDeploymentLabels := map[string]string{
 		"volumeid": rcloneVolume.ID,
-		"hash":     secretHash,
+		"hash":     configHash(rcloneConfigData),
 	}
 
 	secret, err := r.kubeClient.CoreV1().Secrets(r.namespace).Get(deploymentName, metav1.GetOptions{})
@@ -115,7 +282,18 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 		return err
 	}
 
-	if !reflect.DeepEqual(secret.Labels, pvDeploymentLabels) {
+	if secret == nil || !reflect.DeepEqual(secret.Labels, pvDeploymentLabels) {
+		// Running mounters keep their rc password, the new Secret takes it
+		// over.
+		rcPass := ""
+		if secret != nil {
+			rcPass = secretValue(secret, rcPassKey)
+		}
+		if rcPass == "" {
+			if rcPass, err = newRcPassword(); err != nil {
+				return err
+			}
+		}
 		err = r.kubeClient.CoreV1().Secrets(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
 		if err != nil && !k8serrors.IsNotFound(err) {
 			return err
@@ -129,6 +307,8 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 			},
 			StringData: map[string]string{
 				"rclone.conf": rcloneConfigData,
+				rcUserKey:     rcUser,
+				rcPassKey:     rcPass,
 			},
 			Type: corev1.SecretTypeOpaque,
 		})
@@ -143,18 +323,70 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 		return err
 	}
 
-	if !reflect.DeepEqual(deployment.Labels, pvDeploymentLabels) {
+	if deployment == nil || !reflect.DeepEqual(deployment.Labels, pvDeploymentLabels) {
 		err = r.kubeClient.AppsV1().Deployments(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
 		if err != nil && !k8serrors.IsNotFound(err) {
 			return err
 		}
 
 		r.kubeClient.AppsV1().Deployments(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
+		// rclone writes refreshed OAuth tokens back to its config, so it runs
+		// with a writable copy of the Secret, kept in memory.
+		volumes = append(volumes, corev1.Volume{
+			Name: "config-secret",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: deploymentName,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  "rclone.conf",
+							Path: "rclone.conf",
+							Mode: pointer.Int32Ptr(0600),
+						},
+					},
+					Optional: pointer.BoolPtr(false),
+				},
+			},
+		}, corev1.Volume{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory},
+			},
+		})
+		configMount := corev1.VolumeMount{
+			Name:      "config",
+			MountPath: mounterConfigDir,
+		}
+		container.VolumeMounts = append([]corev1.VolumeMount{configMount}, container.VolumeMounts...)
+		container.Env = append(container.Env, rcCredentialsEnv(deploymentName)...)
+		initContainer := corev1.Container{
+			Name:    "rclone-config",
+			Image:   container.Image,
+			Command: []string{"sh", "-c", fmt.Sprintf("cp /secret/rclone.conf %[1]s/rclone.conf && chmod 600 %[1]s/rclone.conf", mounterConfigDir)},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      "config-secret",
+					MountPath: "/secret",
+					ReadOnly:  true,
+				},
+				configMount,
+			},
+		}
+
+		deploymentAnnotations := map[string]string{targetPathAnnotation: targetPath}
+		for k, v := range annotations {
+			deploymentAnnotations[k] = v
+		}
+		dnsPolicy := corev1.DNSClusterFirst
+		if hostNetwork {
+			dnsPolicy = corev1.DNSClusterFirstWithHostNet
+		}
 		_, err = r.kubeClient.AppsV1().Deployments(r.namespace).Create(&v1.Deployment{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      deploymentName,
-				Namespace: r.namespace,
-				Labels:    pvDeploymentLabels,
+				Name:        deploymentName,
+				Namespace:   r.namespace,
+				Labels:      pvDeploymentLabels,
+				Annotations: deploymentAnnotations,
 			},
 			Spec: v1.DeploymentSpec{
 				Replicas: pointer.Int32Ptr(1),
@@ -163,103 +395,19 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 				},
 				Template: corev1.PodTemplateSpec{
 					ObjectMeta: metav1.ObjectMeta{
-						Labels: pvDeploymentLabels,
+						Labels:      pvDeploymentLabels,
+						Annotations: annotations,
 					},
 					Spec: corev1.PodSpec{
-						NodeName:                      os.Getenv("NODE_ID"),
+						NodeName:                      r.nodeID,
+						HostNetwork:                   hostNetwork,
+						DNSPolicy:                     dnsPolicy,
 						RestartPolicy:                 corev1.RestartPolicyAlways,
 						PriorityClassName:             "system-cluster-critical",
 						TerminationGracePeriodSeconds: pointer.Int64Ptr(10),
-						Volumes: []corev1.Volume{
-							{
-								Name: "mount",
-								VolumeSource: corev1.VolumeSource{
-									HostPath: &corev1.HostPathVolumeSource{
-										Path: targetPath,
-										Type: &hostPathCreate,
-									},
-								},
-							},
-							{
-								Name: "config",
-								VolumeSource: corev1.VolumeSource{
-									Secret: &corev1.SecretVolumeSource{
-										SecretName: deploymentName,
-										Items: []corev1.KeyToPath{
-											{
-												Key:  "rclone.conf",
-												Path: "rclone.conf",
-												Mode: pointer.Int32Ptr(0777),
-											},
-										},
-										Optional: pointer.BoolPtr(false),
-									},
-								},
-							},
-						},
-						Containers: []corev1.Container{
-							{
-								Name:    "rclone-mounter",
-								Image:   "rclone/rclone:1.59.2",
-								Command: []string{"rclone"},
-								Args:    mountArgs,
-								Ports: []corev1.ContainerPort{
-									{
-										Name:          "api",
-										ContainerPort: 5572,
-										Protocol:      "TCP",
-									},
-								},
-								Lifecycle: &corev1.Lifecycle{
-									PreStop: &corev1.Handler{
-										Exec: &corev1.ExecAction{Command: []string{"sh", "-c", fmt.Sprintf(
-											"umount", targetPath)}},
-									},
-								},
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "config",
-										MountPath: "/root/.config/rclone/",
-									},
-									{
-										Name:             "mount",
-										MountPath:        targetPath,
-										MountPropagation: &mountPropagation,
-									},
-								},
-								SecurityContext: &corev1.SecurityContext{
-									Capabilities: &corev1.Capabilities{
-										Add: []corev1.Capability{"SYS_ADMIN"},
-									},
-									Privileged: pointer.BoolPtr(true),
-								},
-								LivenessProbe: &corev1.Probe{
-									InitialDelaySeconds: 1,
-									TimeoutSeconds:      5,
-									PeriodSeconds:       10,
-									SuccessThreshold:    1,
-									FailureThreshold:    10,
-									Handler: corev1.Handler{
-										Exec: &corev1.ExecAction{
-											Command: []string{"sh", "-c", fmt.Sprintf("ls -lah %s", targetPath)},
-										},
-									},
-								},
-								ReadinessProbe: &corev1.Probe{
-									InitialDelaySeconds: 1,
-									TimeoutSeconds:      5,
-									PeriodSeconds:       10,
-									SuccessThreshold:    1,
-									FailureThreshold:    10,
-									Handler: corev1.Handler{
-										HTTPGet: &corev1.HTTPGetAction{
-											Path: "/metrics",
-											Port: intstr.FromInt(5572),
-										},
-									},
-								},
-							},
-						},
+						Volumes:                       volumes,
+						InitContainers:                []corev1.Container{initContainer},
+						Containers:                    []corev1.Container{container},
 					},
 				},
 				Strategy: v1.DeploymentStrategy{
@@ -274,13 +422,13 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 	return nil
 }
 
-func ListSecretsByLabel(client *kubernetes.Clientset, namespace string, lab map[string]string) (*corev1.SecretList, error) {
+func ListSecretsByLabel(client kubernetes.Interface, namespace string, lab map[string]string) (*corev1.SecretList, error) {
 	return client.CoreV1().Secrets(namespace).List(metav1.ListOptions{
 		LabelSelector: labels.FormatLabels(lab),
 	})
 }
 
-func DeleteSecretsByLabel(client *kubernetes.Clientset, namespace string, lab map[string]string) error {
+func DeleteSecretsByLabel(client kubernetes.Interface, namespace string, lab map[string]string) error {
 	//propagation := metav1.DeletePropagationBackground
 	return client.CoreV1().Secrets(namespace).DeleteCollection(&metav1.DeleteOptions{
 		//PropagationPolicy: &propagation,
@@ -290,7 +438,7 @@ func DeleteSecretsByLabel(client *kubernetes.Clientset, namespace string, lab ma
 		})
 }
 
-func DeleteDeploymentByLabel(client *kubernetes.Clientset, namespace string, lab map[string]string) error {
+func DeleteDeploymentByLabel(client kubernetes.Interface, namespace string, lab map[string]string) error {
 	propagation := metav1.DeletePropagationForeground
 	return client.AppsV1().Deployments(namespace).DeleteCollection(&metav1.DeleteOptions{
 		PropagationPolicy: &propagation,
@@ -326,14 +474,29 @@ func (r Rclone) DeleteVol(ctx context.Context, rcloneVolume *RcloneVolume, rclon
 	})
 }
 
+// Unmount waits for the mounter to upload pending writes, then deletes it. The
+// PreStop hook unmounts the target so rclone exits cleanly.
 func (r Rclone) Unmount(ctx context.Context, rcloneVolume *RcloneVolume) error {
+	if err := r.flushUploads(ctx, rcloneVolume); err != nil {
+		return err
+	}
+
 	deploymentName := rcloneVolume.deploymentName()
 	err := r.kubeClient.AppsV1().Deployments(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
-	if err != nil {
+	if err != nil && !k8serrors.IsNotFound(err) {
 		return err
 	}
 
-	return r.kubeClient.CoreV1().Secrets(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
+	err = r.kubeClient.CoreV1().Secrets(r.namespace).Delete(deploymentName, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	// The volume leaves the node, so does its cache. Files the exiting
+	// mounter still writes are collected by reconcileNodeMounters.
+	if err := r.removeCache(rcloneVolume.ID); err != nil {
+		klog.Warningf("removing the VFS cache of volume %s: %v", rcloneVolume.ID, err)
+	}
+	return nil
 
 	/*	labelQuery := map[string]string{
 			"volumeid": rcloneVolume.ID,
@@ -345,46 +508,162 @@ func (r Rclone) Unmount(ctx context.Context, rcloneVolume *RcloneVolume) error {
 		return DeleteSecretsByLabel(r.kubeClient, r.namespace, labelQuery)*/
 }
 
+// Remount restarts the mounter of rcloneVolume after its mount went stale.
+// The Deployment replaces the deleted pods, and the new one mounts the target
+// again from the config in the mounter Secret.
+func (r Rclone) Remount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error {
+	_, err := r.kubeClient.AppsV1().Deployments(r.namespace).Get(rcloneVolume.deploymentName(), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return fmt.Errorf("volume %s has no mounter to restart: %w", rcloneVolume.ID, errVolumeNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": rcloneVolume.ID}))
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		klog.Infof("restarting mounter %s for the stale mount of volume %s", pod.Name, rcloneVolume.ID)
+		err := r.kubeClient.CoreV1().Pods(r.namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushUploads waits for the VFS uploads of the running mounter of
+// rcloneVolume, if there is one.
+func (r Rclone) flushUploads(ctx context.Context, rcloneVolume *RcloneVolume) error {
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": rcloneVolume.ID}))
+	if err != nil {
+		return err
+	}
+	timeout := rcloneVolume.UploadTimeout
+	if timeout == 0 {
+		timeout = defaultUploadTimeout
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		client, err := r.mounterClient(pod)
+		if err != nil {
+			klog.Warningf("not waiting for uploads of volume %s: %v", rcloneVolume.ID, err)
+			continue
+		}
+		if err := waitForUploads(ctx, client, pod.Name, timeout); err != nil {
+			return fmt.Errorf("volume %s: %w", rcloneVolume.ID, err)
+		}
+	}
+	return nil
+}
+
+// mounterAddress returns the rc endpoint of a mounter pod.
+func (r Rclone) mounterAddress(pod *corev1.Pod) (string, error) {
+	if r.rcAddress == nil {
+		return rcAddress(pod)
+	}
+	return r.rcAddress(pod)
+}
+
 func (r Rclone) CleanupMountPoint(ctx context.Context, secrets, pameters map[string]string) error {
 	//TODO implement me
 	panic("implement me")
 }
 
 func (r Rclone) GetVolumeById(ctx context.Context, volumeId string) (*RcloneVolume, error) {
-	pvs, err := r.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	pv, err := r.volumes.persistentVolume(volumeId)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, pv := range pvs.Items {
-		if pv.Spec.CSI == nil {
-			continue
+	multi, err := parseMultiRemote(pv.Spec.CSI.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+	remote := pv.Spec.CSI.VolumeAttributes["remote"]
+	path := pv.Spec.CSI.VolumeAttributes["path"]
+	if multi != nil && remote == "" {
+		remote = multiRemoteName
+	}
+	if remote == "" {
+		return nil, errors.New("Missing remote volume attribute")
+	}
+	if path == "" && multi == nil {
+		return nil, errors.New("Missing path volume attribute")
+	}
+	uploadTimeout, err := parseUploadTimeout(pv.Spec.CSI.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := parseCacheOptions(pv.Spec.CSI.VolumeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RcloneVolume{
+		Remote:        remote,
+		RemotePath:    path,
+		ID:            volumeId,
+		UploadTimeout: uploadTimeout,
+		Multi:         multi,
+		Cache:         cache,
+	}, nil
+}
+
+// MounterLogs returns the last lines logged by the mounter of rcloneVolume,
+// falling back to the previous container when the current one has not logged
+// anything yet (for example while crash-looping).
+func (r Rclone) MounterLogs(ctx context.Context, rcloneVolume *RcloneVolume, lines int64) (string, error) {
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": rcloneVolume.ID}))
+	if err != nil {
+		return "", err
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("no mounter pod found for volume %s", rcloneVolume.ID)
+	}
+
+	pod := pods.Items[0]
+	for _, previous := range []bool{false, true} {
+		out, err := r.kubeClient.CoreV1().Pods(r.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			TailLines: &lines,
+			Previous:  previous,
+		}).Do().Raw()
+		if err == nil && len(strings.TrimSpace(string(out))) > 0 {
+			return string(out), nil
 		}
-		if pv.Spec.CSI.VolumeHandle == volumeId {
-			remote := pv.Spec.CSI.VolumeAttributes["remote"]
-			if remote == "" {
-				return nil, errors.New("Missing remote volume attribute")
-			}
-			path := pv.Spec.CSI.VolumeAttributes["path"]
-			if path == "" {
-				return nil, errors.New("Missing path volume attribute")
-			}
+	}
+	return "", nil
+}
+
+// getPersistentVolume looks up the CSI PersistentVolume with the given volume handle.
+func getPersistentVolume(kubeClient kubernetes.Interface, volumeId string) (*corev1.PersistentVolume, error) {
+	pvs, err := kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
 
-			return &RcloneVolume{
-				Remote:     remote,
-				RemotePath: path,
-				ID:         volumeId,
-			}, nil
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volumeId {
+			return pv, nil
 		}
 	}
-	return nil, fmt.Errorf("volume %s not found", volumeId)
+	return nil, fmt.Errorf("volume %s: %w", volumeId, errVolumeNotFound)
 }
 
-func NewRclone(kubeClient *kubernetes.Clientset) Operations {
+func NewRclone(kubeClient kubernetes.Interface, execute exec.Interface, nodeID string) Operations {
+	namespace := os.Getenv("POD_NAMESPACE")
 	return &Rclone{
-		execute:    exec.New(),
+		execute:    execute,
 		kubeClient: kubeClient,
-		namespace:  os.Getenv("POD_NAMESPACE"),
+		namespace:  namespace,
+		nodeID:     nodeID,
+		rcAddress:  rcAddress,
+		volumes:    newVolumeCache(kubeClient, namespace, nodeID),
 	}
 }
 
@@ -404,8 +683,9 @@ func (r *Rclone) command(cmd, remote, remotePath string, flags map[string]string
 	klog.Infof("executing %s command cmd=rclone, remote=%s:%s", cmd, remote, remotePath)
 	out, err := r.execute.Command("rclone", args...).CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%s failed: %v cmd: 'rclone' remote: ':%s:%s' output: %q",
-			cmd, err, remote, remotePath, string(out))
+		output := redactor.Scrub(string(out))
+		return newRcloneError(fmt.Sprintf("%s failed: %v cmd: 'rclone' remote: ':%s:%s' output: %q",
+			cmd, err, remote, remotePath, output), err, output)
 	}
 
 	return nil
@@ -0,0 +1,191 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// mountReadyTimeout bounds the wait for a new mount to serve, unless the
+// deadline of the call is earlier.
+var mountReadyTimeout = time.Minute
+
+// mountReadyInterval is how often a new mount is checked.
+var mountReadyInterval = 500 * time.Millisecond
+
+// errMountNotReady is returned when a new mount does not serve in time or its
+// mounter fails.
+var errMountNotReady = errors.New("mount not ready")
+
+// mounterFailureReasons are container waiting reasons a mounter does not
+// recover from while a publish waits for it.
+var mounterFailureReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// MounterReady tells whether a mounter pod of rcloneVolume is running and
+// its rc API answers for the VFS of the mount. It fails when the mounter pods
+// crash or cannot start.
+func (r Rclone) MounterReady(ctx context.Context, rcloneVolume *RcloneVolume) (bool, error) {
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": rcloneVolume.ID}))
+	if err != nil {
+		return false, err
+	}
+	var failure error
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if err := mounterFailure(pod); err != nil {
+			failure = err
+			continue
+		}
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		client, err := r.mounterClient(pod)
+		if err != nil {
+			continue
+		}
+		// A mounter only has a VFS once rclone mounted the remote.
+		if _, err := client.VfsStats(ctx, ""); err == nil {
+			return true, nil
+		}
+	}
+	return false, failure
+}
+
+// mounterFailure returns why pod will not serve a mount, nil when it may
+// still come up.
+func mounterFailure(pod *corev1.Pod) error {
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Errorf("mounter pod %s failed: %s %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+	}
+	for _, c := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if waiting := c.State.Waiting; waiting != nil && mounterFailureReasons[waiting.Reason] {
+			return fmt.Errorf("mounter pod %s: container %s is in %s: %s", pod.Name, c.Name, waiting.Reason, waiting.Message)
+		}
+	}
+	return nil
+}
+
+// waitForMount blocks until the mount of rcloneVolume at targetPath serves:
+// ops reports its mounter ready, the target is a mount point and its root can
+// be listed. It fails with errMountNotReady after mountReadyTimeout or when
+// the mounter fails.
+func (ns *nodeServer) waitForMount(ctx context.Context, ops Operations, rcloneVolume *RcloneVolume, targetPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, mountReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(mountReadyInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	state := "mounter not started"
+	for {
+		ready, err := ops.MounterReady(ctx, rcloneVolume)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("%w: volume %s: %v", errMountNotReady, rcloneVolume.ID, err)
+		}
+		current := "mounter not ready"
+		if ready {
+			if notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath); err != nil || notMnt {
+				current = "target not mounted"
+			} else if err := listRoot(ctx, targetPath); err != nil {
+				current = fmt.Sprintf("listing the target failed: %v", err)
+			} else {
+				return nil
+			}
+		}
+		// Checks cut short by the deadline say nothing about the mount.
+		if ctx.Err() == nil {
+			state = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w after %v: volume %s: %s", errMountNotReady, time.Since(start).Round(time.Second), rcloneVolume.ID, state)
+		case <-ticker.C:
+		}
+	}
+}
+
+// rootListings runs the listings of listRoot.
+var rootListings = newTargetProbes()
+
+// listRoot reads the first entry of dir, giving up when ctx is done. A hung
+// FUSE mount blocks the read, which later listings of dir wait for rather
+// than starting their own.
+func listRoot(ctx context.Context, dir string) error {
+	return rootListings.run(ctx, dir, func() error {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	})
+}
+
+// targetProbe is a probe of a target in flight.
+type targetProbe struct {
+	done chan struct{}
+	err  error
+}
+
+// targetProbes runs blocking filesystem calls on targets, at most one per
+// target at a time. A call hung on a dead mount is shared by the checks that
+// come after it, so each target leaves at most one goroutine behind.
+type targetProbes struct {
+	mu      sync.Mutex
+	running map[string]*targetProbe
+}
+
+func newTargetProbes() *targetProbes {
+	return &targetProbes{running: map[string]*targetProbe{}}
+}
+
+// run returns the result of probe for target, or of the probe of target
+// already running, giving up when ctx is done.
+func (p *targetProbes) run(ctx context.Context, target string, probe func() error) error {
+	p.mu.Lock()
+	call, ok := p.running[target]
+	if !ok {
+		call = &targetProbe{done: make(chan struct{})}
+		p.running[target] = call
+		go func() {
+			call.err = probe()
+			p.mu.Lock()
+			delete(p.running, target)
+			p.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inFlight returns the number of probes running.
+func (p *targetProbes) inFlight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.running)
+}
@@ -0,0 +1,131 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWaitForMount(t *testing.T) {
+	mountReadyTimeout = 200 * time.Millisecond
+	mountReadyInterval = 10 * time.Millisecond
+	defer func() {
+		mountReadyTimeout = time.Minute
+		mountReadyInterval = 500 * time.Millisecond
+	}()
+
+	mounterPod := func(status corev1.PodStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-1-abc", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-1"}},
+			Status:     status,
+		}
+	}
+	running := corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.7"}
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		noRc      bool
+		notMount  bool
+		wantState string
+	}{
+		{name: "serving", pod: mounterPod(running)},
+		{name: "no mounter pod", wantState: "mounter not ready"},
+		{
+			name:      "pending",
+			pod:       mounterPod(corev1.PodStatus{Phase: corev1.PodPending}),
+			wantState: "mounter not ready",
+		},
+		{name: "rc not answering", pod: mounterPod(running), noRc: true, wantState: "mounter not ready"},
+		{name: "target not mounted", pod: mounterPod(running), notMount: true, wantState: "target not mounted"},
+		{
+			name: "crash looping",
+			pod: mounterPod(corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "rclone-mounter",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off 10s"}},
+				}},
+			}),
+			wantState: "rclone-mounter is in CrashLoopBackOff",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), mounterSecret("vol-1"))
+			if tc.pod != nil {
+				if _, err := td.kubeClient.CoreV1().Pods(testNamespace).Create(tc.pod); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.noRc {
+				td.ns.RcloneOps.(*Rclone).rcAddress = func(*corev1.Pod) (string, error) { return "127.0.0.1:1", nil }
+			}
+			targetPath := t.TempDir()
+			if !tc.notMount {
+				td.mounter.Mount("rclone", targetPath, "fuse.rclone", nil)
+			}
+
+			err := td.ns.waitForMount(context.Background(), td.ns.RcloneOps, &RcloneVolume{ID: "vol-1"}, targetPath)
+			if tc.wantState == "" {
+				if err != nil {
+					t.Fatalf("expected the mount ready, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errMountNotReady) || !strings.Contains(err.Error(), tc.wantState) {
+				t.Fatalf("expected %v with %q, got %v", errMountNotReady, tc.wantState, err)
+			}
+			if code := status.Code(statusError(err, codes.Internal)); code != codes.DeadlineExceeded {
+				t.Errorf("expected %v, got %v", codes.DeadlineExceeded, code)
+			}
+		})
+	}
+}
+
+func TestTargetProbes(t *testing.T) {
+	p := newTargetProbes()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	started := 0
+	hung := func() error {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		<-release
+		return nil
+	}
+
+	// Checks of a hung target share its probe.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := p.run(ctx, "/target", hung); err != context.DeadlineExceeded {
+			t.Errorf("expected the hung probe to time out, got %v", err)
+		}
+		cancel()
+	}
+	if err := p.run(context.Background(), "/other", func() error { return errors.New("stale") }); err == nil || err.Error() != "stale" {
+		t.Errorf("expected the probe error of another target, got %v", err)
+	}
+	mu.Lock()
+	if started != 1 {
+		t.Errorf("expected one probe of the hung target, got %d", started)
+	}
+	mu.Unlock()
+
+	close(release)
+	if err := p.run(context.Background(), "/target", hung); err != nil {
+		t.Errorf("expected the probe to finish, got %v", err)
+	}
+	if n := p.inFlight(); n != 0 {
+		t.Errorf("expected no probe left running, got %d", n)
+	}
+}
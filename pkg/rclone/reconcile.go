@@ -0,0 +1,111 @@
+package rclone
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
+)
+
+// collectOrphanMounters deletes mounter Deployments and Secrets whose volume
+// no longer has a PersistentVolume, for example because the node they run on
+// went away before NodeUnpublishVolume was called.
+func (r *Rclone) collectOrphanMounters(ctx context.Context) error {
+	deployments, err := r.kubeClient.AppsV1().Deployments(r.namespace).List(metav1.ListOptions{LabelSelector: "volumeid"})
+	if err != nil {
+		return err
+	}
+	pvs, err := r.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	volumes := map[string]bool{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == DriverName {
+			volumes[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+
+	for _, deployment := range deployments.Items {
+		volumeId := deployment.Labels["volumeid"]
+		if volumes[volumeId] {
+			continue
+		}
+		klog.Infof("deleting mounter %s, volume %s has no PersistentVolume", deployment.Name, volumeId)
+		if err := r.Unmount(ctx, &RcloneVolume{ID: volumeId}); err != nil {
+			klog.Errorf("deleting mounter %s: %v", deployment.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcileNodeMounters deletes mounters on this node, FUSE and serving ones,
+// whose target belongs to a pod that is no longer scheduled here, which happens when kubelet removed
+// the pod while the node plugin was down, and unmounts their target. Host
+// caches of volumes without a mounter left are removed.
+func (r *Rclone) reconcileNodeMounters(ctx context.Context, mounter mount.Interface) error {
+	deployments, err := r.kubeClient.AppsV1().Deployments(r.namespace).List(metav1.ListOptions{LabelSelector: "volumeid"})
+	if err != nil {
+		return err
+	}
+	pods, err := r.kubeClient.CoreV1().Pods(corev1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", r.nodeID).String(),
+	})
+	if err != nil {
+		return err
+	}
+	podUIDs := map[string]bool{}
+	for _, pod := range pods.Items {
+		podUIDs[string(pod.UID)] = true
+	}
+
+	mounted := map[string]bool{}
+	for _, deployment := range deployments.Items {
+		spec := deployment.Spec.Template.Spec
+		if spec.NodeName != r.nodeID {
+			continue
+		}
+		volume := &RcloneVolume{ID: deployment.Labels["volumeid"]}
+		// Mounters created before the annotation are FUSE mounters, which
+		// mount their target as a hostPath.
+		targetPath := deployment.Annotations[targetPathAnnotation]
+		for _, v := range spec.Volumes {
+			if targetPath == "" && v.Name == "mount" && v.HostPath != nil {
+				targetPath = v.HostPath.Path
+			}
+		}
+		podUID := podUIDFromTargetPath(targetPath)
+		if podUID == "" || podUIDs[podUID] {
+			mounted[volume.normalizedVolumeId()] = true
+			continue
+		}
+
+		klog.Infof("deleting mounter %s, pod %s is no longer on node %s", deployment.Name, podUID, r.nodeID)
+		err := r.Unmount(ctx, volume)
+		if unmountErr := util.UnmountPath(targetPath, mounter); err == nil {
+			err = unmountErr
+		}
+		if err != nil {
+			klog.Errorf("deleting mounter %s: %v", deployment.Name, err)
+		}
+	}
+	return r.collectCaches(mounted)
+}
+
+// podUIDFromTargetPath returns the pod UID of a kubelet publish target such as
+// /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount.
+func podUIDFromTargetPath(targetPath string) string {
+	parts := strings.Split(filepath.Clean(targetPath), string(filepath.Separator))
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "pods" && parts[i+2] == "volumes" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package rclone
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCollectOrphanMounters(t *testing.T) {
+	td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"))
+	ops := td.ns.RcloneOps.(*Rclone)
+	for _, id := range []string{"vol-1", "vol-2"} {
+		vol := &RcloneVolume{ID: id, Remote: "minio", RemotePath: "base/" + id}
+		if err := ops.Mount(context.Background(), vol, filepath.Join(t.TempDir(), id), testRcloneConf, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ops.collectOrphanMounters(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected mounter of vol-1 to be kept: %v", err)
+	}
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-2", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected orphaned mounter of vol-2 to be deleted")
+	}
+	if _, err := td.kubeClient.CoreV1().Secrets(testNamespace).Get("rclone-mounter-vol-2", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected orphaned secret of vol-2 to be deleted")
+	}
+}
+
+func TestReconcileNodeMounters(t *testing.T) {
+	running := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: types.UID("uid-running")},
+		Spec:       corev1.PodSpec{NodeName: testNodeID},
+	}
+	td := newTestDriver(newFakeRclone(), running)
+	ops := td.ns.RcloneOps.(*Rclone)
+	kubelet := t.TempDir()
+	target := func(uid string) string {
+		return filepath.Join(kubelet, "pods", uid, "volumes", "kubernetes.io~csi", "pv", "mount")
+	}
+	mounts := map[string]string{"vol-1": target("uid-running"), "vol-2": target("uid-gone")}
+	for id, targetPath := range mounts {
+		vol := &RcloneVolume{ID: id, Remote: "minio", RemotePath: "base/" + id}
+		if err := ops.Mount(context.Background(), vol, targetPath, testRcloneConf, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A served volume of a removed pod, mounted over NFS.
+	served := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-3-abc", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-3"}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "10.0.0.8",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	if _, err := td.kubeClient.CoreV1().Pods(testNamespace).Create(served); err != nil {
+		t.Fatal(err)
+	}
+	mounts["vol-3"] = target("uid-gone-served")
+	vol := &RcloneVolume{ID: "vol-3", Remote: "minio", RemotePath: "base/vol-3"}
+	if err := NewServeRclone(ops, mountTypeNFS, td.mounter).Mount(context.Background(), vol, mounts["vol-3"], testRcloneConf, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ops.reconcileNodeMounters(context.Background(), td.mounter); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected mounter of a running pod to be kept: %v", err)
+	}
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-2", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected mounter of a removed pod to be deleted")
+	}
+	if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-3", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected serving mounter of a removed pod to be deleted")
+	}
+	for _, id := range []string{"vol-2", "vol-3"} {
+		if notMnt, _ := td.mounter.IsLikelyNotMountPoint(mounts[id]); !notMnt {
+			t.Errorf("expected %s to be unmounted", mounts[id])
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package rclone
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// configChange is how a new rclone.conf changes the remotes of a volume.
+type configChange struct {
+	// updates are the options to push to a running mounter, per remote.
+	// Removed options are set to an empty value.
+	updates map[string]map[string]string
+	// remount is set when a running mounter cannot take the change, because
+	// a remote was added, removed or changed its backend type.
+	remount bool
+}
+
+// remotes returns the names of the changed remotes.
+func (c configChange) remotes() []string {
+	remotes := []string{}
+	for remote := range c.updates {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	return remotes
+}
+
+// diffRemotes compares the options of remotes between two configs. Remotes
+// defined on the command line are not in the config and are skipped.
+func diffRemotes(oldConf, newConf rcloneConfig, remotes []string) configChange {
+	change := configChange{updates: map[string]map[string]string{}}
+	for _, remote := range remotes {
+		if strings.HasPrefix(remote, ":") {
+			continue
+		}
+		oldOpts, hadRemote := oldConf[remote]
+		newOpts, hasRemote := newConf[remote]
+		if !hadRemote && !hasRemote {
+			continue
+		}
+		if hadRemote != hasRemote || oldOpts["type"] != newOpts["type"] {
+			change.remount = true
+			change.updates[remote] = newOpts
+			continue
+		}
+		if reflect.DeepEqual(oldOpts, newOpts) {
+			continue
+		}
+		updates := map[string]string{}
+		for k, v := range newOpts {
+			if oldOpts[k] != v {
+				updates[k] = v
+			}
+		}
+		for k := range oldOpts {
+			if _, ok := newOpts[k]; !ok {
+				updates[k] = ""
+			}
+		}
+		change.updates[remote] = updates
+	}
+	return change
+}
+
+// secretWatches keeps an informer per node-publish secret of the volumes
+// with a mounter on this node. Each is limited to its Secret by a field
+// selector, so no other Secret is listed or watched.
+type secretWatches struct {
+	kubeClient kubernetes.Interface
+	handler    cache.ResourceEventHandler
+
+	mu      sync.Mutex
+	watches map[corev1.SecretReference]chan struct{}
+}
+
+// update watches the secrets of refs and stops watching the others.
+func (w *secretWatches) update(refs map[corev1.SecretReference]bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ref, stop := range w.watches {
+		if !refs[ref] {
+			close(stop)
+			delete(w.watches, ref)
+		}
+	}
+	for ref := range refs {
+		if _, ok := w.watches[ref]; ok {
+			continue
+		}
+		name := ref.Name
+		informer := coreinformers.NewFilteredSecretInformer(w.kubeClient, ref.Namespace, 0, cache.Indexers{}, func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})
+		informer.AddEventHandler(w.handler)
+		stop := make(chan struct{})
+		w.watches[ref] = stop
+		go informer.Run(stop)
+	}
+}
+
+// watchSecrets applies changes of the node-publish secrets of volumes with a
+// mounter on this node until stopCh is closed. The secrets watched follow the
+// mounter Deployments and PVs in the volume cache.
+func (r *Rclone) watchSecrets(reporter *volumeReporter, stopCh <-chan struct{}) {
+	w := &secretWatches{
+		kubeClient: r.kubeClient,
+		watches:    map[corev1.SecretReference]chan struct{}{},
+		handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldSecret, newSecret := oldObj.(*corev1.Secret), newObj.(*corev1.Secret)
+				if bytes.Equal(oldSecret.Data["rclone.conf"], newSecret.Data["rclone.conf"]) || tokensRefreshed(newSecret) {
+					return
+				}
+				if err := r.rotateCredentials(context.Background(), newSecret, reporter); err != nil {
+					klog.Errorf("applying changes of secret %s/%s: %v", newSecret.Namespace, newSecret.Name, err)
+				}
+			},
+		},
+	}
+	refresh := func() {
+		// Partial caches would stop the watches of volumes not seen yet.
+		if r.volumes.synced() {
+			w.update(r.nodeSecretRefs())
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { refresh() },
+		UpdateFunc: func(interface{}, interface{}) { refresh() },
+		DeleteFunc: func(interface{}) { refresh() },
+	}
+	r.volumes.deployments.AddEventHandler(handler)
+	r.volumes.pvs.AddEventHandler(handler)
+
+	if cache.WaitForCacheSync(stopCh, r.volumes.synced) {
+		refresh()
+	}
+	<-stopCh
+	w.update(nil)
+}
+
+// nodeSecretRefs returns the node-publish secrets of the volumes with a
+// mounter on this node, from the volume cache alone.
+func (r *Rclone) nodeSecretRefs() map[corev1.SecretReference]bool {
+	refs := map[corev1.SecretReference]bool{}
+	deployments, err := r.volumes.nodeDeployments(r.nodeID)
+	if err != nil {
+		return refs
+	}
+	for _, deployment := range deployments {
+		pv := r.volumes.cachedPersistentVolume(deployment.Labels["volumeid"])
+		if pv != nil && pv.Spec.CSI.NodePublishSecretRef != nil {
+			refs[*pv.Spec.CSI.NodePublishSecretRef] = true
+		}
+	}
+	return refs
+}
+
+// rotateCredentials applies a changed node-publish secret to the mounters on
+// this node of the volumes referencing it.
+func (r *Rclone) rotateCredentials(ctx context.Context, secret *corev1.Secret, reporter *volumeReporter) error {
+	deployments, err := r.volumes.nodeDeployments(r.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments {
+		pv, err := r.volumes.persistentVolume(deployment.Labels["volumeid"])
+		if err != nil {
+			continue
+		}
+		ref := pv.Spec.CSI.NodePublishSecretRef
+		if ref == nil || ref.Name != secret.Name || ref.Namespace != secret.Namespace {
+			continue
+		}
+		remotes, remounted, err := r.rotateVolume(ctx, deployment, pv, secret)
+		if err != nil || len(remotes) > 0 {
+			reporter.rotated(pv, remotes, remounted, err)
+		}
+	}
+	return nil
+}
+
+// rotateVolume updates the config copy of the mounter of pv and pushes the
+// changed remote options to its running pods through rc config/update. Pods
+// are only restarted, which remounts the volume, when a remote was added,
+// removed or changed its backend type. A pod that does not take the update
+// fails the rotation instead. It returns the changed remotes the volume uses
+// and whether it was remounted.
+func (r *Rclone) rotateVolume(ctx context.Context, deployment *appsv1.Deployment, pv *corev1.PersistentVolume, secret *corev1.Secret) ([]string, bool, error) {
+	data, ok := secret.Data["rclone.conf"]
+	if !ok {
+		return nil, false, nil
+	}
+	redactor.setVolume(pv.Spec.CSI.VolumeHandle, string(data))
+	attributes := pv.Spec.CSI.VolumeAttributes
+	multi, err := parseMultiRemote(attributes)
+	if err != nil {
+		return nil, false, err
+	}
+	newData := volumeConfig(string(data), multi)
+
+	oldData, err := r.mounterConfig(deployment.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	if oldData == newData {
+		return nil, false, nil
+	}
+
+	oldConf, oldErr := parseRcloneConf(oldData)
+	newConf, err := parseRcloneConf(newData)
+	if err != nil {
+		return nil, false, err
+	}
+	change := diffRemotes(oldConf, newConf, volumeRemotes(attributes, multi))
+	if oldErr != nil {
+		change.remount = true
+	}
+
+	if err := r.updateMounterConfig(deployment.Name, newData); err != nil {
+		return nil, false, err
+	}
+	if len(change.updates) == 0 {
+		return nil, false, nil
+	}
+
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": pv.Spec.CSI.VolumeHandle}))
+	if err != nil {
+		return nil, false, err
+	}
+	remounted := false
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if !change.remount {
+			// The saved config applies when the mounter restarts anyway,
+			// a restart is not forced on the pod I/O.
+			if err := r.pushConfig(ctx, pod, change); err != nil {
+				return change.remotes(), remounted, fmt.Errorf("mounter %s cannot take the new config while running: %w", pod.Name, err)
+			}
+			continue
+		}
+		klog.Infof("restarting mounter %s for the new config of volume %s", pod.Name, pv.Spec.CSI.VolumeHandle)
+		if err := r.kubeClient.CoreV1().Pods(r.namespace).Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			return change.remotes(), remounted, err
+		}
+		remounted = true
+	}
+	return change.remotes(), remounted, nil
+}
+
+// mounterConfig returns the rclone config copied to the mounter Secret name.
+func (r *Rclone) mounterConfig(name string) (string, error) {
+	secret, err := r.kubeClient.CoreV1().Secrets(r.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if data, ok := secret.Data["rclone.conf"]; ok {
+		return string(data), nil
+	}
+	return secret.StringData["rclone.conf"], nil
+}
+
+// updateMounterConfig replaces the config copy of the mounter name, so a
+// mounter restarted from now on reads it, and labels the mounter with its
+// hash, so the next publish finds the mounter up to date instead of
+// recreating it.
+func (r *Rclone) updateMounterConfig(name, rcloneConfigData string) error {
+	hash := configHash(rcloneConfigData)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := r.kubeClient.CoreV1().Secrets(r.namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		data := map[string][]byte{}
+		for k, v := range secret.StringData {
+			data[k] = []byte(v)
+		}
+		for k, v := range secret.Data {
+			data[k] = v
+		}
+		// The rc credentials stay, the running mounters use them.
+		data["rclone.conf"] = []byte(rcloneConfigData)
+		secret.Data = data
+		secret.StringData = nil
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels["hash"] = hash
+		if _, err := r.kubeClient.CoreV1().Secrets(r.namespace).Update(secret); err != nil {
+			return err
+		}
+		deployment, err := r.kubeClient.AppsV1().Deployments(r.namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if deployment.Labels == nil {
+			deployment.Labels = map[string]string{}
+		}
+		deployment.Labels["hash"] = hash
+		_, err = r.kubeClient.AppsV1().Deployments(r.namespace).Update(deployment)
+		return err
+	})
+}
+
+// pushConfig sets the changed remote options in the running mounter pod.
+func (r *Rclone) pushConfig(ctx context.Context, pod *corev1.Pod, change configChange) error {
+	client, err := r.mounterClient(pod)
+	if err != nil {
+		return err
+	}
+	for _, remote := range change.remotes() {
+		if err := client.ConfigUpdate(ctx, remote, change.updates[remote]); err != nil {
+			return fmt.Errorf("remote %s: %w", remote, err)
+		}
+	}
+	// rclone builds the backend of a remote once and caches it. Dropping it
+	// makes the next use build it from the new config, and forgetting the
+	// directory cache of the VFS drops what the old backend listed.
+	if err := client.FsCacheClear(ctx); err != nil {
+		return err
+	}
+	_, err = client.VfsForget(ctx, "", nil, nil)
+	return err
+}
@@ -0,0 +1,289 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDiffRemotes(t *testing.T) {
+	oldConf := rcloneConfig{
+		"minio": {"type": "s3", "access_key_id": "old", "region": "eu"},
+		"drive": {"type": "drive", "token": "t1"},
+	}
+	tests := []struct {
+		name        string
+		newConf     rcloneConfig
+		remotes     []string
+		wantUpdates map[string]map[string]string
+		wantRemount bool
+	}{
+		{
+			name:        "unchanged",
+			newConf:     oldConf,
+			remotes:     []string{"minio"},
+			wantUpdates: map[string]map[string]string{},
+		},
+		{
+			name: "rotated keys",
+			newConf: rcloneConfig{
+				"minio": {"type": "s3", "access_key_id": "new"},
+				"drive": {"type": "drive", "token": "t1"},
+			},
+			remotes:     []string{"minio"},
+			wantUpdates: map[string]map[string]string{"minio": {"access_key_id": "new", "region": ""}},
+		},
+		{
+			name: "unused remote changed",
+			newConf: rcloneConfig{
+				"minio": oldConf["minio"],
+				"drive": {"type": "drive", "token": "t2"},
+			},
+			remotes:     []string{"minio"},
+			wantUpdates: map[string]map[string]string{},
+		},
+		{
+			name: "backend type changed",
+			newConf: rcloneConfig{
+				"minio": {"type": "b2", "account": "a"},
+			},
+			remotes:     []string{"minio"},
+			wantUpdates: map[string]map[string]string{"minio": {"type": "b2", "account": "a"}},
+			wantRemount: true,
+		},
+		{
+			name:        "remote removed",
+			newConf:     rcloneConfig{"minio": oldConf["minio"]},
+			remotes:     []string{"minio", "drive"},
+			wantUpdates: map[string]map[string]string{"drive": nil},
+			wantRemount: true,
+		},
+		{
+			name:        "command line remote",
+			newConf:     rcloneConfig{},
+			remotes:     []string{":s3,provider=AWS"},
+			wantUpdates: map[string]map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			change := diffRemotes(oldConf, tc.newConf, tc.remotes)
+			if !reflect.DeepEqual(change.updates, tc.wantUpdates) {
+				t.Errorf("expected updates %v, got %v", tc.wantUpdates, change.updates)
+			}
+			if change.remount != tc.wantRemount {
+				t.Errorf("expected remount %v, got %v", tc.wantRemount, change.remount)
+			}
+		})
+	}
+}
+
+// rotationObjects returns a volume whose node-publish secret is
+// default/rclone-secret, with a running mounter on this node.
+func rotationObjects() []runtime.Object {
+	pv := testPV("pv-1", "vol-1", "minio", "base/pvc-1")
+	pv.Spec.CSI.NodePublishSecretRef = &corev1.SecretReference{Namespace: "default", Name: "rclone-secret"}
+	vol := &RcloneVolume{ID: "vol-1"}
+	mounterLabels := map[string]string{"volumeid": "vol-1", "hash": configHash(testRcloneConf)}
+	secret := mounterSecret("vol-1")
+	secret.Labels = mounterLabels
+	return []runtime.Object{
+		pv,
+		secret,
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: vol.deploymentName(), Namespace: testNamespace, Labels: mounterLabels},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{NodeName: testNodeID}}},
+		},
+		servingPod(true),
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	rotatedConf := strings.Replace(testRcloneConf, "AKIAEXAMPLEKEY", "AKIAROTATEDKEY", 1)
+	tests := []struct {
+		name        string
+		secretName  string
+		newConf     string
+		rcFails     bool
+		wantUpdates []string
+		wantDeleted bool
+		wantEvent   string
+	}{
+		{
+			name:        "keys pushed to the mounter",
+			secretName:  "rclone-secret",
+			newConf:     rotatedConf,
+			wantUpdates: []string{"minio"},
+			wantEvent:   "Normal CredentialsRotated updated the config of remotes minio",
+		},
+		{
+			name:        "update refused without a restart",
+			secretName:  "rclone-secret",
+			newConf:     rotatedConf,
+			rcFails:     true,
+			wantUpdates: []string{"minio"},
+			wantEvent:   "Warning CredentialsRotationFailed",
+		},
+		{
+			name:        "backend type change remounts",
+			secretName:  "rclone-secret",
+			newConf:     "[minio]\ntype = b2\naccount = a\n",
+			wantDeleted: true,
+			wantEvent:   "Normal CredentialsRotated remounted",
+		},
+		{
+			name:       "unused remote changed",
+			secretName: "rclone-secret",
+			newConf:    strings.Replace(testRcloneConf, "ya29.access-example", "ya29.refreshed", 1),
+		},
+		{
+			name:       "unchanged",
+			secretName: "rclone-secret",
+			newConf:    testRcloneConf,
+		},
+		{
+			name:       "other secret",
+			secretName: "unrelated",
+			newConf:    rotatedConf,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vol := &RcloneVolume{ID: "vol-1"}
+			td := newTestDriver(newFakeRclone(), rotationObjects()...)
+			handlers := map[string]fakeRcHandler{}
+			if tc.rcFails {
+				handlers["config/update"] = func(map[string]interface{}) (interface{}, error) {
+					return nil, errors.New("config update failed")
+				}
+			}
+			rc := newFakeRc(t, handlers)
+			rc.password = testRcPass
+			ops := td.ns.RcloneOps.(*Rclone)
+			ops.rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: tc.secretName, Namespace: "default"},
+				Data:       map[string][]byte{"rclone.conf": []byte(tc.newConf)},
+			}
+			if err := ops.rotateCredentials(context.Background(), secret, td.ns.reporter); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			gotUpdates := []string{}
+			for _, call := range rc.calls("config/update") {
+				gotUpdates = append(gotUpdates, call.params["name"].(string))
+			}
+			if len(tc.wantUpdates) == 0 {
+				tc.wantUpdates = []string{}
+			}
+			if !reflect.DeepEqual(gotUpdates, tc.wantUpdates) {
+				t.Errorf("expected config/update of %v, got %v", tc.wantUpdates, gotUpdates)
+			}
+			// Pushed options only reach a rebuilt backend.
+			if cleared := rc.calls("fscache/clear", "vfs/forget"); len(tc.wantUpdates) > 0 && !tc.rcFails && len(cleared) != 2 {
+				t.Errorf("expected the cached backend dropped and the VFS forgotten, got %v", cleared)
+			}
+			deleted := contains(td.actions(), "delete pods")
+			if deleted != tc.wantDeleted {
+				t.Errorf("expected mounter pod deleted %v, got actions %v", tc.wantDeleted, td.actions())
+			}
+
+			copySecret, _ := td.kubeClient.CoreV1().Secrets(testNamespace).Get(vol.deploymentName(), metav1.GetOptions{})
+			deployment, _ := td.kubeClient.AppsV1().Deployments(testNamespace).Get(vol.deploymentName(), metav1.GetOptions{})
+			wantConf := testRcloneConf
+			if tc.secretName == "rclone-secret" {
+				wantConf = tc.newConf
+			}
+			if got := string(copySecret.Data["rclone.conf"]); got != wantConf {
+				t.Errorf("expected the mounter config %q, got %q", wantConf, got)
+			}
+			if got := string(copySecret.Data[rcPassKey]); got != testRcPass {
+				t.Errorf("expected the rc password of the running mounter kept, got %q", got)
+			}
+			if deployment.Labels["hash"] != configHash(wantConf) || copySecret.Labels["hash"] != configHash(wantConf) {
+				t.Errorf("expected the mounter labelled with the hash of its config")
+			}
+
+			select {
+			case event := <-td.recorder.Events:
+				if tc.wantEvent == "" || !strings.HasPrefix(event, tc.wantEvent) {
+					t.Errorf("expected event %q, got %q", tc.wantEvent, event)
+				}
+			default:
+				if tc.wantEvent != "" {
+					t.Errorf("expected event %q", tc.wantEvent)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchSecrets(t *testing.T) {
+	source := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-secret", Namespace: "default"},
+		Data:       map[string][]byte{"rclone.conf": []byte(testRcloneConf)},
+	}
+	td := newTestDriver(newFakeRclone(), append(rotationObjects(), source)...)
+	rc := newFakeRc(t, nil)
+	ops := td.ns.RcloneOps.(*Rclone)
+	ops.rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ops.volumes.start(true, stopCh)
+	go ops.watchSecrets(td.ns.reporter, stopCh)
+
+	// Only the node-publish secret of the volume is watched.
+	secretWatches := func() []string {
+		watches := []string{}
+		for _, action := range td.kubeClient.Actions() {
+			if watch, ok := action.(k8stesting.WatchAction); ok && action.GetResource().Resource == "secrets" {
+				watches = append(watches, action.GetNamespace()+" "+watch.GetWatchRestrictions().Fields.String())
+			}
+		}
+		return watches
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(secretWatches()) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected a watch of the node-publish secret: %v", err)
+	}
+	if want := []string{"default metadata.name=rclone-secret"}; !reflect.DeepEqual(secretWatches(), want) {
+		t.Errorf("expected secret watches %q, got %q", want, secretWatches())
+	}
+
+	// Tokens saved by a token sync are skipped, the rotation that follows is
+	// applied.
+	refreshed := strings.Replace(testRcloneConf, "AKIAEXAMPLEKEY", "AKIAREFRESHKEY", 1)
+	source.Data["rclone.conf"] = []byte(refreshed)
+	source.Annotations = map[string]string{tokensHashAnnotation: configHash(refreshed)}
+	if _, err := td.kubeClient.CoreV1().Secrets("default").Update(source); err != nil {
+		t.Fatal(err)
+	}
+	source.Data["rclone.conf"] = []byte(strings.Replace(testRcloneConf, "AKIAEXAMPLEKEY", "AKIAROTATEDKEY", 1))
+	if _, err := td.kubeClient.CoreV1().Secrets("default").Update(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(rc.calls("config/update")) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the rotated keys pushed to the mounter: %v", err)
+	}
+	updates := rc.calls("config/update")
+	if len(updates) != 1 || !strings.Contains(updates[0].body, "AKIAROTATEDKEY") {
+		t.Errorf("expected only the rotated keys pushed, got %v", updates)
+	}
+}
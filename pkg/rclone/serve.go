@@ -0,0 +1,268 @@
+package rclone
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Mount types of volumes. With fuse the mounter runs rclone mount into the
+// target, with nfs and webdav it serves the remote and the node mounts it
+// with the kernel client.
+const (
+	mountTypeKey    = "mountType"
+	mountTypeFuse   = "fuse"
+	mountTypeNFS    = "nfs"
+	mountTypeWebDAV = "webdav"
+)
+
+// Annotations of served mounters, on the Deployment and its pods, holding the
+// loopback ports of the server and of the rc API.
+const (
+	servePortAnnotation = "csi-rclone/serve-port"
+	rcPortAnnotation    = "csi-rclone/rc-port"
+)
+
+// serveHost is the address served mounters listen on. They run in the host
+// network, so that the server is only reachable from the node mounting it.
+const serveHost = "127.0.0.1"
+
+// servePodTimeout bounds the wait for a serving mounter to become ready.
+var servePodTimeout = 2 * time.Minute
+
+// volumeMountType returns the mount type set in volume attributes, fuse by
+// default.
+func volumeMountType(attributes map[string]string) (string, error) {
+	switch mountType := attributes[mountTypeKey]; mountType {
+	case "", mountTypeFuse:
+		return mountTypeFuse, nil
+	case mountTypeNFS, mountTypeWebDAV:
+		return mountType, nil
+	default:
+		return "", fmt.Errorf("unknown %s %q, expected %s, %s or %s", mountTypeKey, mountType, mountTypeFuse, mountTypeNFS, mountTypeWebDAV)
+	}
+}
+
+// serveRclone mounts volumes by running rclone serve in the mounter
+// Deployment and mounting it into the target with the kernel NFS or WebDAV
+// client of the node. Unmounting the target is left to the caller, it must
+// happen before Unmount removes the server.
+type serveRclone struct {
+	*Rclone
+	protocol string
+	mounter  mount.Interface
+}
+
+// NewServeRclone returns Operations serving volumes over protocol, nfs or
+// webdav, from mounters managed like those of r.
+func NewServeRclone(r *Rclone, protocol string, mounter mount.Interface) Operations {
+	return &serveRclone{Rclone: r, protocol: protocol, mounter: mounter}
+}
+
+// serveFlags are the default mount flags rclone serve understands, serving
+// on port and answering rc on rcPort of the loopback address.
+func (s *serveRclone) serveFlags(rcloneVolume *RcloneVolume, port, rcPort int) map[string]string {
+	flags := defaultMountFlags(rcloneVolume)
+	for _, k := range []string{"volname", "devname", "allow-other", "allow-non-empty"} {
+		delete(flags, k)
+	}
+	flags["addr"] = net.JoinHostPort(serveHost, strconv.Itoa(port))
+	flags["rc-addr"] = net.JoinHostPort(serveHost, strconv.Itoa(rcPort))
+	return flags
+}
+
+// servePorts returns the server and rc ports of the mounter of rcloneVolume,
+// those it already has, or free ones of the node for a new mounter. The node
+// plugin runs in the host network too, so a port it can bind is free for
+// the mounter.
+func (s *serveRclone) servePorts(rcloneVolume *RcloneVolume) (int, int, error) {
+	deployment, err := s.kubeClient.AppsV1().Deployments(s.namespace).Get(rcloneVolume.deploymentName(), metav1.GetOptions{})
+	if err == nil {
+		if port, rcPort, err := annotatedPorts(deployment.Annotations); err == nil {
+			return port, rcPort, nil
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		return 0, 0, err
+	}
+	ports := make([]int, 2)
+	for i := range ports {
+		l, err := net.Listen("tcp", net.JoinHostPort(serveHost, "0"))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer l.Close()
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+	}
+	return ports[0], ports[1], nil
+}
+
+// annotatedPorts reads the ports of a served mounter from its annotations.
+func annotatedPorts(annotations map[string]string) (int, int, error) {
+	port, err := strconv.Atoi(annotations[servePortAnnotation])
+	if err != nil {
+		return 0, 0, fmt.Errorf("no %s annotation", servePortAnnotation)
+	}
+	rcPort, err := strconv.Atoi(annotations[rcPortAnnotation])
+	if err != nil {
+		return 0, 0, fmt.Errorf("no %s annotation", rcPortAnnotation)
+	}
+	return port, rcPort, nil
+}
+
+// loopbackProbe checks that the mounter listens on port of the loopback
+// address, which the kubelet reaches in the host network.
+func loopbackProbe(port int) *corev1.Probe {
+	probe := rcReadinessProbe()
+	probe.Handler = corev1.Handler{
+		TCPSocket: &corev1.TCPSocketAction{Host: serveHost, Port: intstr.FromInt(port)},
+	}
+	return probe
+}
+
+func (s *serveRclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, parameters map[string]string) error {
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return err
+	}
+
+	port, rcPort, err := s.servePorts(rcloneVolume)
+	if err != nil {
+		return err
+	}
+	// The flags are those of the mount command line, after its operands.
+	// Addresses set by parameters would expose the server, they are dropped.
+	flags := s.serveFlags(rcloneVolume, port, rcPort)
+	serveParameters := map[string]string{}
+	for k, v := range parameters {
+		if k != "addr" && k != "rc-addr" {
+			serveParameters[k] = v
+		}
+	}
+	args := append([]string{"serve", s.protocol, fmt.Sprintf("%s:/%s", rcloneVolume.Remote, rcloneVolume.RemotePath)},
+		buildMountArgs(rcloneVolume, targetPath, flags, serveParameters)[3:]...)
+	container := corev1.Container{
+		Name:           "rclone-mounter",
+		Image:          mounterImage,
+		Command:        []string{"rclone"},
+		Args:           args,
+		LivenessProbe:  loopbackProbe(port),
+		ReadinessProbe: loopbackProbe(rcPort),
+	}
+	annotations := map[string]string{
+		servePortAnnotation: strconv.Itoa(port),
+		rcPortAnnotation:    strconv.Itoa(rcPort),
+	}
+	if err := s.applyMounter(rcloneVolume, targetPath, rcloneConfigData, nil, container, annotations, true); err != nil {
+		return err
+	}
+	return s.mountServer(ctx, rcloneVolume, targetPath, port)
+}
+
+// Remount restarts the mounter of rcloneVolume and mounts targetPath from
+// the new server, the stale mount has to be gone.
+func (s *serveRclone) Remount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string) error {
+	if err := s.Rclone.Remount(ctx, rcloneVolume, targetPath); err != nil {
+		return err
+	}
+	deployment, err := s.kubeClient.AppsV1().Deployments(s.namespace).Get(rcloneVolume.deploymentName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	port, _, err := annotatedPorts(deployment.Annotations)
+	if err != nil {
+		return fmt.Errorf("mounter of volume %s: %v", rcloneVolume.ID, err)
+	}
+	return s.mountServer(ctx, rcloneVolume, targetPath, port)
+}
+
+// mountServer mounts targetPath from the mounter of rcloneVolume, serving
+// on port, once it is ready.
+func (s *serveRclone) mountServer(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string, port int) error {
+	if err := s.waitForServer(ctx, rcloneVolume); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(serveHost, strconv.Itoa(port))
+	var source, fsType string
+	var options []string
+	switch s.protocol {
+	case mountTypeNFS:
+		// rclone serves NFSv3 without a lock manager, on one port.
+		source, fsType = serveHost+":/", "nfs"
+		options = []string{"port=" + strconv.Itoa(port), "mountport=" + strconv.Itoa(port), "tcp", "vers=3", "nolock"}
+	case mountTypeWebDAV:
+		source, fsType = "http://"+addr+"/", "davfs"
+	}
+	klog.Infof("mounting %s of volume %s at %s", source, rcloneVolume.ID, targetPath)
+	return s.mounter.Mount(source, targetPath, fsType, options)
+}
+
+// waitForServer waits until a mounter pod of rcloneVolume is ready to
+// serve.
+func (s *serveRclone) waitForServer(ctx context.Context, rcloneVolume *RcloneVolume) error {
+	ctx, cancel := context.WithTimeout(ctx, servePodTimeout)
+	defer cancel()
+
+	selector := labels.FormatLabels(map[string]string{"volumeid": rcloneVolume.ID})
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		pods, err := ListPods(s.kubeClient, s.namespace, selector)
+		if err != nil {
+			return false, err
+		}
+		for _, pod := range pods.Items {
+			if pod.DeletionTimestamp == nil && podReady(&pod) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, ctx.Done())
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("mounter of volume %s is not serving: %w", rcloneVolume.ID, err)
+	}
+	return nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// servedMountType returns the mount type of a target mounted from a serving
+// mounter, found in the mount table, or fuse.
+func servedMountType(mounter mount.Interface, targetPath string) string {
+	mounts, err := mounter.List()
+	if err != nil {
+		klog.Warningf("cannot list mounts: %v", err)
+		return mountTypeFuse
+	}
+	for _, m := range mounts {
+		if m.Path != targetPath {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(m.Type, "nfs"):
+			return mountTypeNFS
+		case strings.HasPrefix(m.Device, "http://"):
+			return mountTypeWebDAV
+		}
+	}
+	return mountTypeFuse
+}
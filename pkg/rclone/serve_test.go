@@ -0,0 +1,167 @@
+package rclone
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func servingPod(ready bool) *corev1.Pod {
+	condition := corev1.ConditionFalse
+	if ready {
+		condition = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "rclone-mounter-vol-1-abc", Namespace: testNamespace, Labels: map[string]string{"volumeid": "vol-1"}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "10.0.0.7",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: condition}},
+		},
+	}
+}
+
+func TestServeVolume(t *testing.T) {
+	servePodTimeout = 100 * time.Millisecond
+	uploadPollInterval = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		mountType string
+		pod       *corev1.Pod
+		noServe   bool
+		wantCode  codes.Code
+		wantMount string
+	}{
+		{name: "nfs", mountType: mountTypeNFS, pod: servingPod(true), wantCode: codes.OK, wantMount: "nfs 127.0.0.1:/"},
+		{name: "webdav", mountType: mountTypeWebDAV, pod: servingPod(true), wantCode: codes.OK, wantMount: "davfs http://127.0.0.1:%s/"},
+		{name: "unknown mount type", mountType: "smb", pod: servingPod(true), wantCode: codes.InvalidArgument},
+		{name: "mounter not ready", mountType: mountTypeNFS, pod: servingPod(false), wantCode: codes.DeadlineExceeded},
+		{name: "process mounter", mountType: mountTypeNFS, pod: servingPod(true), noServe: true, wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"), tc.pod)
+			if tc.noServe {
+				td.ns.serveOps = nil
+			}
+			targetPath := filepath.Join(t.TempDir(), "target")
+			req := testPublishRequest(targetPath)
+			req.VolumeContext[mountTypeKey] = tc.mountType
+
+			_, err := td.ns.NodePublishVolume(context.Background(), req)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if err != nil {
+				return
+			}
+
+			deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			container := deployment.Spec.Template.Spec.Containers[0]
+			if got, want := strings.Join(container.Args[:3], " "), "serve "+tc.mountType+" minio:/base/pvc-1"; got != want {
+				t.Errorf("expected rclone %s, got %s", want, got)
+			}
+			if contains(container.Args, "--allow-other=true") {
+				t.Errorf("expected serve flags, got %v", container.Args)
+			}
+			port, rcPort, err := annotatedPorts(deployment.Annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertLoopbackOnly(t, container.Args, "--addr=", port)
+			assertLoopbackOnly(t, container.Args, "--rc-addr=", rcPort)
+			if spec := deployment.Spec.Template.Spec; !spec.HostNetwork || deployment.Spec.Template.Annotations[rcPortAnnotation] != strconv.Itoa(rcPort) {
+				t.Errorf("expected a host network mounter annotated with its ports, got %+v", deployment.Spec.Template)
+			}
+			pod := &corev1.Pod{ObjectMeta: deployment.Spec.Template.ObjectMeta}
+			if addr, err := rcAddress(pod); err != nil || addr != "127.0.0.1:"+strconv.Itoa(rcPort) {
+				t.Errorf("expected the plugin to call rc on the loopback address, got %q (%v)", addr, err)
+			}
+			if strings.Contains(tc.wantMount, "%s") {
+				tc.wantMount = fmt.Sprintf(tc.wantMount, strconv.Itoa(port))
+			}
+			if container.SecurityContext != nil {
+				t.Errorf("expected an unprivileged server, got %v", container.SecurityContext)
+			}
+			mounts, _ := td.mounter.List()
+			if len(mounts) != 1 || mounts[0].Type+" "+mounts[0].Device != tc.wantMount || mounts[0].Path != targetPath {
+				t.Fatalf("expected a %s mount of the mounter at %s, got %+v", tc.wantMount, targetPath, mounts)
+			}
+			if tc.mountType == mountTypeNFS && !contains(mounts[0].Opts, "port="+strconv.Itoa(port)) {
+				t.Errorf("expected the NFS mount on port %d, got %v", port, mounts[0].Opts)
+			}
+			if got := deployment.Annotations[targetPathAnnotation]; got != targetPath {
+				t.Errorf("expected the mounter annotated with its target %s, got %q", targetPath, got)
+			}
+
+			// The kernel mount must be gone before its server.
+			td.kubeClient.PrependReactor("delete", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if servedMountType(td.mounter, targetPath) != mountTypeFuse {
+					t.Errorf("mounter deleted while %s is still mounted", targetPath)
+				}
+				return false, nil, nil
+			})
+			if _, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: targetPath}); err != nil {
+				t.Fatalf("NodeUnpublishVolume failed: %v", err)
+			}
+			if _, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{}); err == nil {
+				t.Errorf("expected mounter deployment to be deleted")
+			}
+		})
+	}
+}
+
+// assertLoopbackOnly checks that the flag of args listens on port of the
+// loopback address only, and that a server there cannot be reached through
+// the other addresses of the node.
+func assertLoopbackOnly(t *testing.T, args []string, flag string, port int) {
+	t.Helper()
+	addr := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, flag) {
+			addr = strings.TrimPrefix(arg, flag)
+		}
+	}
+	host, gotPort, err := net.SplitHostPort(addr)
+	if err != nil || gotPort != strconv.Itoa(port) || !net.ParseIP(host).IsLoopback() {
+		t.Fatalf("expected %s on port %d of the loopback address, got %v", flag, port, args)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", addr, err)
+	}
+	defer l.Close()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		ip, ok := a.(*net.IPNet)
+		if !ok || ip.IP.IsLoopback() || ip.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.IP.String(), gotPort), time.Second)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s reachable on %s", flag, ip.IP)
+		}
+	}
+}
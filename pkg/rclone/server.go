@@ -0,0 +1,120 @@
+package rclone
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// nonBlockingGRPCServer mirrors csicommon.NonBlockingGRPCServer but lets the
+// driver chain its own unary interceptors (metrics, logging).
+type nonBlockingGRPCServer struct {
+	wg           sync.WaitGroup
+	server       *grpc.Server
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+func NewNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{interceptors: interceptors}
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		klog.Fatal(err.Error())
+	}
+
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+		}
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		klog.Fatalf("Failed to listen: %v", err)
+	}
+
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(s.interceptors...))
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(listener); err != nil {
+			klog.Errorf("gRPC server stopped: %v", err)
+		}
+	}()
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+}
+
+// StopWithTimeout stops accepting RPCs and waits for in-flight ones, up to
+// timeout after which they are cancelled. It reports whether they drained.
+func (s *nonBlockingGRPCServer) StopWithTimeout(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		s.server.Stop()
+		<-stopped
+		return false
+	}
+}
+
+// secretsRequest is implemented by every CSI request that carries secrets.
+type secretsRequest interface {
+	GetSecrets() map[string]string
+}
+
+// logGRPC logs CSI calls with secrets stripped, and scrubs every secret value
+// the request carried from the returned error. The secrets are masked while
+// the call runs.
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if r, ok := req.(secretsRequest); ok {
+		defer redactor.addRequest(r.GetSecrets())()
+	}
+	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	klog.V(5).Infof("GRPC request: %s", sanitizeMessage(req))
+	resp, err := handler(ctx, req)
+	err = redactor.Error(err)
+	if err != nil {
+		klog.Errorf("GRPC error: %s: %v", info.FullMethod, err)
+	} else {
+		klog.V(5).Infof("GRPC response: %s", sanitizeMessage(resp))
+	}
+	return resp, err
+}
@@ -0,0 +1,132 @@
+package rclone
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// stateFile is the node-local state kept in the plugin dir.
+const stateFile = "state.json"
+
+// publishedVolume is what the node remembers about a published target. It
+// holds no secrets.
+type publishedVolume struct {
+	VolumeID   string `json:"volumeId"`
+	TargetPath string `json:"targetPath"`
+	Remote     string `json:"remote"`
+	RemotePath string `json:"remotePath"`
+	// MountType is how a mount mode volume is mounted, fuse when empty.
+	MountType string `json:"mountType,omitempty"`
+	// Sync marks sync mode volumes, bind mounts of a node copy.
+	Sync bool `json:"sync,omitempty"`
+}
+
+// nodeState tracks the volumes published on this node, keyed by target path,
+// and persists them across plugin restarts. Every change is written at once,
+// so the state survives a crash as well. A nodeState without a path is kept
+// in memory only.
+type nodeState struct {
+	mu      sync.Mutex
+	path    string
+	volumes map[string]publishedVolume
+}
+
+// loadNodeState reads the state from pluginDir, starting empty when there is
+// none yet. An empty pluginDir keeps the state in memory.
+func loadNodeState(pluginDir string) (*nodeState, error) {
+	s := &nodeState{volumes: map[string]publishedVolume{}}
+	if pluginDir == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(pluginDir, stateFile)
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var volumes []publishedVolume
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		s.volumes[v.TargetPath] = v
+	}
+	return s, nil
+}
+
+func (s *nodeState) add(v publishedVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volumes[v.TargetPath] = v
+	if err := s.write(); err != nil {
+		klog.Errorf("writing node state: %v", err)
+	}
+}
+
+func (s *nodeState) remove(targetPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.volumes, targetPath)
+	if err := s.write(); err != nil {
+		klog.Errorf("writing node state: %v", err)
+	}
+}
+
+// list returns the published volumes sorted by target path.
+func (s *nodeState) list() []publishedVolume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+// sorted returns the published volumes sorted by target path. s.mu must be
+// held.
+func (s *nodeState) sorted() []publishedVolume {
+	out := make([]publishedVolume, 0, len(s.volumes))
+	for _, v := range s.volumes {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TargetPath < out[j].TargetPath })
+	return out
+}
+
+// save writes the state, add and remove already did unless writing failed.
+func (s *nodeState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+// write replaces the state file through a rename, so a crash never leaves a
+// partial file. s.mu must be held, which keeps the writes in order.
+func (s *nodeState) write() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), stateFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
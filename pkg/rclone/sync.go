@@ -0,0 +1,468 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
+	"k8s.io/utils/exec"
+)
+
+// Volume attributes of sync mode volumes.
+const (
+	volumeModeKey     = "mode"
+	syncIntervalKey   = "syncInterval"
+	conflictPolicyKey = "conflictPolicy"
+	// syncFlagPrefix marks attributes passed as flags to the rclone copy,
+	// sync and bisync commands, like "mount/" does for rclone mount.
+	syncFlagPrefix = "sync/"
+)
+
+const (
+	volumeModeMount = "mount"
+	volumeModeSync  = "sync"
+)
+
+const defaultSyncInterval = time.Minute
+
+// Conflict policies of sync mode volumes. With copy, the default, files new
+// or changed on the node are copied to the remote, which never loses a file:
+// nothing is deleted and files newer on the remote are kept. With local the
+// node copy is mirrored to the remote, deleting and overwriting what other
+// writers changed, so it has to be asked for. The others run bisync,
+// resolving files changed on both sides in favour of the newer one, the
+// remote one, or keeping both under conflict suffixes.
+const (
+	conflictCopy     = "copy"
+	conflictLocal    = "local"
+	conflictNewer    = "newer"
+	conflictRemote   = "remote"
+	conflictKeepBoth = "keep-both"
+)
+
+var bisyncConflictResolve = map[string]string{
+	conflictNewer:    "newer",
+	conflictRemote:   "path2",
+	conflictKeepBoth: "none",
+}
+
+// syncOptions are the sync settings of a volume.
+type syncOptions struct {
+	interval time.Duration
+	policy   string
+	flags    []string
+}
+
+// volumeMode returns the mode set in volume attributes, mount by default.
+func volumeMode(attributes map[string]string) (string, error) {
+	switch mode := attributes[volumeModeKey]; mode {
+	case "", volumeModeMount:
+		return volumeModeMount, nil
+	case volumeModeSync:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown %s %q, expected %s or %s", volumeModeKey, mode, volumeModeMount, volumeModeSync)
+	}
+}
+
+// parseSyncOptions reads the sync settings from volume attributes.
+func parseSyncOptions(attributes map[string]string) (syncOptions, error) {
+	opts := syncOptions{interval: defaultSyncInterval, policy: conflictCopy}
+	if value, ok := attributes[syncIntervalKey]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return opts, fmt.Errorf("invalid %s %q, expected a duration such as 5m", syncIntervalKey, value)
+		}
+		opts.interval = interval
+	}
+	if value, ok := attributes[conflictPolicyKey]; ok {
+		if _, bisync := bisyncConflictResolve[value]; !bisync && value != conflictCopy && value != conflictLocal {
+			return opts, fmt.Errorf("unknown %s %q, expected %s, %s, %s, %s or %s",
+				conflictPolicyKey, value, conflictCopy, conflictLocal, conflictNewer, conflictRemote, conflictKeepBoth)
+		}
+		opts.policy = value
+	}
+	for k, v := range attributes {
+		if !strings.HasPrefix(k, syncFlagPrefix) {
+			continue
+		}
+		if v != "" {
+			opts.flags = append(opts.flags, fmt.Sprintf("--%s=%s", k[len(syncFlagPrefix):], v))
+		} else {
+			opts.flags = append(opts.flags, "--"+k[len(syncFlagPrefix):])
+		}
+	}
+	sort.Strings(opts.flags)
+	return opts, nil
+}
+
+// syncManager serves sync mode volumes. The remote directory is copied to a
+// node-local directory that is bind-mounted into pods, and changes are synced
+// back to the remote in the background, so pods never see FUSE.
+type syncManager struct {
+	execute exec.Interface
+	mounter mount.Interface
+	dir     string
+	bisync  *rcloneVersionCheck
+
+	mu      sync.Mutex
+	volumes map[string]*syncVolume
+	// starting holds the volumes copied for their first publish, closed
+	// once they are in volumes or failed.
+	starting map[string]chan struct{}
+}
+
+// syncVolume is the node copy of one volume, shared by all its targets.
+type syncVolume struct {
+	remote       string
+	localDir     string
+	configPath   string
+	workDir      string
+	settingsPath string
+	opts         syncOptions
+	targets      map[string]bool
+	stop         chan struct{}
+	done         chan struct{}
+
+	// mu serializes the syncs of the volume.
+	mu       sync.Mutex
+	resynced bool
+}
+
+// syncSettings are kept next to a node copy, so a restarted plugin can take
+// it over and sync its changes back.
+type syncSettings struct {
+	Remote         string        `json:"remote"`
+	Interval       time.Duration `json:"interval"`
+	ConflictPolicy string        `json:"conflictPolicy"`
+	Flags          []string      `json:"flags,omitempty"`
+}
+
+func newSyncManager(execute exec.Interface, mounter mount.Interface, dir string) *syncManager {
+	return &syncManager{
+		execute:  execute,
+		mounter:  mounter,
+		dir:      dir,
+		bisync:   &rcloneVersionCheck{execute: execute, min: bisyncRcloneVersion, needs: "bisync --conflict-resolve"},
+		volumes:  map[string]*syncVolume{},
+		starting: map[string]chan struct{}{},
+	}
+}
+
+// Publish bind-mounts the node copy of rcloneVolume at targetPath, copying
+// the remote and starting the background sync on the first publish. The
+// first copy runs without m.mu, so it only holds up the publishes of the
+// same volume.
+func (m *syncManager) Publish(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, opts syncOptions) error {
+	v, err := m.volume(ctx, rcloneVolume, rcloneConfigData, opts)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.volumes[rcloneVolume.ID] != v {
+		return fmt.Errorf("sync mode volume %s was unpublished while publishing %s", rcloneVolume.ID, targetPath)
+	}
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return err
+	}
+	if err := m.mounter.Mount(v.localDir, targetPath, "", []string{"bind"}); err != nil {
+		if len(v.targets) == 0 {
+			delete(m.volumes, rcloneVolume.ID)
+			m.stopVolume(v)
+		}
+		return err
+	}
+	v.targets[targetPath] = true
+	return nil
+}
+
+// volume returns the node copy of rcloneVolume, starting it unless it runs
+// already. A volume being started is waited for.
+func (m *syncManager) volume(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigData string, opts syncOptions) (*syncVolume, error) {
+	m.mu.Lock()
+	for {
+		if v, ok := m.volumes[rcloneVolume.ID]; ok {
+			m.mu.Unlock()
+			return v, nil
+		}
+		starting, ok := m.starting[rcloneVolume.ID]
+		if !ok {
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-starting:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+	starting := make(chan struct{})
+	m.starting[rcloneVolume.ID] = starting
+	m.mu.Unlock()
+
+	v, err := m.start(ctx, rcloneVolume, rcloneConfigData, opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.starting, rcloneVolume.ID)
+	close(starting)
+	if err != nil {
+		return nil, err
+	}
+	m.volumes[rcloneVolume.ID] = v
+	return v, nil
+}
+
+func (m *syncManager) start(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigData string, opts syncOptions) (*syncVolume, error) {
+	if m.dir == "" {
+		return nil, fmt.Errorf("sync mode volumes need a node-local directory")
+	}
+	if _, bisync := bisyncConflictResolve[opts.policy]; bisync {
+		if err := m.bisync.check(); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s %s: %v", conflictPolicyKey, opts.policy, err)
+		}
+	}
+	v := m.newSyncVolume(rcloneVolume.ID, fmt.Sprintf("%s:/%s", rcloneVolume.Remote, rcloneVolume.RemotePath), opts)
+	if err := os.MkdirAll(v.localDir, 0750); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(v.configPath, []byte(rcloneConfigData), 0600); err != nil {
+		return nil, err
+	}
+	klog.Infof("copying %s to %s", v.remote, v.localDir)
+	if err := m.run(ctx, v, "copy", v.remote, v.localDir); err != nil {
+		os.Remove(v.configPath)
+		return nil, err
+	}
+	settings, err := json.Marshal(syncSettings{Remote: v.remote, Interval: opts.interval, ConflictPolicy: opts.policy, Flags: opts.flags})
+	if err == nil {
+		err = ioutil.WriteFile(v.settingsPath, settings, 0600)
+	}
+	if err != nil {
+		os.Remove(v.configPath)
+		return nil, err
+	}
+
+	go m.loop(v)
+	return v, nil
+}
+
+func (m *syncManager) newSyncVolume(volumeId, remote string, opts syncOptions) *syncVolume {
+	name := (&RcloneVolume{ID: volumeId}).normalizedVolumeId()
+	return &syncVolume{
+		remote:       remote,
+		localDir:     filepath.Join(m.dir, name),
+		configPath:   filepath.Join(m.dir, name+".conf"),
+		workDir:      filepath.Join(m.dir, name+".bisync"),
+		settingsPath: filepath.Join(m.dir, name+".json"),
+		opts:         opts,
+		targets:      map[string]bool{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// loop syncs v every interval until it is stopped.
+func (m *syncManager) loop(v *syncVolume) {
+	defer close(v.done)
+	ticker := time.NewTicker(v.opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			if err := m.sync(context.Background(), v); err != nil {
+				klog.Errorf("syncing %s: %v", v.remote, err)
+			}
+		}
+	}
+}
+
+// restore takes over the node copies of the sync mode volumes published
+// before the plugin restarted, resuming their background sync.
+func (m *syncManager) restore(published []publishedVolume) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range published {
+		if !p.Sync {
+			continue
+		}
+		v, err := m.adopt(p.VolumeID)
+		if err != nil {
+			klog.Errorf("restoring sync mode volume %s at %s: %v", p.VolumeID, p.TargetPath, err)
+			continue
+		}
+		if v == nil {
+			klog.Warningf("no node copy of sync mode volume %s left for %s", p.VolumeID, p.TargetPath)
+			continue
+		}
+		v.targets[p.TargetPath] = true
+	}
+}
+
+// adopt returns the node copy of volumeId, taking over one left by a previous
+// plugin instance. It returns nil when the volume has no node copy. m.mu must
+// be held.
+func (m *syncManager) adopt(volumeId string) (*syncVolume, error) {
+	if v, ok := m.volumes[volumeId]; ok {
+		return v, nil
+	}
+	if _, ok := m.starting[volumeId]; ok {
+		return nil, fmt.Errorf("sync mode volume %s is still being copied", volumeId)
+	}
+	if m.dir == "" {
+		return nil, nil
+	}
+	name := (&RcloneVolume{ID: volumeId}).normalizedVolumeId()
+	data, err := ioutil.ReadFile(filepath.Join(m.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var settings syncSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("reading the sync settings of volume %s: %v", volumeId, err)
+	}
+	v := m.newSyncVolume(volumeId, settings.Remote, syncOptions{
+		interval: settings.Interval,
+		policy:   settings.ConflictPolicy,
+		flags:    settings.Flags,
+	})
+	if v.opts.interval <= 0 {
+		v.opts.interval = defaultSyncInterval
+	}
+	if v.opts.policy == "" {
+		v.opts.policy = conflictCopy
+	}
+	// bisync keeps the baseline of its previous runs in the work dir.
+	if entries, err := ioutil.ReadDir(v.workDir); err == nil && len(entries) > 0 {
+		v.resynced = true
+	}
+	klog.Infof("taking over the node copy of volume %s in %s", volumeId, v.localDir)
+	m.volumes[volumeId] = v
+	go m.loop(v)
+	return v, nil
+}
+
+// sync pushes the node copy of v to the remote according to its conflict
+// policy.
+func (m *syncManager) sync(ctx context.Context, v *syncVolume) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch v.opts.policy {
+	case conflictCopy:
+		return m.run(ctx, v, "copy", "--update", v.localDir, v.remote)
+	case conflictLocal:
+		return m.run(ctx, v, "sync", v.localDir, v.remote)
+	}
+	args := []string{"bisync", v.localDir, v.remote,
+		"--workdir=" + v.workDir,
+		"--conflict-resolve=" + bisyncConflictResolve[v.opts.policy],
+	}
+	if !v.resynced {
+		// bisync needs a baseline of both sides before its first run.
+		args = append(args, "--resync")
+	}
+	if err := m.run(ctx, v, args...); err != nil {
+		return err
+	}
+	v.resynced = true
+	return nil
+}
+
+func (m *syncManager) run(ctx context.Context, v *syncVolume, args ...string) error {
+	args = append(args, "--config="+v.configPath)
+	args = append(args, v.opts.flags...)
+	out, err := m.execute.CommandContext(ctx, "rclone", args...).CombinedOutput()
+	if err != nil {
+		output := redactor.Scrub(string(out))
+		return newRcloneError(fmt.Sprintf("rclone %s failed: %v output: %q", args[0], err, output), err, output)
+	}
+	return nil
+}
+
+// Published tells whether targetPath is a sync mode target of volumeId,
+// including node copies left by a previous plugin instance.
+func (m *syncManager) Published(volumeId, targetPath string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.volumes {
+		if v.targets[targetPath] {
+			return true
+		}
+	}
+	if m.dir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(m.dir, (&RcloneVolume{ID: volumeId}).normalizedVolumeId()+".json"))
+	return err == nil
+}
+
+// Unpublish unmounts targetPath. When it was the last target of the volume
+// the node copy is synced a last time and removed. A failed final sync keeps
+// the target, so a retry does not lose the changes. The final sync runs
+// without m.mu, the volume lock serializes it with the background sync.
+func (m *syncManager) Unpublish(ctx context.Context, volumeId, targetPath string) error {
+	m.mu.Lock()
+	v, err := m.adopt(volumeId)
+	if err != nil || v == nil {
+		m.mu.Unlock()
+		return err
+	}
+	// A target the node state lost after a plugin restart.
+	v.targets[targetPath] = true
+	last := len(v.targets) == 1
+	m.mu.Unlock()
+
+	if last {
+		if err := m.sync(ctx, v); err != nil {
+			return fmt.Errorf("final sync of volume %s: %w", volumeId, err)
+		}
+	}
+	if err := util.UnmountPath(targetPath, m.mounter); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(v.targets, targetPath)
+	stop := len(v.targets) == 0
+	if stop {
+		delete(m.volumes, volumeId)
+	}
+	m.mu.Unlock()
+	if stop {
+		m.stopVolume(v)
+	}
+	return nil
+}
+
+// stopVolume stops the background sync of v and removes its node copy. v must
+// no longer be in m.volumes.
+func (m *syncManager) stopVolume(v *syncVolume) {
+	close(v.stop)
+	<-v.done
+	for _, path := range []string{v.localDir, v.workDir, v.configPath, v.settingsPath} {
+		if err := os.RemoveAll(path); err != nil {
+			klog.Warningf("removing %s: %v", path, err)
+		}
+	}
+}
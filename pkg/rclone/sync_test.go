@@ -0,0 +1,308 @@
+package rclone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestParseSyncOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       syncOptions
+		wantErr    bool
+	}{
+		{
+			name:       "defaults",
+			attributes: map[string]string{},
+			want:       syncOptions{interval: defaultSyncInterval, policy: conflictCopy},
+		},
+		{
+			name:       "mirroring asked for",
+			attributes: map[string]string{conflictPolicyKey: conflictLocal},
+			want:       syncOptions{interval: defaultSyncInterval, policy: conflictLocal},
+		},
+		{
+			name:       "bisync with flags",
+			attributes: map[string]string{syncIntervalKey: "30s", conflictPolicyKey: conflictNewer, "sync/exclude": "*.tmp", "sync/checksum": ""},
+			want:       syncOptions{interval: 30 * time.Second, policy: conflictNewer, flags: []string{"--checksum", "--exclude=*.tmp"}},
+		},
+		{
+			name:       "bad interval",
+			attributes: map[string]string{syncIntervalKey: "0s"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown policy",
+			attributes: map[string]string{conflictPolicyKey: "mine"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSyncOptions(tc.attributes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func syncPublishRequest(targetPath, policy string) *csi.NodePublishVolumeRequest {
+	req := testPublishRequest(targetPath)
+	req.VolumeContext[volumeModeKey] = volumeModeSync
+	if policy != "" {
+		req.VolumeContext[conflictPolicyKey] = policy
+	}
+	return req
+}
+
+func TestSyncVolume(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		finalSync     []rcloneResult
+		wantFinalSync []string
+		wantCode      codes.Code
+	}{
+		{
+			name:          "copy by default",
+			finalSync:     []rcloneResult{{}},
+			wantFinalSync: []string{"rclone", "copy", "--update", "vol-1", "minio:/base/pvc-1"},
+			wantCode:      codes.OK,
+		},
+		{
+			name:          "local wins",
+			policy:        conflictLocal,
+			finalSync:     []rcloneResult{{}},
+			wantFinalSync: []string{"rclone", "sync", "vol-1", "minio:/base/pvc-1"},
+			wantCode:      codes.OK,
+		},
+		{
+			name:          "bisync newer wins",
+			policy:        conflictNewer,
+			finalSync:     []rcloneResult{{}},
+			wantFinalSync: []string{"rclone", "bisync", "vol-1", "minio:/base/pvc-1", "--workdir=vol-1.bisync", "--conflict-resolve=newer", "--resync"},
+			wantCode:      codes.OK,
+		},
+		{
+			name:          "final sync fails",
+			finalSync:     []rcloneResult{{output: "connection refused", err: errRcloneFailed}},
+			wantFinalSync: []string{"rclone", "copy", "--update", "vol-1", "minio:/base/pvc-1"},
+			wantCode:      codes.Unavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			td := newTestDriver(newFakeRclone(append([]rcloneResult{{}}, tc.finalSync...)...))
+			td.ns.syncer.dir = filepath.Join(dir, "sync")
+			// See TestSyncVolumeBisyncVersion.
+			td.ns.syncer.bisync.checked = true
+			targets := []string{filepath.Join(dir, "pod-1"), filepath.Join(dir, "pod-2")}
+
+			for _, target := range targets {
+				if _, err := td.ns.NodePublishVolume(context.Background(), syncPublishRequest(target, tc.policy)); err != nil {
+					t.Fatalf("NodePublishVolume failed: %v", err)
+				}
+				if notMnt, _ := td.mounter.IsLikelyNotMountPoint(target); notMnt {
+					t.Fatalf("expected %s to be bind-mounted", target)
+				}
+			}
+			if len(td.rclone.calls) != 1 || td.rclone.calls[0][1] != "copy" {
+				t.Fatalf("expected one copy of the remote, got %v", td.rclone.calls)
+			}
+			if len(mounterActions(td)) != 0 {
+				t.Errorf("expected no mounter for a sync volume, got %v", mounterActions(td))
+			}
+
+			for i, target := range targets {
+				_, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: target})
+				last := i == len(targets)-1
+				if !last {
+					if err != nil {
+						t.Fatalf("NodeUnpublishVolume failed: %v", err)
+					}
+					continue
+				}
+				if code := status.Code(err); code != tc.wantCode {
+					t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+				}
+			}
+
+			if len(td.rclone.calls) != 2 {
+				t.Fatalf("expected a final sync, got %v", td.rclone.calls)
+			}
+			finalSync := []string{}
+			for _, arg := range td.rclone.calls[1][:len(tc.wantFinalSync)] {
+				finalSync = append(finalSync, strings.ReplaceAll(arg, td.ns.syncer.dir+"/", ""))
+			}
+			if !reflect.DeepEqual(finalSync, tc.wantFinalSync) {
+				t.Errorf("expected final sync %v, got %v", tc.wantFinalSync, finalSync)
+			}
+
+			_, statErr := os.Stat(filepath.Join(dir, "sync", "vol-1"))
+			notMnt, _ := td.mounter.IsLikelyNotMountPoint(targets[1])
+			if tc.wantCode == codes.OK && (!os.IsNotExist(statErr) || !notMnt) {
+				t.Errorf("expected the node copy to be removed and the target unmounted")
+			}
+			if tc.wantCode != codes.OK && (statErr != nil || notMnt) {
+				t.Errorf("expected the node copy and target to be kept after a failed sync")
+			}
+		})
+	}
+}
+
+func TestSyncVolumeBisyncVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		rclone   []rcloneResult
+		wantCode codes.Code
+		wantCall string
+	}{
+		{
+			name:     "copy runs on any rclone",
+			rclone:   []rcloneResult{{}},
+			wantCode: codes.OK,
+			wantCall: "copy",
+		},
+		{
+			name:     "bisync on a recent rclone",
+			policy:   conflictNewer,
+			rclone:   []rcloneResult{{output: "rclone v1.66.0\n"}, {}},
+			wantCode: codes.OK,
+			wantCall: "version",
+		},
+		{
+			name:     "bisync on an old rclone",
+			policy:   conflictKeepBoth,
+			rclone:   []rcloneResult{{output: "rclone v1.65.2\n"}},
+			wantCode: codes.FailedPrecondition,
+			wantCall: "version",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			td := newTestDriver(newFakeRclone(tc.rclone...))
+			td.ns.syncer.dir = filepath.Join(dir, "sync")
+
+			_, err := td.ns.NodePublishVolume(context.Background(), syncPublishRequest(filepath.Join(dir, "pod-1"), tc.policy))
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if len(td.rclone.calls) != len(tc.rclone) || td.rclone.calls[0][1] != tc.wantCall {
+				t.Errorf("expected rclone %s first, got %v", tc.wantCall, td.rclone.calls)
+			}
+		})
+	}
+}
+
+func TestSyncVolumeRestart(t *testing.T) {
+	tests := []struct {
+		name         string
+		restoreState bool
+	}{
+		{name: "restored from the node state", restoreState: true},
+		{name: "node state lost"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			td := newTestDriver(newFakeRclone(rcloneResult{}, rcloneResult{}))
+			td.ns.syncer.dir = filepath.Join(dir, "sync")
+			target := filepath.Join(dir, "pod-1")
+			if _, err := td.ns.NodePublishVolume(context.Background(), syncPublishRequest(target, "")); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+
+			// The plugin restarts, leaving the node copy and its bind mount.
+			previous := td.ns.syncer
+			close(previous.volumes["vol-1"].stop)
+			td.ns.syncer = newSyncManager(td.rclone, td.mounter, previous.dir)
+			if tc.restoreState {
+				td.ns.syncer.restore(td.ns.state.list())
+				if v := td.ns.syncer.volumes["vol-1"]; v == nil || !v.targets[target] {
+					t.Fatalf("expected %s restored as a target of vol-1", target)
+				}
+			}
+
+			if _, err := td.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: target}); err != nil {
+				t.Fatalf("NodeUnpublishVolume failed: %v", err)
+			}
+			if len(td.rclone.calls) != 2 || td.rclone.calls[1][1] != "copy" {
+				t.Fatalf("expected a final sync, got %v", td.rclone.calls)
+			}
+			if notMnt, _ := td.mounter.IsLikelyNotMountPoint(target); !notMnt {
+				t.Errorf("expected %s unmounted", target)
+			}
+			if _, err := os.Stat(filepath.Join(previous.dir, "vol-1.json")); !os.IsNotExist(err) {
+				t.Errorf("expected the node copy to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSyncPublishCopyDoesNotBlockOtherVolumes(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	rclone := newFakeRclone(rcloneResult{wait: release}, rcloneResult{})
+	m := newSyncManager(rclone, &mount.FakeMounter{}, filepath.Join(dir, "sync"))
+	opts := syncOptions{interval: time.Hour, policy: conflictCopy}
+
+	slow := make(chan error, 1)
+	go func() {
+		slow <- m.Publish(context.Background(), &RcloneVolume{ID: "vol-1", Remote: "minio", RemotePath: "base/pvc-1"}, filepath.Join(dir, "pod-1"), "", opts)
+	}()
+	for {
+		rclone.mu.Lock()
+		copying := len(rclone.calls) == 1
+		rclone.mu.Unlock()
+		if copying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if m.Published("vol-3", filepath.Join(dir, "pod-3")) {
+			t.Errorf("expected vol-3 not to be published")
+		}
+		done <- m.Publish(context.Background(), &RcloneVolume{ID: "vol-2", Remote: "minio", RemotePath: "base/pvc-2"}, filepath.Join(dir, "pod-2"), "", opts)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("publishing vol-2 failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first copy of vol-1 held up vol-2")
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("publishing vol-1 failed: %v", err)
+	}
+	for _, v := range m.volumes {
+		close(v.stop)
+	}
+}
@@ -0,0 +1,244 @@
+package rclone
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/wunderio/csi-rclone/pkg/rc"
+	"golang.org/x/net/context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// tokenSyncInterval is how often mounters are asked for refreshed OAuth
+// tokens.
+var tokenSyncInterval = time.Minute
+
+// tokensHashAnnotation marks a node-publish secret written by syncTokens
+// with the hash of the rclone.conf it saved, so that the rotation watches
+// of the nodes skip it: the mounters already hold the refreshed tokens, and
+// mounters of other nodes pick them up on their own next token sync.
+const tokensHashAnnotation = "csi-rclone/tokens-hash"
+
+// tokensRefreshed tells whether the rclone.conf of secret was last written
+// by syncTokens.
+func tokensRefreshed(secret *corev1.Secret) bool {
+	hash, ok := secret.Annotations[tokensHashAnnotation]
+	return ok && hash == configHash(string(secret.Data["rclone.conf"]))
+}
+
+// syncTokens copies the OAuth tokens refreshed by the mounters on this node
+// back to the node-publish secret of their volume and to the mounter's
+// config copy, so that restarts keep them and the refresh token does not
+// expire unused.
+func (r *Rclone) syncTokens(ctx context.Context) error {
+	deployments, err := r.volumes.nodeDeployments(r.nodeID)
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments {
+		pv, err := r.volumes.persistentVolume(deployment.Labels["volumeid"])
+		if err != nil || pv.Spec.CSI.NodePublishSecretRef == nil {
+			continue
+		}
+		if err := r.syncVolumeTokens(ctx, deployment, pv); err != nil {
+			klog.Warningf("syncing OAuth tokens of volume %s: %v", pv.Spec.CSI.VolumeHandle, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rclone) syncVolumeTokens(ctx context.Context, deployment *appsv1.Deployment, pv *corev1.PersistentVolume) error {
+	copyData, err := r.mounterConfig(deployment.Name)
+	if err != nil {
+		return err
+	}
+	conf, err := parseRcloneConf(copyData)
+	if err != nil {
+		return err
+	}
+	attributes := pv.Spec.CSI.VolumeAttributes
+	multi, err := parseMultiRemote(attributes)
+	if err != nil {
+		return err
+	}
+	remotes := []string{}
+	for _, remote := range volumeRemotes(attributes, multi) {
+		if conf[remote]["token"] != "" {
+			remotes = append(remotes, remote)
+		}
+	}
+	if len(remotes) == 0 {
+		return nil
+	}
+
+	client, err := r.runningMounter(pv.Spec.CSI.VolumeHandle)
+	if client == nil || err != nil {
+		return err
+	}
+	mounterTokens := map[string]string{}
+	refreshed := map[string]string{}
+	for _, remote := range remotes {
+		options, err := client.ConfigGet(ctx, remote)
+		if err != nil {
+			return err
+		}
+		mounterTokens[remote] = options["token"]
+		if token := options["token"]; token != "" && token != conf[remote]["token"] {
+			refreshed[remote] = token
+		}
+	}
+
+	ref := pv.Spec.CSI.NodePublishSecretRef
+	var sourceData string
+	// Mounters of other volumes, on this node or others, may share the
+	// remote and refresh its token on their own. A token only replaces one
+	// that expires earlier, and an update racing another is retried on the
+	// fresh Secret.
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		source, err := r.kubeClient.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		sourceData = string(source.Data["rclone.conf"])
+		sourceConf, err := parseRcloneConf(sourceData)
+		if err != nil {
+			return err
+		}
+		updated := sourceData
+		for remote, token := range refreshed {
+			if newerToken(token, sourceConf[remote]["token"]) {
+				updated = setConfValue(updated, remote, "token", token)
+			}
+		}
+		if updated == sourceData {
+			return nil
+		}
+		source.Data["rclone.conf"] = []byte(updated)
+		if source.Annotations == nil {
+			source.Annotations = map[string]string{}
+		}
+		source.Annotations[tokensHashAnnotation] = configHash(updated)
+		if _, err := r.kubeClient.CoreV1().Secrets(ref.Namespace).Update(source); err != nil {
+			return err
+		}
+		klog.Infof("saved refreshed OAuth tokens of volume %s to secret %s/%s", pv.Spec.CSI.VolumeHandle, ref.Namespace, ref.Name)
+		sourceData = updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	newData := volumeConfig(sourceData, multi)
+	if newData != copyData {
+		if err := r.updateMounterConfig(deployment.Name, newData); err != nil {
+			return err
+		}
+	}
+	// The secret may hold a newer token, refreshed by another mounter.
+	newConf, err := parseRcloneConf(newData)
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		if token := newConf[remote]["token"]; token != "" && token != mounterTokens[remote] {
+			if err := client.ConfigUpdate(ctx, remote, map[string]string{"token": token}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runningMounter returns an rc client of a running mounter pod of the
+// volume, nil when there is none.
+func (r *Rclone) runningMounter(volumeId string) (*rc.Client, error) {
+	pod, err := r.runningMounterPod(volumeId)
+	if err != nil || pod == nil {
+		return nil, err
+	}
+	return r.mounterClient(pod)
+}
+
+// runningMounterPod returns a running mounter pod of the volume, nil when
+// there is none.
+func (r *Rclone) runningMounterPod(volumeId string) (*corev1.Pod, error) {
+	pods, err := ListPods(r.kubeClient, r.namespace, labels.FormatLabels(map[string]string{"volumeid": volumeId}))
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// newerToken tells whether the OAuth token a expires after b. Tokens whose
+// expiry cannot be read are taken as newer when they differ.
+func newerToken(a, b string) bool {
+	if b == "" {
+		return a != ""
+	}
+	var ta, tb struct {
+		Expiry time.Time `json:"expiry"`
+	}
+	if json.Unmarshal([]byte(a), &ta) != nil || json.Unmarshal([]byte(b), &tb) != nil || ta.Expiry.IsZero() || tb.Expiry.IsZero() {
+		return a != b
+	}
+	return ta.Expiry.After(tb.Expiry)
+}
+
+// setConfValue sets key of remote in rclone.conf data, keeping the rest of
+// the file as it is. The key is added at the end of the section when it is
+// missing.
+func setConfValue(data, remote, key, value string) string {
+	out := []string{}
+	inSection, done := false, false
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if inSection && !done {
+				out = insertBeforeBlank(out, key+" = "+value)
+				done = true
+			}
+			inSection = trimmed == "["+remote+"]"
+		} else if inSection && !done {
+			parts := strings.SplitN(trimmed, "=", 2)
+			if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+				line = key + " = " + value
+				done = true
+			}
+		}
+		out = append(out, line)
+	}
+	if inSection && !done {
+		out = insertBeforeBlank(out, key+" = "+value)
+	}
+	result := strings.Join(out, "\n")
+	if strings.HasSuffix(data, "\n") {
+		result += "\n"
+	}
+	return result
+}
+
+// insertBeforeBlank appends line to a section, ahead of the blank lines
+// separating it from the next one.
+func insertBeforeBlank(lines []string, line string) []string {
+	i := len(lines)
+	for i > 0 && strings.TrimSpace(lines[i-1]) == "" {
+		i--
+	}
+	return append(lines[:i], append([]string{line}, lines[i:]...)...)
+}
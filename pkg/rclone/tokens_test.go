@@ -0,0 +1,197 @@
+package rclone
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSetConfValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		remote string
+		want   string
+	}{
+		{
+			name:   "replaced",
+			data:   "[drive]\ntype = drive\ntoken = old\n\n[minio]\ntype = s3\n",
+			remote: "drive",
+			want:   "[drive]\ntype = drive\ntoken = new\n\n[minio]\ntype = s3\n",
+		},
+		{
+			name:   "added before the next section",
+			data:   "[drive]\ntype = drive\n\n[minio]\ntype = s3\ntoken = keep\n",
+			remote: "drive",
+			want:   "[drive]\ntype = drive\ntoken = new\n\n[minio]\ntype = s3\ntoken = keep\n",
+		},
+		{
+			name:   "added to the last section",
+			data:   "[minio]\ntype = s3\n\n[drive]\ntype = drive",
+			remote: "drive",
+			want:   "[minio]\ntype = s3\n\n[drive]\ntype = drive\ntoken = new",
+		},
+		{
+			name:   "unknown remote",
+			data:   "[minio]\ntype = s3\n",
+			remote: "drive",
+			want:   "[minio]\ntype = s3\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := setConfValue(tc.data, tc.remote, "token", "new"); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func testToken(access, expiry string) string {
+	return fmt.Sprintf(`{"access_token":%q,"token_type":"Bearer","refresh_token":"1//refresh","expiry":%q}`, access, expiry)
+}
+
+func TestNewerToken(t *testing.T) {
+	older := testToken("a", "2026-10-01T10:00:00Z")
+	newer := testToken("b", "2026-10-01T11:00:00Z")
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{newer, older, true},
+		{older, newer, false},
+		{newer, newer, false},
+		{newer, "", true},
+		{"opaque", "other", true},
+		{"opaque", "opaque", false},
+	}
+	for _, tc := range tests {
+		if got := newerToken(tc.a, tc.b); got != tc.want {
+			t.Errorf("newerToken(%s, %s): expected %v, got %v", tc.a, tc.b, tc.want, got)
+		}
+	}
+}
+
+func TestSyncTokens(t *testing.T) {
+	original := testToken("original", "2026-10-01T10:00:00Z")
+	refreshed := testToken("refreshed", "2026-10-01T11:00:00Z")
+	byOtherMount := testToken("other", "2026-10-01T12:00:00Z")
+	conf := func(token string) string {
+		return "[drive]\ntype = drive\ntoken = " + token + "\n"
+	}
+	tests := []struct {
+		name         string
+		source       string
+		mounterToken string
+		conflict     bool
+		wantSource   string
+		wantCopy     string
+		wantPushed   []string
+	}{
+		{
+			name:         "refreshed token saved",
+			source:       original,
+			mounterToken: refreshed,
+			wantSource:   refreshed,
+			wantCopy:     refreshed,
+		},
+		{
+			name:         "saved after a conflict",
+			source:       original,
+			mounterToken: refreshed,
+			conflict:     true,
+			wantSource:   refreshed,
+			wantCopy:     refreshed,
+		},
+		{
+			name:         "newer token of another mount kept",
+			source:       byOtherMount,
+			mounterToken: refreshed,
+			wantSource:   byOtherMount,
+			wantCopy:     byOtherMount,
+			wantPushed:   []string{byOtherMount},
+		},
+		{
+			name:         "not refreshed",
+			source:       original,
+			mounterToken: original,
+			wantSource:   original,
+			wantCopy:     original,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pv := testPV("pv-1", "vol-1", "drive", "base/pvc-1")
+			pv.Spec.CSI.NodePublishSecretRef = &corev1.SecretReference{Namespace: "default", Name: "rclone-secret"}
+			vol := &RcloneVolume{ID: "vol-1"}
+			mounterLabels := map[string]string{"volumeid": "vol-1", "hash": configHash(conf(original))}
+			objects := []runtime.Object{
+				pv,
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "rclone-secret", Namespace: "default"},
+					Data:       map[string][]byte{"rclone.conf": []byte(conf(tc.source))},
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: vol.deploymentName(), Namespace: testNamespace, Labels: mounterLabels},
+					Data:       map[string][]byte{"rclone.conf": []byte(conf(original))},
+				},
+				&appsv1.Deployment{
+					ObjectMeta: metav1.ObjectMeta{Name: vol.deploymentName(), Namespace: testNamespace, Labels: mounterLabels},
+					Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{NodeName: testNodeID}}},
+				},
+				servingPod(true),
+			}
+			td := newTestDriver(newFakeRclone(), objects...)
+			if tc.conflict {
+				conflicted := false
+				td.kubeClient.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					if conflicted || action.GetNamespace() != "default" {
+						return false, nil, nil
+					}
+					conflicted = true
+					return true, nil, k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "rclone-secret", fmt.Errorf("changed"))
+				})
+			}
+			rc := newFakeRc(t, map[string]fakeRcHandler{
+				"config/get": func(map[string]interface{}) (interface{}, error) {
+					return map[string]string{"type": "drive", "token": tc.mounterToken}, nil
+				},
+			})
+			ops := td.ns.RcloneOps.(*Rclone)
+			ops.rcAddress = func(*corev1.Pod) (string, error) { return rc.addr, nil }
+
+			if err := ops.syncTokens(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			source, _ := td.kubeClient.CoreV1().Secrets("default").Get("rclone-secret", metav1.GetOptions{})
+			if got := string(source.Data["rclone.conf"]); got != conf(tc.wantSource) {
+				t.Errorf("expected the secret to hold %q, got %q", conf(tc.wantSource), got)
+			}
+			if saved := tc.wantSource != tc.source; tokensRefreshed(source) != saved {
+				t.Errorf("expected the secret marked as saved by the token sync %v, got annotations %v", saved, source.Annotations)
+			}
+			copyData, _ := ops.mounterConfig(vol.deploymentName())
+			if copyData != conf(tc.wantCopy) {
+				t.Errorf("expected the mounter copy to hold %q, got %q", conf(tc.wantCopy), copyData)
+			}
+			pushed := []string{}
+			for _, call := range rc.calls("config/update") {
+				pushed = append(pushed, call.params["parameters"].(map[string]interface{})["token"].(string))
+			}
+			if fmt.Sprint(pushed) != fmt.Sprint(append([]string{}, tc.wantPushed...)) {
+				t.Errorf("expected tokens %v pushed to the mounter, got %v", tc.wantPushed, pushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package rclone
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// topologyEndpointsKey is the StorageClass parameter mapping values of the
+	// first topology key to remote endpoints, e.g. "zone-a=http://minio-a:9000,zone-b=http://minio-b:9000".
+	topologyEndpointsKey = "topologyEndpoints"
+	// endpointFlagKey names the rclone flag the endpoint is passed as, e.g. "s3-endpoint".
+	endpointFlagKey = "endpointFlag"
+)
+
+// parseTopologyEndpoints parses a topologyEndpointsKey parameter.
+func parseTopologyEndpoints(value string) (map[string]string, error) {
+	endpoints := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected <topology value>=<endpoint>", topologyEndpointsKey, entry)
+		}
+		endpoints[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("%s is empty", topologyEndpointsKey)
+	}
+	return endpoints, nil
+}
+
+// nodeTopology returns the segments of nodeID for the given label keys,
+// skipping labels the node does not have.
+func nodeTopology(kubeClient kubernetes.Interface, nodeID string, keys []string) (map[string]string, error) {
+	node, err := kubeClient.CoreV1().Nodes().Get(nodeID, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("node %s not found", nodeID)
+	}
+	segments := map[string]string{}
+	for _, key := range keys {
+		if value, ok := node.Labels[key]; ok {
+			segments[key] = value
+		}
+	}
+	return segments, nil
+}
+
+// accessibleTopology picks the topologies a new volume is reachable from.
+// Without endpoints the remote is reachable everywhere, so the requirement is
+// returned as is. With endpoints only topologies whose first key has an
+// endpoint qualify, preferred ones first. A nil result means no constraint.
+func accessibleTopology(req *csi.TopologyRequirement, keys []string, endpoints map[string]string) ([]*csi.Topology, error) {
+	if len(endpoints) == 0 {
+		if len(req.GetRequisite()) > 0 {
+			return req.GetRequisite(), nil
+		}
+		return req.GetPreferred(), nil
+	}
+
+	candidates := append(append([]*csi.Topology{}, req.GetPreferred()...), req.GetRequisite()...)
+	if len(candidates) == 0 {
+		values := make([]string, 0, len(endpoints))
+		for value := range endpoints {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			candidates = append(candidates, &csi.Topology{Segments: map[string]string{keys[0]: value}})
+		}
+	}
+
+	seen := map[string]bool{}
+	topologies := []*csi.Topology{}
+	for _, t := range candidates {
+		value := t.GetSegments()[keys[0]]
+		// Topologies of one zone still differ by their other keys, such as
+		// the hostname, all of them are kept.
+		segments := segmentsKey(t.GetSegments())
+		if _, ok := endpoints[value]; !ok || seen[segments] {
+			continue
+		}
+		seen[segments] = true
+		topologies = append(topologies, t)
+	}
+	if len(topologies) == 0 {
+		return nil, fmt.Errorf("no %s endpoint for the requested topology %v", keys[0], candidates)
+	}
+	return topologies, nil
+}
+
+// segmentsKey identifies a topology by all its segments.
+func segmentsKey(segments map[string]string) string {
+	pairs := make([]string, 0, len(segments))
+	for k, v := range segments {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
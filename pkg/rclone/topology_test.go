@@ -0,0 +1,252 @@
+package rclone
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	zoneKey     = "topology.kubernetes.io/zone"
+	hostnameKey = "kubernetes.io/hostname"
+)
+
+func zone(name string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{zoneKey: name}}
+}
+
+// zoneHost is a topology with a zone and a hostname segment.
+func zoneHost(zoneName, host string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{zoneKey: zoneName, hostnameKey: host}}
+}
+
+func testNode(zoneName string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   testNodeID,
+		Labels: map[string]string{zoneKey: zoneName, "kubernetes.io/os": "linux"},
+	}}
+}
+
+func TestAccessibleTopology(t *testing.T) {
+	endpoints := map[string]string{"zone-a": "http://minio-a:9000", "zone-b": "http://minio-b:9000"}
+	tests := []struct {
+		name      string
+		req       *csi.TopologyRequirement
+		keys      []string
+		endpoints map[string]string
+		want      []*csi.Topology
+		wantErr   bool
+	}{
+		{
+			name: "no endpoints keeps requisite",
+			req:  &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-a"), zone("zone-c")}},
+			want: []*csi.Topology{zone("zone-a"), zone("zone-c")},
+		},
+		{
+			name: "no endpoints and no requirement",
+			want: nil,
+		},
+		{
+			name:      "endpoints filter requisite, preferred first",
+			req:       &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-a"), zone("zone-b"), zone("zone-c")}, Preferred: []*csi.Topology{zone("zone-b")}},
+			endpoints: endpoints,
+			want:      []*csi.Topology{zone("zone-b"), zone("zone-a")},
+		},
+		{
+			name:      "endpoints without requirement",
+			endpoints: endpoints,
+			want:      []*csi.Topology{zone("zone-a"), zone("zone-b")},
+		},
+		{
+			name: "several keys keep every node of a zone",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zoneHost("zone-a", "node-1"), zoneHost("zone-a", "node-2"), zoneHost("zone-c", "node-3")},
+				Preferred: []*csi.Topology{zoneHost("zone-a", "node-2")},
+			},
+			keys:      []string{zoneKey, hostnameKey},
+			endpoints: endpoints,
+			want:      []*csi.Topology{zoneHost("zone-a", "node-2"), zoneHost("zone-a", "node-1")},
+		},
+		{
+			name:      "no endpoint in requested zones",
+			req:       &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-c")}},
+			endpoints: endpoints,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := tc.keys
+			if keys == nil {
+				keys = []string{zoneKey}
+			}
+			got, err := accessibleTopology(tc.req, keys, tc.endpoints)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	params := map[string]string{
+		"remote":             "minio",
+		"path":               "base",
+		topologyEndpointsKey: "zone-a=http://minio-a:9000, zone-b=http://minio-b:9000",
+		endpointFlagKey:      "s3-endpoint",
+	}
+	tests := []struct {
+		name         string
+		topologyKeys []string
+		params       map[string]string
+		requirement  *csi.TopologyRequirement
+		rclone       []rcloneResult
+		wantCode     codes.Code
+		wantTopology []*csi.Topology
+	}{
+		{
+			name:     "endpoints without topology keys",
+			params:   params,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:         "missing endpoint flag",
+			topologyKeys: []string{zoneKey},
+			params:       map[string]string{"remote": "minio", "path": "base", topologyEndpointsKey: "zone-a=http://minio-a:9000"},
+			wantCode:     codes.InvalidArgument,
+		},
+		{
+			name:         "unsatisfiable requirement",
+			topologyKeys: []string{zoneKey},
+			params:       params,
+			requirement:  &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-c")}},
+			wantCode:     codes.ResourceExhausted,
+		},
+		{
+			name:         "zones with an endpoint",
+			topologyKeys: []string{zoneKey},
+			params:       params,
+			requirement:  &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-a"), zone("zone-c")}},
+			rclone:       []rcloneResult{{}, {}},
+			wantCode:     codes.OK,
+			wantTopology: []*csi.Topology{zone("zone-a")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(tc.rclone...))
+			td.cs.topologyKeys = tc.topologyKeys
+
+			resp, err := td.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:                      "pvc-1",
+				VolumeCapabilities:        []*csi.VolumeCapability{testVolumeCapability},
+				Parameters:                tc.params,
+				Secrets:                   testSecrets,
+				AccessibilityRequirements: tc.requirement,
+			})
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.wantCode, code, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(resp.GetVolume().GetAccessibleTopology(), tc.wantTopology) {
+				t.Errorf("expected topology %v, got %v", tc.wantTopology, resp.GetVolume().GetAccessibleTopology())
+			}
+			ctx := resp.GetVolume().GetVolumeContext()
+			if ctx[topologyEndpointsKey] != params[topologyEndpointsKey] || ctx[endpointFlagKey] != "s3-endpoint" {
+				t.Errorf("expected endpoints in volume context, got %v", ctx)
+			}
+		})
+	}
+}
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	td := newTestDriver(newFakeRclone(), testNode("zone-a"))
+	td.ns.topologyKeys = []string{zoneKey, "topology.kubernetes.io/region"}
+
+	resp, err := td.ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetNodeId() != testNodeID {
+		t.Errorf("expected node id %s, got %s", testNodeID, resp.GetNodeId())
+	}
+	want := map[string]string{zoneKey: "zone-a"}
+	if !reflect.DeepEqual(resp.GetAccessibleTopology().GetSegments(), want) {
+		t.Errorf("expected segments %v, got %v", want, resp.GetAccessibleTopology().GetSegments())
+	}
+}
+
+func TestNodePublishVolumeTopologyEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		zone     string
+		wantArg  string
+		unwanted string
+	}{
+		{name: "nearest endpoint", zone: "zone-b", wantArg: "--s3-endpoint=http://minio-b:9000"},
+		{name: "no endpoint for zone", zone: "zone-c", unwanted: "--s3-endpoint"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), testNode(tc.zone))
+			td.ns.topologyKeys = []string{zoneKey}
+			req := testPublishRequest(filepath.Join(t.TempDir(), "target"))
+			req.VolumeContext[topologyEndpointsKey] = "zone-a=http://minio-a:9000,zone-b=http://minio-b:9000"
+			req.VolumeContext[endpointFlagKey] = "s3-endpoint"
+
+			if _, err := td.ns.NodePublishVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			deployment, err := td.kubeClient.AppsV1().Deployments(testNamespace).Get("rclone-mounter-vol-1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := deployment.Spec.Template.Spec.Containers[0].Args
+			if tc.wantArg != "" && !contains(args, tc.wantArg) {
+				t.Errorf("expected argument %s in %v", tc.wantArg, args)
+			}
+			for _, arg := range args {
+				if tc.unwanted != "" && strings.HasPrefix(arg, tc.unwanted) {
+					t.Errorf("unexpected argument %s", arg)
+				}
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeTopologyEndpointSync(t *testing.T) {
+	dir := t.TempDir()
+	td := newTestDriver(newFakeRclone(rcloneResult{}), testNode("zone-b"))
+	td.ns.topologyKeys = []string{zoneKey}
+	td.ns.syncer.dir = filepath.Join(dir, "sync")
+	req := syncPublishRequest(filepath.Join(dir, "target"), "")
+	req.VolumeContext[topologyEndpointsKey] = "zone-a=http://minio-a:9000,zone-b=http://minio-b:9000"
+	req.VolumeContext[endpointFlagKey] = "s3-endpoint"
+
+	if _, err := td.ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	defer close(td.ns.syncer.volumes["vol-1"].stop)
+	if len(td.rclone.calls) != 1 || !contains(td.rclone.calls[0], "--s3-endpoint=http://minio-b:9000") {
+		t.Errorf("expected the copy to use the zone endpoint, got %v", td.rclone.calls)
+	}
+	if flags := td.ns.syncer.volumes["vol-1"].opts.flags; !contains(flags, "--s3-endpoint=http://minio-b:9000") {
+		t.Errorf("expected the background sync to use the zone endpoint, got %v", flags)
+	}
+}
@@ -0,0 +1,296 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// staleCheckInterval is how often the targets published on the node are
+// checked for stale mounts.
+var staleCheckInterval = 30 * time.Second
+
+// staleStatTimeout bounds the stat of a target. A hung mount may still
+// recover and is left alone.
+var staleStatTimeout = 10 * time.Second
+
+// Repairs of a target back off from staleRepairBackoff, doubling with every
+// failed attempt up to staleRepairMaxBackoff.
+var (
+	staleRepairBackoff    = 30 * time.Second
+	staleRepairMaxBackoff = 10 * time.Minute
+)
+
+// staleMountError tells whether err, from a target, means its mount lost its
+// server: the rclone process is gone (ENOTCONN) or the NFS server was
+// replaced (ESTALE).
+func staleMountError(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ESTALE)
+}
+
+// staleRepair is the backoff of the repairs of one target.
+type staleRepair struct {
+	failures int
+	next     time.Time
+	// remounted is set once the target is mounted again, while the pod
+	// it is published to still has to be restarted.
+	remounted bool
+}
+
+// kubeletTargetPattern matches the target path kubelet publishes a CSI
+// volume of a pod at, capturing the pod UID and the PV name.
+var kubeletTargetPattern = regexp.MustCompile(`/pods/([^/]+)/volumes/kubernetes\.io~csi/([^/]+)/mount$`)
+
+// mountWatchdog finds published targets whose mount went stale, for example
+// because the mounter crashed, and mounts them again: the stale mount is
+// lazily unmounted, the mounter restarted and the new mount waited for. The
+// containers of the pod the target is published to keep the stale mount
+// unless they mount the volume with HostToContainer propagation, so with
+// evict set the pod is then evicted for its controller to replace it.
+type mountWatchdog struct {
+	ns *nodeServer
+	// volumes finds the pods of targets and their PVs, see
+	// volumeCache.startConsumers.
+	volumes *volumeCache
+	evict   bool
+	// stat stats a target, os.Stat by default.
+	stat func(path string) error
+	// stats runs stat, one call per target at a time.
+	stats *targetProbes
+	now   func() time.Time
+
+	mu      sync.Mutex
+	repairs map[string]*staleRepair
+}
+
+func newMountWatchdog(ns *nodeServer) *mountWatchdog {
+	return &mountWatchdog{
+		ns:      ns,
+		volumes: ns.reporter.volumes,
+		stat: func(path string) error {
+			_, err := os.Stat(path)
+			return err
+		},
+		stats:   newTargetProbes(),
+		now:     time.Now,
+		repairs: map[string]*staleRepair{},
+	}
+}
+
+// check repairs the stale mounts of the targets published on this node.
+// Sync mode targets are bind mounts of a node directory and never go stale.
+func (w *mountWatchdog) check(ctx context.Context) {
+	published := map[string]bool{}
+	for _, v := range w.ns.state.list() {
+		published[v.TargetPath] = true
+		if v.Sync || !w.due(v.TargetPath) {
+			continue
+		}
+		err := w.statTarget(v.TargetPath)
+		if !staleMountError(err) {
+			if err != nil {
+				klog.V(4).Infof("not repairing %s: %v", v.TargetPath, err)
+			}
+			w.mu.Lock()
+			repair, ok := w.repairs[v.TargetPath]
+			if ok && repair.remounted && err == nil {
+				w.mu.Unlock()
+				w.repair(ctx, v, nil)
+				continue
+			}
+			delete(w.repairs, v.TargetPath)
+			w.mu.Unlock()
+			continue
+		}
+		w.repair(ctx, v, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for target := range w.repairs {
+		if !published[target] {
+			delete(w.repairs, target)
+		}
+	}
+}
+
+// due tells whether the backoff of targetPath allows a repair.
+func (w *mountWatchdog) due(targetPath string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	repair, ok := w.repairs[targetPath]
+	return !ok || !w.now().Before(repair.next)
+}
+
+// statTarget stats targetPath, giving up after staleStatTimeout. A stat
+// still hung from an earlier check is waited for instead of starting
+// another.
+func (w *mountWatchdog) statTarget(targetPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), staleStatTimeout)
+	defer cancel()
+	err := w.stats.run(ctx, targetPath, func() error { return w.stat(targetPath) })
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("stat of %s hung for %v", targetPath, staleStatTimeout)
+	}
+	return err
+}
+
+// repair mounts the stale target of v again and restarts the pod it is
+// published to, unless a publish or unpublish of it is running, and backs
+// off when that fails. Without cause the target was already mounted again
+// and only the pod is left.
+func (w *mountWatchdog) repair(ctx context.Context, v publishedVolume, cause error) {
+	lockKeys := []string{volumeLockKey(v.VolumeID), targetLockKey(v.TargetPath)}
+	if err := w.ns.locks.acquire(v.VolumeID, lockKeys...); err != nil {
+		klog.V(4).Infof("not repairing %s now: %v", v.TargetPath, err)
+		return
+	}
+	defer w.ns.locks.Release(lockKeys...)
+
+	start := time.Now()
+	var err error
+	if cause != nil {
+		klog.Warningf("mount of volume %s at %s is stale: %v", v.VolumeID, v.TargetPath, cause)
+		staleMounts.Inc()
+		w.ns.reporter.stale(v.VolumeID, v.TargetPath, cause)
+		err = w.remount(ctx, v)
+	}
+	remounted := err == nil
+	if remounted {
+		err = w.restartConsumer(v)
+	}
+	observeMountRepair(start, err)
+
+	w.mu.Lock()
+	var retry time.Duration
+	if err == nil {
+		delete(w.repairs, v.TargetPath)
+	} else {
+		repair, ok := w.repairs[v.TargetPath]
+		if !ok {
+			repair = &staleRepair{}
+			w.repairs[v.TargetPath] = repair
+		}
+		repair.remounted = remounted
+		retry = staleRepairBackoff << uint(repair.failures)
+		if retry > staleRepairMaxBackoff || retry <= 0 {
+			retry = staleRepairMaxBackoff
+		} else {
+			repair.failures++
+		}
+		repair.next = w.now().Add(retry)
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		klog.Errorf("repairing the mount of volume %s at %s failed, retrying in %v: %v", v.VolumeID, v.TargetPath, retry, err)
+	} else {
+		klog.Infof("repaired the mount of volume %s at %s", v.VolumeID, v.TargetPath)
+	}
+	w.ns.reporter.repaired(v.VolumeID, v.TargetPath, retry, err)
+}
+
+// remount lazily unmounts the stale target of v, which cannot be unmounted
+// normally while pods hold it open, restarts its mounter and waits for the
+// new mount.
+func (w *mountWatchdog) remount(ctx context.Context, v publishedVolume) error {
+	ops := w.ns.RcloneOps
+	if v.MountType != "" && v.MountType != mountTypeFuse {
+		if ops = w.ns.serveOps[v.MountType]; ops == nil {
+			return fmt.Errorf("%s %s needs the deployment mounter", mountTypeKey, v.MountType)
+		}
+	}
+	if out, err := w.ns.mounter.Exec.Run("umount", "-l", v.TargetPath); err != nil {
+		return fmt.Errorf("lazy unmount of %s failed: %v: %s", v.TargetPath, err, strings.TrimSpace(string(out)))
+	}
+	vol := &RcloneVolume{ID: v.VolumeID, Remote: v.Remote, RemotePath: v.RemotePath}
+	if err := ops.Remount(ctx, vol, v.TargetPath); err != nil {
+		return err
+	}
+	return w.ns.waitForMount(ctx, ops, vol, v.TargetPath)
+}
+
+// restartConsumer evicts the pod the target of v is published to, unless
+// eviction is disabled or every container mounting the volume uses
+// HostToContainer or Bidirectional propagation and so sees the repaired
+// mount. Pods no controller owns would not come back and are left alone. The
+// eviction honours the disruption budgets of the pod.
+func (w *mountWatchdog) restartConsumer(v publishedVolume) error {
+	if !w.evict {
+		return nil
+	}
+	match := kubeletTargetPattern.FindStringSubmatch(v.TargetPath)
+	if match == nil {
+		return nil
+	}
+	podUID, volumeName := types.UID(match[1]), match[2]
+	pod, err := w.volumes.nodePod(podUID)
+	if err != nil {
+		return fmt.Errorf("finding the pod of %s: %v", v.TargetPath, err)
+	}
+	if pod == nil || pod.DeletionTimestamp != nil {
+		// The pod is gone or going, its replacement mounts the target again.
+		return nil
+	}
+	propagates, err := w.propagatesMount(pod, volumeName)
+	if err != nil || propagates {
+		return err
+	}
+	if metav1.GetControllerOf(pod) == nil {
+		klog.Warningf("pod %s/%s keeps the stale mount of volume %s, not evicting it as no controller owns it", pod.Namespace, pod.Name, v.VolumeID)
+		w.ns.reporter.staleConsumer(v.VolumeID, v.TargetPath, pod)
+		return nil
+	}
+	klog.Infof("evicting pod %s/%s, its containers still have the stale mount of volume %s", pod.Namespace, pod.Name, v.VolumeID)
+	err = w.ns.kubeClient.CoreV1().Pods(pod.Namespace).Evict(&policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+	})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	w.ns.reporter.evicted(v.VolumeID, v.TargetPath, pod, err)
+	if err != nil {
+		return fmt.Errorf("pod %s/%s keeps the stale mount, evicting it failed: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
+
+// propagatesMount tells whether every container of pod mounting the claim of
+// the PV volumeName receives mounts made later on the node.
+func (w *mountWatchdog) propagatesMount(pod *corev1.Pod, volumeName string) (bool, error) {
+	pv, err := w.volumes.namedPersistentVolume(volumeName)
+	if err != nil {
+		return false, fmt.Errorf("volume %s of pod %s/%s: %v", volumeName, pod.Namespace, pod.Name, err)
+	}
+	claim := pv.Spec.ClaimRef
+	podVolumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if source := volume.PersistentVolumeClaim; source != nil && claim != nil {
+			podVolumes[volume.Name] = claim.Namespace == pod.Namespace && claim.Name == source.ClaimName
+		}
+	}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		for _, m := range c.VolumeMounts {
+			if !podVolumes[m.Name] {
+				continue
+			}
+			if m.MountPropagation == nil || *m.MountPropagation == corev1.MountPropagationNone {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,345 @@
+package rclone
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestMountWatchdog(t *testing.T) {
+	mountReadyTimeout = 200 * time.Millisecond
+	mountReadyInterval = 10 * time.Millisecond
+	defer func() {
+		mountReadyTimeout = time.Minute
+		mountReadyInterval = 500 * time.Millisecond
+	}()
+
+	tests := []struct {
+		name        string
+		statErr     error
+		noMounter   bool
+		wantRepair  bool
+		wantEvents  []string
+		wantBackoff time.Duration
+	}{
+		{name: "healthy"},
+		{name: "backend error", statErr: syscall.EIO},
+		{
+			name:       "rclone gone",
+			statErr:    syscall.ENOTCONN,
+			wantRepair: true,
+			wantEvents: []string{"Warning MountStale", "Normal MountRepaired"},
+		},
+		{
+			name:       "stale handle",
+			statErr:    syscall.ESTALE,
+			wantRepair: true,
+			wantEvents: []string{"Warning MountStale", "Normal MountRepaired"},
+		},
+		{
+			name:        "mounter gone",
+			statErr:     syscall.ENOTCONN,
+			noMounter:   true,
+			wantRepair:  true,
+			wantEvents:  []string{"Warning MountStale", "Warning MountRepairFailed"},
+			wantBackoff: staleRepairBackoff,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			td := newTestDriver(newFakeRclone(), testPV("pv-1", "vol-1", "minio", "base/pvc-1"))
+			var mu sync.Mutex
+			unmounted := []string{}
+			td.ns.mounter.Exec = mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if cmd == "umount" {
+					unmounted = append(unmounted, strings.Join(args, " "))
+					td.mounter.Unmount(args[len(args)-1])
+				}
+				return nil, nil
+			})
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if _, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(targetPath)); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			if tc.noMounter {
+				td.kubeClient.AppsV1().Deployments(testNamespace).Delete("rclone-mounter-vol-1", &metav1.DeleteOptions{})
+			}
+			for len(td.recorder.Events) > 0 {
+				<-td.recorder.Events
+			}
+
+			w := td.ns.watchdog
+			now := time.Now()
+			w.now = func() time.Time { return now }
+			stale := tc.statErr
+			w.stat = func(path string) error {
+				if path != targetPath || stale == nil {
+					return nil
+				}
+				return &os.PathError{Op: "stat", Path: path, Err: stale}
+			}
+			w.check(context.Background())
+
+			wantUnmounted := []string{}
+			if tc.wantRepair {
+				wantUnmounted = append(wantUnmounted, "-l "+targetPath)
+			}
+			if strings.Join(unmounted, ",") != strings.Join(wantUnmounted, ",") {
+				t.Errorf("expected unmounts %q, got %q", wantUnmounted, unmounted)
+			}
+			events := []string{}
+			for len(td.recorder.Events) > 0 {
+				events = append(events, <-td.recorder.Events)
+			}
+			for _, want := range tc.wantEvents {
+				found := false
+				for _, event := range events {
+					found = found || strings.HasPrefix(event, want)
+				}
+				if !found {
+					t.Errorf("expected event %q in %q", want, events)
+				}
+			}
+			if notMnt, _ := td.mounter.IsLikelyNotMountPoint(targetPath); tc.wantRepair && tc.wantBackoff == 0 && notMnt {
+				t.Errorf("expected %s mounted again", targetPath)
+			}
+
+			if tc.wantBackoff == 0 {
+				if len(w.repairs) != 0 {
+					t.Errorf("expected no repair pending, got %v", w.repairs)
+				}
+				return
+			}
+			// Not tried again before the backoff passed.
+			w.check(context.Background())
+			if len(unmounted) != 1 {
+				t.Errorf("expected no repair within the backoff, got unmounts %q", unmounted)
+			}
+			now = now.Add(tc.wantBackoff)
+			w.check(context.Background())
+			if len(unmounted) != 2 {
+				t.Errorf("expected a repair after the backoff, got unmounts %q", unmounted)
+			}
+			if next := w.repairs[targetPath].next; !next.Equal(now.Add(2 * tc.wantBackoff)) {
+				t.Errorf("expected the next repair after %v, got %v", 2*tc.wantBackoff, next.Sub(now))
+			}
+		})
+	}
+}
+
+func TestMountWatchdogRestartsConsumer(t *testing.T) {
+	mountReadyTimeout = 200 * time.Millisecond
+	mountReadyInterval = 10 * time.Millisecond
+	defer func() {
+		mountReadyTimeout = time.Minute
+		mountReadyInterval = 500 * time.Millisecond
+	}()
+	hostToContainer := corev1.MountPropagationHostToContainer
+
+	tests := []struct {
+		name         string
+		propagation  *corev1.MountPropagationMode
+		noPod        bool
+		noController bool
+		noEviction   bool
+		evictErr     error
+		wantEvicted  bool
+		wantPodEvent string
+		wantEvent    string
+	}{
+		{name: "private mount evicted", wantEvicted: true, wantPodEvent: "Normal Evicted", wantEvent: "Normal MountRepaired"},
+		{name: "propagated mount kept", propagation: &hostToContainer, wantEvent: "Normal MountRepaired"},
+		{name: "pod gone", noPod: true, wantEvent: "Normal MountRepaired"},
+		{name: "eviction disabled", noEviction: true, wantEvent: "Normal MountRepaired"},
+		{name: "pod without controller kept", noController: true, wantPodEvent: "Warning MountStaleInPod", wantEvent: "Normal MountRepaired"},
+		{
+			name:         "eviction refused",
+			evictErr:     k8serrors.NewTooManyRequests("disruption budget", 10),
+			wantEvicted:  true,
+			wantPodEvent: "Warning EvictionFailed",
+			wantEvent:    "Warning MountRepairFailed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			isController := true
+			consumer := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1", OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-1", UID: "rs-1", Controller: &isController,
+				}}},
+				Spec: corev1.PodSpec{
+					NodeName: testNodeID,
+					Volumes: []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+					}}},
+					Containers: []corev1.Container{{
+						Name:         "app",
+						VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data", MountPropagation: tc.propagation}},
+					}},
+				},
+			}
+			if tc.noController {
+				consumer.OwnerReferences = nil
+			}
+			// The claim of the PV is default/data.
+			objects := []runtime.Object{testPV("pv-1", "vol-1", "minio", "base/pvc-1")}
+			if !tc.noPod {
+				objects = append(objects, consumer)
+			}
+			td := newTestDriver(newFakeRclone(), objects...)
+			evicted := []string{}
+			evictErr := tc.evictErr
+			td.kubeClient.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "eviction" {
+					return false, nil, nil
+				}
+				eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+				evicted = append(evicted, eviction.Namespace+"/"+eviction.Name)
+				return true, nil, evictErr
+			})
+			td.ns.mounter.Exec = mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "umount" {
+					td.mounter.Unmount(args[len(args)-1])
+				}
+				return nil, nil
+			})
+			targetPath := filepath.Join(t.TempDir(), "pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount")
+			if _, err := td.ns.NodePublishVolume(context.Background(), testPublishRequest(targetPath)); err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			for len(td.recorder.Events) > 0 {
+				<-td.recorder.Events
+			}
+
+			w := td.ns.watchdog
+			w.evict = !tc.noEviction
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			if w.evict {
+				w.volumes.startConsumers(stopCh)
+			}
+			w.volumes.start(false, stopCh)
+			if !cache.WaitForCacheSync(stopCh, w.volumes.synced) {
+				t.Fatal("volume cache not synced")
+			}
+			td.kubeClient.ClearActions()
+			now := time.Now()
+			w.now = func() time.Time { return now }
+			stale := true
+			w.stat = func(path string) error {
+				if !stale {
+					return nil
+				}
+				return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN}
+			}
+			w.check(context.Background())
+
+			for _, action := range td.kubeClient.Actions() {
+				if action.GetNamespace() == "" && action.GetVerb() == "list" || action.GetResource().Resource == "persistentvolumeclaims" {
+					t.Errorf("expected the pod and its claim found in the cache, got %s %s", action.GetVerb(), action.GetResource().Resource)
+				}
+			}
+			if got := len(evicted) > 0; got != tc.wantEvicted {
+				t.Errorf("expected the consumer evicted %v, got %v", tc.wantEvicted, evicted)
+			}
+			events := []string{}
+			for len(td.recorder.Events) > 0 {
+				events = append(events, <-td.recorder.Events)
+			}
+			if len(events) == 0 || !strings.HasPrefix(events[len(events)-1], tc.wantEvent) {
+				t.Errorf("expected last event %q, got %q", tc.wantEvent, events)
+			}
+			podEvents := 0
+			for _, event := range events {
+				if strings.HasPrefix(event, "Normal Evicted") || strings.HasPrefix(event, "Warning EvictionFailed") || strings.HasPrefix(event, "Warning MountStaleInPod") {
+					podEvents++
+					if tc.wantPodEvent == "" || !strings.HasPrefix(event, tc.wantPodEvent) {
+						t.Errorf("expected pod event %q, got %q", tc.wantPodEvent, event)
+					}
+				}
+			}
+			// On the pod, the PV and its claim.
+			if tc.wantPodEvent != "" && podEvents != 3 {
+				t.Errorf("expected %q on the pod, the PV and its claim, got %q", tc.wantPodEvent, events)
+			}
+			if tc.evictErr == nil {
+				return
+			}
+
+			// The target is mounted again, the next attempt only evicts.
+			stale = false
+			evictErr = nil
+			now = now.Add(staleRepairBackoff)
+			td.kubeClient.ClearActions()
+			w.check(context.Background())
+			if len(evicted) != 2 {
+				t.Errorf("expected the eviction tried again, got %v", evicted)
+			}
+			if contains(td.actions(), "delete pods") {
+				t.Errorf("expected the mounter kept, got %v", td.actions())
+			}
+			events = nil
+			for len(td.recorder.Events) > 0 {
+				events = append(events, <-td.recorder.Events)
+			}
+			if len(events) == 0 || !strings.HasPrefix(events[len(events)-1], "Normal MountRepaired") {
+				t.Errorf("expected MountRepaired once the pod is evicted, got %q", events)
+			}
+			if len(w.repairs) != 0 {
+				t.Errorf("expected no repair pending, got %v", w.repairs)
+			}
+		})
+	}
+}
+
+func TestPreStopUnmount(t *testing.T) {
+	const target = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv-1/mount"
+	tests := []struct {
+		name        string
+		mounts      string
+		wantUnmount bool
+	}{
+		{name: "own mount", mounts: "vol-1:mounter-a " + target + " fuse.rclone rw 0 0\n", wantUnmount: true},
+		{name: "repaired by the next pod", mounts: "vol-1:mounter-b " + target + " fuse.rclone rw 0 0\n"},
+		{name: "already unmounted", mounts: "proc /proc proc rw 0 0\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mounts := filepath.Join(t.TempDir(), "mounts")
+			if err := ioutil.WriteFile(mounts, []byte(tc.mounts), 0644); err != nil {
+				t.Fatal(err)
+			}
+			script := strings.Replace(preStopUnmount("vol-1:$POD_NAME", target), "/proc/mounts", mounts, 1)
+			cmd := exec.Command("sh", "-c", "umount() { echo unmounted \"$@\"; }\n"+script)
+			cmd.Env = []string{"POD_NAME=mounter-a"}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("PreStop hook failed: %v", err)
+			}
+			if got := strings.TrimSpace(string(out)); (got == "unmounted "+target) != tc.wantUnmount {
+				t.Errorf("expected unmount %v, got %q", tc.wantUnmount, got)
+			}
+		})
+	}
+}
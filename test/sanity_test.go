@@ -1,54 +1,119 @@
 package test
 
 import (
-	"github.com/kubernetes-csi/csi-test/pkg/sanity"
-	"github.com/wunderio/csi-rclone/pkg/kube"
-	"github.com/wunderio/csi-rclone/pkg/rclone"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/kubernetes-csi/csi-test/utils"
+	"github.com/wunderio/csi-rclone/pkg/rclone"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sexec "k8s.io/utils/exec"
 )
 
-func TestMyDriver(t *testing.T) {
-	// Setup the full driver and its environment
-	endpoint := "unix:///plugin/csi.sock"
-	kubeClient, err := kube.GetK8sClient()
+// TestSanity runs the CSI sanity suite against a driver serving a local
+// rclone remote from a temp dir, with a fake kube client and rclone mount
+// processes, so it needs no cluster or network. It needs root, /dev/fuse, and
+// rclone and fusermount in PATH. Stage, snapshot and expansion specs run when
+// the driver advertises the matching capability.
+func TestSanity(t *testing.T) {
+	if _, err := exec.LookPath("rclone"); err != nil {
+		t.Skip("rclone not found in PATH")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("/dev/fuse not available")
+	}
+	if !hasFusermount() {
+		t.Skip("fusermount not found in PATH")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "csi-rclone-sanity")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.Mkdir(remoteDir, 0755); err != nil {
+		t.Fatal(err)
 	}
-	driver := rclone.NewDriver("hostname", endpoint, kubeClient)
-	go driver.Run()
 
-	mntDir, err := ioutil.TempDir("/tmp/sanity/mount/", "mount")
+	secrets := map[string]string{"rclone.conf": "[local]\ntype = local\n"}
+	// JSON is valid YAML, which is what the secrets file is parsed as.
+	secretsFile := filepath.Join(dir, "secrets.yaml")
+	data, err := json.Marshal(map[string]map[string]string{
+		"CreateVolumeSecret":      secrets,
+		"DeleteVolumeSecret":      secrets,
+		"NodePublishVolumeSecret": secrets,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	os.RemoveAll(mntDir)
-	//defer os.RemoveAll(mntDir)
+	if err := ioutil.WriteFile(secretsFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
 
-	mntStageDir, err := ioutil.TempDir("/tmp/sanity/stage/", "stage")
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	kubeClient := fake.NewSimpleClientset()
+	ops, err := rclone.NewProcessRclone(kubeClient, k8sexec.New(), "sanity-node")
 	if err != nil {
 		t.Fatal(err)
 	}
-	os.Getwd()
-	os.RemoveAll(mntStageDir)
-	//defer os.RemoveAll(mntStageDir)
-	cfg := &sanity.Config{
+	driver := rclone.NewDriver("sanity-node", endpoint, kubeClient, k8sexec.New(), rclone.WithOperations(ops), rclone.WithVolumeExpansion())
+	go driver.Run()
 
-		TargetPath:  mntDir,
-		StagingPath: mntStageDir,
+	cfg := &sanity.Config{
+		TargetPath:  filepath.Join(dir, "target"),
+		StagingPath: filepath.Join(dir, "staging"),
 		Address:     endpoint,
-		SecretsFile: "testdata/secrets.yaml",
+		SecretsFile: secretsFile,
 		TestVolumeParameters: map[string]string{
-			"remote": "minio",
-			"path":   "pruebas",
-			"csi.storage.k8s.io/provisioner-secret-name":             "rclone-secret",
-			"csi.storage.k8s.io/provisioner-secret-namespace":        "csi-rclone",
-			"csi.storage.k8s.io/controller-publish-secret-name":      "rclone-secret",
-			"csi.storage.k8s.io/controller-publish-secret-namespace": "csi-rclone",
-			//"csi.storage.k8s.io/node-publish-secret-name": "",
-			//"csi.storage.k8s.io/node-publish-secret-namespace": "${pvc.namespace}",
+			"remote": "local",
+			"path":   remoteDir,
 		},
 	}
+	if err := waitForDriver(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
 	sanity.Test(t, cfg)
 }
+
+func hasFusermount() bool {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForDriver blocks until the driver answers Probe on endpoint.
+func waitForDriver(endpoint string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		conn, err := utils.Connect(endpoint)
+		if err == nil {
+			_, err = csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+			conn.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}